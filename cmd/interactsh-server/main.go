@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/hex"
@@ -12,6 +13,7 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
@@ -37,6 +39,9 @@ var (
 	pprofServerAddress    = "127.0.0.1:8086"
 )
 
+// shutdownTimeout bounds the wait for the in-flight DNS queries on shutdown
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	cliOptions := &options.CLIServerOptions{}
 	flagSet := goflags.NewFlagSet()
@@ -49,35 +54,125 @@ func main() {
 		flagSet.StringVarP(&cliOptions.ListenIP, "listen-ip", "lip", "0.0.0.0", "public ip address to listen on"),
 		flagSet.IntVarP(&cliOptions.Eviction, "eviction", "e", 30, "number of days to persist interaction data in memory"),
 		flagSet.BoolVarP(&cliOptions.NoEviction, "no-eviction", "ne", false, "disable periodic data eviction from memory"),
+		flagSet.IntVarP(&cliOptions.MaxInteractionsPerID, "max-interactions", "mi", 0, "max number of interactions kept per correlation id, dropping the oldest (0 disables)"),
+		flagSet.StringSliceVarP(&cliOptions.ProtocolEviction, "protocol-eviction", "pe", []string{}, "per protocol eviction of the in-memory interactions (dns=1h,http=24h)", goflags.CommaSeparatedStringSliceOptions),
 		flagSet.BoolVarP(&cliOptions.Auth, "auth", "a", false, "enable authentication to server using random generated token"),
 		flagSet.StringVarP(&cliOptions.Token, "token", "t", "", "enable authentication to server using given token"),
 		flagSet.StringVar(&cliOptions.OriginURL, "acao-url", "*", "origin url to send in acao header to use web-client)"), // cli flag set to deprecate
 		flagSet.BoolVarP(&cliOptions.SkipAcme, "skip-acme", "sa", false, "skip acme registration (certificate checks/handshake + TLS protocols will be disabled)"),
+		flagSet.IntVar(&cliOptions.ACMELookupTimeout, "acme-lookup-timeout", 5, "seconds to wait for the acme challenge records before answering SERVFAIL"),
+		flagSet.BoolVar(&cliOptions.OfflineMode, "offline", false, "offline mode answering a fixed ip for every dns query without acme/tls/external dependencies"),
+		flagSet.StringVarP(&cliOptions.OfflineIP, "offline-ip", "oip", "127.0.0.1", "ip address to answer with in offline mode"),
+		flagSet.StringVar(&cliOptions.SinkholeIP, "sinkhole-ip", "", "ip address answered for subdomains without custom records instead of the server ip"),
+		flagSet.StringVar(&cliOptions.SinkholeIPv6, "sinkhole-ipv6", "", "ipv6 address answered for subdomains without custom records instead of the server ipv6"),
 		flagSet.BoolVarP(&cliOptions.ScanEverywhere, "scan-everywhere", "se", false, "scan canary token everywhere"),
+		flagSet.BoolVarP(&cliOptions.ScanRawQuery, "scan-raw-query", "srq", false, "also scan the raw dns query bytes (edns options) for canary tokens with scan-everywhere"),
+		flagSet.BoolVarP(&cliOptions.SignedLabels, "signed-labels", "sl", false, "only accept correlation ids followed by their token signature (<id>-<hmac>) (authenticated)"),
+		flagSet.BoolVarP(&cliOptions.LogUnsignedLabels, "log-unsigned", "lu", false, "log interactions carrying unsigned correlation ids"),
+		flagSet.StringSliceVarP(&cliOptions.HoneytokenLabels, "honeytoken-labels", "htl", []string{}, "labels stored as enriched high-priority interactions (authenticated)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVarP(&cliOptions.HoneytokenWebhook, "honeytoken-webhook", "htw", "", "url honeytoken interactions are posted to"),
+		flagSet.StringVar(&cliOptions.WebhookURL, "webhook-url", "", "url every interaction is posted to as json"),
+		flagSet.StringVar(&cliOptions.WebhookAuthHeader, "webhook-auth-header", "", "header (name: value) or authorization value sent to the webhook"),
+		flagSet.IntVar(&cliOptions.WebhookRetries, "webhook-retries", 3, "number of retries with backoff of a failed webhook delivery"),
+		flagSet.StringVar(&cliOptions.SyslogAddress, "syslog", "", "syslog server interactions are sent to ([udp|tcp|unix]://address)"),
+		flagSet.StringVar(&cliOptions.SyslogFacility, "syslog-facility", "local0", "facility of the syslog messages"),
+		flagSet.StringSliceVar(&cliOptions.KafkaBrokers, "kafka-brokers", []string{}, "kafka brokers interactions are produced to", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVar(&cliOptions.KafkaTopic, "kafka-topic", "", "kafka topic interactions are produced to keyed by correlation id"),
+		flagSet.StringVar(&cliOptions.KafkaUsername, "kafka-username", "", "kafka sasl username"),
+		flagSet.StringVar(&cliOptions.KafkaPassword, "kafka-password", "", "kafka sasl password"),
+		flagSet.StringVar(&cliOptions.KafkaSASLMechanism, "kafka-sasl-mechanism", "plain", "kafka sasl mechanism (plain, scram-sha-256, scram-sha-512)"),
+		flagSet.BoolVarP(&cliOptions.TOTPLabels, "totp-labels", "otp", false, "only accept correlation ids with an otp-<code> label carrying a valid time-based code (authenticated)"),
+		flagSet.IntVar(&cliOptions.TOTPPeriod, "totp-period", 30, "time step in seconds of the otp label codes"),
+		flagSet.IntVar(&cliOptions.TOTPSkew, "totp-skew", 1, "number of otp time steps accepted before and after the current one"),
 		flagSet.IntVarP(&cliOptions.CorrelationIdLength, "correlation-id-length", "cidl", settings.CorrelationIdLengthDefault, "length of the correlation id preamble"),
 		flagSet.IntVarP(&cliOptions.CorrelationIdNonceLength, "correlation-id-nonce-length", "cidn", settings.CorrelationIdNonceLengthDefault, "length of the correlation id nonce"),
+		flagSet.StringVarP(&cliOptions.CorrelationIdAlphabet, "correlation-id-alphabet", "cida", "", "characters of the correlation ids (lowercase letters, digits and dashes, default any alphanumeric)"),
+		flagSet.StringVarP(&cliOptions.CorrelationIdRegex, "correlation-id-regex", "cidre", "", "regex extracting the correlation id of the dns names from its first capture group"),
+		flagSet.StringVarP(&cliOptions.CorrelationIdSeparators, "correlation-id-split", "cids", "-_", "characters splitting the dns labels into the parts checked for correlation ids"),
 		flagSet.StringVar(&cliOptions.CertificatePath, "cert", "", "custom certificate path"),
 		flagSet.StringVar(&cliOptions.PrivateKeyPath, "privkey", "", "custom private key path"),
 		flagSet.StringVarP(&cliOptions.OriginIPHeader, "origin-ip-header", "oih", "", "HTTP header containing origin ip (interactsh behind a reverse proxy)"),
 		flagSet.IntVarP(&cliOptions.OriginIPEDNSopt, "origin-ip-ednsopt", "oie", -1, "ednsopt code containing origin ip (interactsh behind a reverse proxy)"),
+		flagSet.BoolVar(&cliOptions.OriginIPEDNSoptPort, "origin-ip-ednsopt-port", false, "read a 2-byte source port following the ip of the origin ednsopt"),
 	)
 
 	flagSet.CreateGroup("config", "config",
 		flagSet.StringSliceVarP(&cliOptions.Resolvers, "resolvers", "r", nil, "list of resolvers to use (file or comma separated)", goflags.FileCommaSeparatedStringSliceOptions),
 		flagSet.StringVar(&cliOptions.Config, "config", defaultConfigLocation, "flag configuration file"),
 		flagSet.BoolVarP(&cliOptions.DynamicResp, "dynamic-resp", "dr", false, "enable setting up arbitrary response data"),
-		flagSet.StringVarP(&cliOptions.CustomRecords, "custom-records", "cr", "", "custom dns records YAML file for DNS server"),
+		flagSet.StringVarP(&cliOptions.CustomRecords, "custom-records", "cr", "", "custom dns records file for DNS server (yaml, .csv or .hosts), reloaded on SIGHUP"),
+		flagSet.BoolVar(&cliOptions.StrictCustomRecords, "strict-custom-records", false, "fail on invalid custom dns records instead of skipping them"),
+		flagSet.BoolVar(&cliOptions.DisableDefaultRecords, "no-default-records", false, "disable the built-in cloud metadata (aws, alibaba, oracle) and localhost dns records"),
 		flagSet.StringVarP(&cliOptions.HTTPIndex, "http-index", "hi", "", "custom index file for http server"),
 		flagSet.StringVarP(&cliOptions.HTTPDirectory, "http-directory", "hd", "", "directory with files to serve with http server"),
 		flagSet.StringVarP(&cliOptions.HTTPReverseProxy, "http-reverse-proxy", "hrp", "", "the proxy for reverse proxy server"),
 		flagSet.StringSliceVarP(&cliOptions.HTTPReverseParams, "http-reverse-params", "hrps", []string{}, "the parameter list of reverse proxy destination", goflags.CommaSeparatedStringSliceOptions),
 		flagSet.BoolVarP(&cliOptions.HTTPReverseInsecureSkipVerify, "http-reverse-insecure-skip-verify", "hrisv", false, "controls whether a client verifies the server's certificate chain and host name"),
+		flagSet.StringSliceVarP(&cliOptions.CAARecords, "dns-caa-records", "dcaa", []string{}, "caa records answered for a domain (domain=0 issue \"letsencrypt.org\")", goflags.StringSliceOptions),
 		flagSet.StringSliceVarP(&cliOptions.DnsSubdomainRecords, "dns-subdomain-records", "dsr", []string{}, "DnsSubdomainRecords is the mapping relationship between subdomain and resolve, used for dns rebinding", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsSequenceRecords, "dns-sequence-records", "dsq", []string{}, "subdomain to ip sequence mapping (subdomain=ip1;ip2), successive queries return the next ip, used for dns rebinding", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&cliOptions.DnsDelegations, "dns-delegations", []string{}, "subdomain delegated to a name server with optional glue (subdomain=host[=ip]), answered with a referral", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsDNAMERecords, "dns-dname-records", "ddn", []string{}, "subdomain to target domain mapping (subdomain=target) answered with a DNAME and the synthesized CNAME", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsCDBypassRecords, "dns-cd-bypass-records", "dcd", []string{}, "subdomain to ip mapping (subdomain=ip) answered only for queries with the checking-disabled bit set", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsDirectQueryRecords, "dns-direct-query-records", "ddq", []string{}, "subdomain to ip mapping (subdomain=ip) answered only for direct (non-resolver) queries", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsDirectQuerySources, "dns-direct-query-sources", "ddqs", []string{}, "ips/cidrs whose dns queries are always considered direct", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.DnsSplitHorizon, "dns-split-horizon", "dsh", []string{}, "source cidr to ip mapping (cidr=ip) answered for A queries, first match wins", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVarP(&cliOptions.AnswerOrdering, "dns-answer-ordering", "dao", server.AnswerOrderingInsertion, "order of dns response records (insertion-order, rfc-order)"),
+		flagSet.StringVar(&cliOptions.EDNSPadding, "dns-edns-padding", "", "pad dns responses over encrypted transports (requested, always)"),
+		flagSet.StringVar(&cliOptions.StrictDomain, "dns-strict-domain", "", "answer queries outside the configured domains with an error (nxdomain, refused)"),
+		flagSet.StringVar(&cliOptions.DNSSECKeyPath, "dnssec-key", "", "bind .key file of the zsk signing responses to dnssec (do) queries, .private next to it"),
+		flagSet.StringVar(&cliOptions.DNSSECKSKPath, "dnssec-ksk", "", "bind .key file of the ksk signing the dnskey records (default -dnssec-key)"),
+		flagSet.StringSliceVar(&cliOptions.DnsAllowedQTypes, "dns-allowed-qtypes", []string{}, "query types answered and stored, others get an empty reply (e.g. A,TXT)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&cliOptions.DnsDeniedQTypes, "dns-denied-qtypes", []string{}, "query types answered with an empty reply and not stored (e.g. SOA,NS)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVar(&cliOptions.CDNSubtree, "dns-cdn-subtree", "", "subdomain label whose subtree rotates through the cdn pool (e.g. cdn)"),
+		flagSet.StringSliceVar(&cliOptions.CDNPool, "dns-cdn-pool", []string{}, "list of ips rotated for queries under the cdn subtree", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.IntVar(&cliOptions.CDNTTL, "dns-cdn-ttl", 5, "ttl forced on answers under the cdn subtree"),
+		flagSet.StringSliceVar(&cliOptions.FlakyLabels, "dns-flaky-labels", []string{}, "subdomains answered SERVFAIL on the first query of a source and normally on retries", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.IntVar(&cliOptions.MaxTrackedNames, "dns-max-tracked-names", server.DefaultMaxTrackedNames, "max names tracked by the sequence and flaky records, least recently used ones are evicted"),
+		flagSet.IntVar(&cliOptions.FlakyWindow, "dns-flaky-window", 30, "seconds during which retries of a flaky subdomain are answered normally"),
+		flagSet.IntVar(&cliOptions.DnsResponseDelay, "dns-response-delay", 0, "milliseconds to wait before answering dns queries (per query with a delay<duration> label, e.g. delay5s)"),
+		flagSet.IntVar(&cliOptions.DnsDedupWindow, "dns-dedup-window", 0, "seconds during which identical dns interactions (id, qtype, source ip) are stored once (0 disables)"),
+		flagSet.StringSliceVar(&cliOptions.DnsIgnoreNames, "dns-ignore-names", []string{}, "query names (or *suffixes) answered without storing their interactions (e.g. health checks)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&cliOptions.DnsIgnoreIDs, "dns-ignore-ids", []string{}, "correlation ids (or *suffixes) whose dns interactions are not stored", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.IntVar(&cliOptions.DnsMaxResponseDelay, "dns-max-response-delay", 10000, "maximum milliseconds to wait before answering dns queries"),
+		flagSet.BoolVar(&cliOptions.DNSDiscovery, "dns-discovery", false, "advertise server capabilities in the TXT record of _interactsh.<domain>"),
+		flagSet.BoolVar(&cliOptions.RefusePublicSuffixLabels, "dns-refuse-public-suffix", false, "answer REFUSED to queries whose first label is a public suffix"),
+		flagSet.StringVar(&cliOptions.PublicSuffixListPath, "dns-public-suffix-list", "", "public suffix list file to use instead of the bundled one"),
+		flagSet.StringVar(&cliOptions.MailHost, "dns-mail-host", "", "subdomain answered for MX queries (default mail)"),
+		flagSet.StringSliceVar(&cliOptions.NSRecords, "dns-ns-records", []string{}, "name servers of a domain (domain=host), replacing ns1/ns2", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVar(&cliOptions.MXRecords, "dns-mx-records", []string{}, "mail exchangers of a domain in order (domain=10 mx1.host,20 mx2.host), replacing the mail host", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringVar(&cliOptions.MailSPF, "dns-mail-spf", "", "spf txt record answered for the mail host (e.g. \"v=spf1 ip4:1.2.3.4 -all\")"),
+		flagSet.StringVar(&cliOptions.AuditEchoLabel, "dns-audit-echo", "", "subdomain answering a txt record with the query source ip and timestamp"),
+		flagSet.BoolVar(&cliOptions.EchoTXT, "dns-echo-txt", false, "answer txt queries with the queried name as received (0x20 casing)"),
+		flagSet.StringVar(&cliOptions.HINFOCpu, "dns-hinfo-cpu", "", "cpu string to answer for HINFO queries"),
+		flagSet.StringVar(&cliOptions.HINFOOs, "dns-hinfo-os", "", "os string to answer for HINFO queries"),
+		flagSet.IntVar(&cliOptions.SOASerial, "dns-soa-serial", 0, "serial of the SOA record, incremented on custom records reloads (0 uses the startup timestamp)"),
+		flagSet.IntVar(&cliOptions.SOARefresh, "dns-soa-refresh", 0, "refresh timer of the SOA record in seconds"),
+		flagSet.IntVar(&cliOptions.SOARetry, "dns-soa-retry", 0, "retry timer of the SOA record in seconds"),
+		flagSet.IntVar(&cliOptions.SOAExpire, "dns-soa-expire", 60, "expire timer of the SOA record in seconds"),
+		flagSet.IntVar(&cliOptions.SOAMinTTL, "dns-soa-minttl", 60, "minimum (negative caching) ttl of the SOA record in seconds"),
+		flagSet.StringVar(&cliOptions.ANAMEUpstream, "dns-aname-upstream", "1.1.1.1:53", "resolver of the aname custom record targets"),
+		flagSet.IntVar(&cliOptions.ANAMECacheTTL, "dns-aname-cache-ttl", 60, "seconds the resolved aname targets are cached for (0 disables)"),
 		flagSet.BoolVarP(&cliOptions.DiskStorage, "disk", "ds", false, "disk based storage"),
 		flagSet.StringVarP(&cliOptions.DiskStoragePath, "disk-path", "dsp", "", "disk storage path"),
+		flagSet.StringVarP(&cliOptions.SecondaryDiskStoragePath, "secondary-disk-path", "sdsp", "", "secondary disk storage path mirroring the interactions (migration)"),
+		flagSet.BoolVarP(&cliOptions.CompressStorage, "compress-storage", "cs", false, "gzip the interactions stored on disk"),
+		flagSet.BoolVarP(&cliOptions.SnapshotOnShutdown, "snapshot", "ss", false, "persist in-memory storage to a snapshot on shutdown and reload it on startup"),
+		flagSet.StringVarP(&cliOptions.SnapshotPath, "snapshot-path", "ssp", "", "in-memory storage snapshot file path"),
+		flagSet.StringVarP(&cliOptions.ExportOnShutdown, "export-on-shutdown", "eos", "", "ndjson file the stored interactions are exported to on shutdown"),
+		flagSet.StringVar(&cliOptions.RedisAddress, "redis", "", "redis server address storing the interactions shared by several instances"),
+		flagSet.StringVar(&cliOptions.RedisPassword, "redis-password", "", "redis server password"),
+		flagSet.IntVar(&cliOptions.RedisDB, "redis-db", 0, "redis server database"),
+		flagSet.IntVar(&cliOptions.MaxStorageWritesPerSec, "max-storage-writes", 0, "max interactions stored per second across all protocols, excess is answered but not stored (0 disables)"),
+		flagSet.StringVar(&cliOptions.DnsLogFile, "dns-log-file", "", "file to log every dns query to as json lines"),
+		flagSet.IntVar(&cliOptions.DnsLogMaxSizeMB, "dns-log-max-size", 100, "size in mb the dns query log is rotated at, keeping 3 backups (0 disables)"),
+		flagSet.IntVar(&cliOptions.DnsRateLimit, "dns-rate-limit", 0, "max dns queries per second per source ip, excess is refused and not stored (0 disables)"),
+		flagSet.IntVar(&cliOptions.DnsRateBurst, "dns-rate-burst", 0, "burst of dns queries allowed per source ip (default -dns-rate-limit)"),
+		flagSet.BoolVar(&cliOptions.DnsRateLimitExemptTrusted, "dns-rate-limit-exempt-trusted", false, "exempt the -real-ip-from addresses from the dns rate limit"),
 		flagSet.StringVarP(&cliOptions.HeaderServer, "server-header", "csh", "", "custom value of Server header in response"),
 		flagSet.BoolVarP(&cliOptions.NoVersionHeader, "disable-version", "dv", false, "disable publishing interactsh version in response header"),
-		flagSet.StringSliceVarP(&cliOptions.RealIPFrom, "real-ip-from", "rip", []string{}, "defines trusted addresses that are known to send correct replacement addresses", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.StringSliceVarP(&cliOptions.RealIPFrom, "real-ip-from", "rip", []string{}, "defines trusted addresses that are known to send correct replacement addresses (origin ip ednsopt, client subnet)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.BoolVar(&cliOptions.ProxyProtocol, "dns-proxy-protocol", false, "parse proxy protocol v1/v2 headers of dns over tcp connections from -real-ip-from addresses"),
 	)
 
 	flagSet.CreateGroup("update", "Update",
@@ -88,6 +183,11 @@ func main() {
 	flagSet.CreateGroup("services", "Services",
 		flagSet.IntVar(&cliOptions.DnsPort, "dns-port", 53, "port to use for dns service"),
 		flagSet.IntVar(&cliOptions.DnsTTL, "dns-ttl", 3600, "ttl to use for dns service"),
+		flagSet.IntVar(&cliOptions.TCPTTLOverride, "dns-tcp-ttl", 0, "ttl to use for dns responses over tcp, dot and doh (0 uses -dns-ttl)"),
+		flagSet.IntVar(&cliOptions.DoHPort, "doh-port", 0, "port to use for dns-over-https service (0 disables)"),
+		flagSet.StringSliceVar(&cliOptions.DnsTTLByType, "dns-ttl-by-type", []string{}, "ttl to use per record type (type=ttl, e.g. A=30,TXT=0)", goflags.CommaSeparatedStringSliceOptions),
+		flagSet.IntVar(&cliOptions.DnsEDNSUDPSize, "dns-edns-udp-size", 1232, "udp buffer size advertised in responses to edns queries"),
+		flagSet.StringVar(&cliOptions.DnsTTLJitter, "dns-ttl-jitter", "", "random ttl offset drawn per record, in seconds (30) or percent (20%)"),
 		flagSet.IntVar(&cliOptions.HttpPort, "http-port", 80, "port to use for http service"),
 		flagSet.IntVar(&cliOptions.HttpsPort, "https-port", 443, "port to use for https service"),
 		flagSet.IntVar(&cliOptions.SmtpPort, "smtp-port", 25, "port to use for smtp service"),
@@ -129,6 +229,15 @@ func main() {
 		os.Exit(0)
 	}
 
+	// offline mode must not reach any external service
+	if cliOptions.OfflineMode {
+		cliOptions.DisableUpdateCheck = true
+		cliOptions.SkipAcme = true
+		if cliOptions.IPAddress == "" {
+			cliOptions.IPAddress = cliOptions.OfflineIP
+		}
+	}
+
 	if !cliOptions.DisableUpdateCheck {
 		latestVersion, err := updateutils.GetToolVersionCallback("interactsh-server", options.Version)()
 		if err != nil {
@@ -193,13 +302,17 @@ func main() {
 		gologger.DefaultLogger.SetMaxLevel(levels.LevelDebug)
 	}
 
+	if err := serverOptions.ValidateCorrelationID(); err != nil {
+		gologger.Fatal().Msgf("Invalid correlation id options: %s\n", err)
+	}
+
 	// responder and smb can't be active at the same time
 	if cliOptions.Responder && cliOptions.Smb {
 		gologger.Fatal().Msgf("responder and smb can't be active at the same time\n")
 	}
 
 	// Requires auth if token is specified or enables it automatically for responder and smb options
-	if serverOptions.Token != "" || cliOptions.Responder || cliOptions.Smb || cliOptions.Ftp || cliOptions.LdapWithFullLogger {
+	if serverOptions.Token != "" || cliOptions.Responder || cliOptions.Smb || cliOptions.Ftp || cliOptions.LdapWithFullLogger || len(serverOptions.HoneytokenLabels) > 0 {
 		serverOptions.Auth = true
 	}
 
@@ -208,6 +321,11 @@ func main() {
 		serverOptions.Auth = true
 	}
 
+	// signed and one-time labels are keyed by the token
+	if serverOptions.SignedLabels || serverOptions.TOTPLabels {
+		serverOptions.Auth = true
+	}
+
 	// of in case a custom token is specified
 	if serverOptions.Token != "" {
 		serverOptions.Auth = true
@@ -229,36 +347,119 @@ func main() {
 	var store storage.Storage
 	storeOptions := storage.DefaultOptions
 	storeOptions.EvictionTTL = evictionTTL
+	storeOptions.ProtocolEvictionTTL = cliOptions.ProtocolEvictionTTL()
+	storeOptions.MaxInteractionsPerID = cliOptions.MaxInteractionsPerID
+	if len(storeOptions.ProtocolEvictionTTL) > 0 && (cliOptions.DiskStorage || cliOptions.RedisAddress != "") {
+		gologger.Warning().Msgf("protocol eviction only applies to the in-memory storage\n")
+	}
 	if cliOptions.DiskStorage {
 		if cliOptions.DiskStoragePath == "" {
 			gologger.Fatal().Msgf("disk storage path must be specified\n")
 		}
 		storeOptions.DbPath = cliOptions.DiskStoragePath
+		storeOptions.CompressStorage = cliOptions.CompressStorage
+	} else if cliOptions.CompressStorage && cliOptions.SecondaryDiskStoragePath == "" {
+		gologger.Warning().Msgf("storage compression only applies to the disk storage\n")
 	}
+	if cliOptions.SnapshotOnShutdown {
+		if cliOptions.SnapshotPath == "" {
+			gologger.Fatal().Msgf("snapshot path must be specified\n")
+		}
+		if cliOptions.DiskStorage {
+			gologger.Warning().Msgf("snapshot is ignored with disk based storage\n")
+		}
+		storeOptions.SnapshotPath = cliOptions.SnapshotPath
+	}
+
+	storeOptions.ExportPath = cliOptions.ExportOnShutdown
 
 	var err error
-	store, err = storage.New(&storeOptions)
+	if cliOptions.RedisAddress != "" {
+		if cliOptions.DiskStorage || cliOptions.SnapshotOnShutdown {
+			gologger.Warning().Msgf("disk storage and snapshot are ignored with redis storage\n")
+		}
+		if cliOptions.ExportOnShutdown != "" {
+			gologger.Warning().Msgf("export on shutdown is ignored with redis storage\n")
+		}
+		storeOptions.RedisAddress = cliOptions.RedisAddress
+		storeOptions.RedisPassword = cliOptions.RedisPassword
+		storeOptions.RedisDB = cliOptions.RedisDB
+		store, err = storage.NewRedis(&storeOptions)
+	} else {
+		store, err = storage.New(&storeOptions)
+	}
 	if err != nil {
 		gologger.Fatal().Msgf("couldn't create storage: %s\n", err)
 	}
 
 	serverOptions.Storage = store
 
-	if serverOptions.Auth {
-		_ = serverOptions.Storage.SetID(serverOptions.Token)
+	// a secondary disk storage mirrors the writes while migrating from the in-memory storage
+	var secondaryStore storage.Storage
+	if cliOptions.SecondaryDiskStoragePath != "" {
+		if cliOptions.DiskStorage && cliOptions.SecondaryDiskStoragePath == cliOptions.DiskStoragePath {
+			gologger.Fatal().Msgf("secondary disk storage path must differ from disk storage path\n")
+		}
+		secondaryStoreOptions := storage.DefaultOptions
+		secondaryStoreOptions.EvictionTTL = evictionTTL
+		secondaryStoreOptions.MaxInteractionsPerID = cliOptions.MaxInteractionsPerID
+		secondaryStoreOptions.DbPath = cliOptions.SecondaryDiskStoragePath
+		secondaryStoreOptions.CompressStorage = cliOptions.CompressStorage
+		secondaryStore, err = storage.New(&secondaryStoreOptions)
+		if err != nil {
+			gologger.Fatal().Msgf("couldn't create secondary storage: %s\n", err)
+		}
+		serverOptions.SecondaryStorage = secondaryStore
 	}
 
 	serverOptions.Stats = &server.Metrics{}
+	if serverOptions.Auth {
+		_ = serverOptions.SetStorageID(serverOptions.Token)
+	}
+	serverOptions.Counters = server.NewNameCounters(serverOptions.MaxTrackedNames)
+	if serverOptions.MaxStorageWritesPerSec > 0 {
+		serverOptions.StorageWriteLimiter = server.NewWriteLimiter(serverOptions.MaxStorageWritesPerSec)
+	}
+	if serverOptions.DnsLogFile != "" {
+		queryLog, err := server.NewQueryLog(serverOptions.DnsLogFile, serverOptions.DnsLogMaxSizeMB)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create DNS query log: %s\n", err)
+		}
+		serverOptions.DnsQueryLog = queryLog
+	}
+	if serverOptions.SyslogAddress != "" {
+		syslogWriter, err := server.NewSyslogWriter(serverOptions.SyslogAddress, serverOptions.SyslogFacility)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create syslog writer: %s\n", err)
+		}
+		serverOptions.Syslog = syslogWriter
+	}
+	if len(serverOptions.KafkaBrokers) > 0 {
+		kafkaSink, err := server.NewKafkaSink(serverOptions.KafkaBrokers, serverOptions.KafkaTopic, serverOptions.KafkaUsername, serverOptions.KafkaPassword, serverOptions.KafkaSASLMechanism)
+		if err != nil {
+			gologger.Fatal().Msgf("Could not create kafka sink: %s\n", err)
+		}
+		serverOptions.Kafka = kafkaSink
+	}
 
 	// If root-tld is enabled create a singleton unencrypted record in the store
 	if serverOptions.RootTLD {
 		for _, domain := range serverOptions.Domains {
-			_ = store.SetID(domain)
+			_ = serverOptions.SetStorageID(domain)
 		}
 	}
 
-	acmeStore := acme.NewProvider()
-	serverOptions.ACMEStore = acmeStore
+	var acmeStore *acme.Provider
+	if !serverOptions.OfflineMode {
+		acmeStore = acme.NewProvider()
+		serverOptions.ACMEStore = acmeStore
+	}
+
+	if serverOptions.StrictCustomRecords {
+		if err := server.ValidateCustomRecords(serverOptions); err != nil {
+			gologger.Fatal().Msgf("Could not load custom DNS records: %s\n", err)
+		}
+	}
 
 	dnsTcpServer := server.NewDNSServer("tcp", serverOptions)
 	dnsUdpServer := server.NewDNSServer("udp", serverOptions)
@@ -309,7 +510,9 @@ func main() {
 	serverOptions.CertFiles = certFiles
 
 	// manually cleans up stale OCSP from storage
-	acme.CleanupStorage()
+	if !serverOptions.OfflineMode {
+		acme.CleanupStorage()
+	}
 
 	httpServer, err := server.NewHTTPServer(serverOptions)
 	if err != nil {
@@ -319,6 +522,19 @@ func main() {
 	httpsAlive := make(chan bool)
 	go httpServer.ListenAndServe(tlsConfig, httpAlive, httpsAlive)
 
+	dnsServers := []*server.DNSServer{dnsTcpServer, dnsUdpServer}
+	dohAlive := make(chan bool)
+	var dohServer *server.DoHServer
+	if serverOptions.DoHPort > 0 {
+		if tlsConfig == nil {
+			gologger.Warning().Msgf("DNS-over-HTTPS requires tls and will be disabled")
+		} else {
+			dohServer = server.NewDoHServer(serverOptions)
+			dnsServers = append(dnsServers, dohServer.DNSServer())
+			go dohServer.ListenAndServe(tlsConfig, dohAlive)
+		}
+	}
+
 	smtpServer, err := server.NewSMTPServer(serverOptions)
 	if err != nil {
 		gologger.Fatal().Msgf("Could not create SMTP server: %s", err)
@@ -392,6 +608,10 @@ func main() {
 				service = "HTTPS"
 				network = "TCP"
 				port = serverOptions.HttpsPort
+			case status = <-dohAlive:
+				service = "DoH"
+				network = "TCP"
+				port = serverOptions.DoHPort
 			case status = <-smtpAlive:
 				service = "SMTP"
 				network = "TCP"
@@ -443,15 +663,81 @@ func main() {
 		}()
 	}
 
+	// SIGHUP reloads the custom records and bumps the SOA serial
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			for _, dnsServer := range dnsServers {
+				if err := dnsServer.ReloadCustomRecords(); err != nil {
+					gologger.Warning().Msgf("Could not reload custom DNS records: %s\n", err)
+				}
+			}
+		}
+	}()
+
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	for range c {
+		// in-flight queries are answered and stored before closing the storage
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		for _, dnsServer := range []*server.DNSServer{dnsTcpServer, dnsUdpServer} {
+			if err := dnsServer.Shutdown(ctx); err != nil {
+				gologger.Warning().Msgf("Couldn't shut down the DNS server: %s\n", err)
+			}
+		}
+		if dohServer != nil {
+			if err := dohServer.Shutdown(ctx); err != nil {
+				gologger.Warning().Msgf("Couldn't shut down the DoH server: %s\n", err)
+			}
+		}
+		cancel()
+		if db, ok := store.(*storage.StorageDB); ok && storeOptions.ExportPath != "" {
+			if count, err := db.Export(); err != nil {
+				gologger.Warning().Msgf("Couldn't export the interactions: %s\n", err)
+			} else {
+				gologger.Info().Msgf("Exported %d interactions to %s\n", count, storeOptions.ExportPath)
+			}
+		}
 		if err := store.Close(); err != nil {
 			gologger.Warning().Msgf("Couldn't close the storage: %s\n", err)
 		}
+		if secondaryStore != nil {
+			if err := secondaryStore.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't close the secondary storage: %s\n", err)
+			}
+		}
 		if pprofServer != nil {
 			pprofServer.Close()
 		}
+		if serverOptions.DnsQueryLog != nil {
+			if err := serverOptions.DnsQueryLog.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't close the DNS query log: %s\n", err)
+			}
+		}
+		if serverOptions.Syslog != nil {
+			serverOptions.Syslog.Close()
+		}
+		if serverOptions.Kafka != nil {
+			if err := serverOptions.Kafka.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't flush the kafka sink: %s\n", err)
+			}
+		}
+		if serverOptions.ResultDispatcher != nil {
+			if err := serverOptions.ResultDispatcher.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't run the queued result callbacks: %s\n", err)
+			}
+		}
+		if serverOptions.Webhook != nil {
+			if err := serverOptions.Webhook.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't flush the webhook: %s\n", err)
+			}
+		}
+		if serverOptions.HoneytokenRecorder != nil {
+			if err := serverOptions.HoneytokenRecorder.Close(); err != nil {
+				gologger.Warning().Msgf("Couldn't record the queued honeytoken hits: %s\n", err)
+			}
+		}
 		os.Exit(1)
 	}
 }
@@ -1,7 +1,13 @@
 package options
 
 import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/projectdiscovery/goflags"
+	"github.com/projectdiscovery/gologger"
 	"github.com/projectdiscovery/interactsh/pkg/server"
 )
 
@@ -12,7 +18,75 @@ type CLIServerOptions struct {
 	Debug                         bool
 	Domains                       goflags.StringSlice
 	DnsTTL                        int
+	MaxStorageWritesPerSec        int
+	DnsLogFile                    string
+	DnsLogMaxSizeMB               int
+	DnsRateLimit                  int
+	DnsRateBurst                  int
+	DnsRateLimitExemptTrusted     bool
+	SecondaryDiskStoragePath      string
+	CompressStorage               bool
+	TCPTTLOverride                int
+	DoHPort                       int
+	DnsTTLByType                  goflags.StringSlice
+	DnsTTLJitter                  string
+	DnsEDNSUDPSize                int
 	DnsSubdomainRecords           goflags.StringSlice
+	CAARecords                    goflags.StringSlice
+	DnsSequenceRecords            goflags.StringSlice
+	DnsDNAMERecords               goflags.StringSlice
+	DnsDelegations                goflags.StringSlice
+	DnsCDBypassRecords            goflags.StringSlice
+	DnsDirectQueryRecords         goflags.StringSlice
+	DnsDirectQuerySources         goflags.StringSlice
+	DnsSplitHorizon               goflags.StringSlice
+	AnswerOrdering                string
+	EDNSPadding                   string
+	StrictDomain                  string
+	DnsAllowedQTypes              goflags.StringSlice
+	DNSSECKeyPath                 string
+	DNSSECKSKPath                 string
+	DnsDeniedQTypes               goflags.StringSlice
+	CDNSubtree                    string
+	CDNPool                       goflags.StringSlice
+	CDNTTL                        int
+	FlakyLabels                   goflags.StringSlice
+	HoneytokenLabels              goflags.StringSlice
+	HoneytokenWebhook             string
+	WebhookURL                    string
+	WebhookAuthHeader             string
+	WebhookRetries                int
+	SyslogAddress                 string
+	SyslogFacility                string
+	KafkaBrokers                  goflags.StringSlice
+	KafkaTopic                    string
+	KafkaUsername                 string
+	KafkaPassword                 string
+	KafkaSASLMechanism            string
+	FlakyWindow                   int
+	DnsResponseDelay              int
+	DnsDedupWindow                int
+	DnsIgnoreNames                goflags.StringSlice
+	DnsIgnoreIDs                  goflags.StringSlice
+	ProxyProtocol                 bool
+	DnsMaxResponseDelay           int
+	MaxTrackedNames               int
+	DNSDiscovery                  bool
+	RefusePublicSuffixLabels      bool
+	PublicSuffixListPath          string
+	MailHost                      string
+	NSRecords                     goflags.StringSlice
+	MXRecords                     goflags.StringSlice
+	MailSPF                       string
+	AuditEchoLabel                string
+	EchoTXT                       bool
+	HINFOCpu                      string
+	HINFOOs                       string
+	SOASerial                     int
+	SOARefresh                    int
+	SOARetry                      int
+	SOAExpire                     int
+	SOAMinTTL                     int
 	DnsPort                       int
 	IPAddress                     string
 	IPv6Address                   string
@@ -23,6 +97,8 @@ type CLIServerOptions struct {
 	LdapWithFullLogger            bool
 	Eviction                      int
 	NoEviction                    bool
+	ProtocolEviction              goflags.StringSlice
+	MaxInteractionsPerID          int
 	Responder                     bool
 	Smb                           bool
 	SmbPort                       int
@@ -42,18 +118,42 @@ type CLIServerOptions struct {
 	Token                         string
 	OriginURL                     string
 	RootTLD                       bool
+	SignedLabels                  bool
+	LogUnsignedLabels             bool
+	TOTPLabels                    bool
+	TOTPPeriod                    int
+	TOTPSkew                      int
 	FTPDirectory                  string
 	SkipAcme                      bool
+	OfflineMode                   bool
+	OfflineIP                     string
+	ACMELookupTimeout             int
+	SinkholeIP                    string
+	SinkholeIPv6                  string
+	ANAMEUpstream                 string
+	ANAMECacheTTL                 int
 	DynamicResp                   bool
 	CorrelationIdLength           int
 	CorrelationIdNonceLength      int
+	CorrelationIdAlphabet         string
+	CorrelationIdRegex            string
+	CorrelationIdSeparators       string
 	ScanEverywhere                bool
+	ScanRawQuery                  bool
 	CertificatePath               string
 	CustomRecords                 string
+	StrictCustomRecords           bool
+	DisableDefaultRecords         bool
 	PrivateKeyPath                string
 	OriginIPHeader                string
 	DiskStorage                   bool
 	DiskStoragePath               string
+	RedisAddress                  string
+	RedisPassword                 string
+	RedisDB                       int
+	SnapshotOnShutdown            bool
+	SnapshotPath                  string
+	ExportOnShutdown              string
 	EnablePprof                   bool
 	EnableMetrics                 bool
 	Verbose                       bool
@@ -61,6 +161,7 @@ type CLIServerOptions struct {
 	NoVersionHeader               bool
 	RealIPFrom                    goflags.StringSlice
 	OriginIPEDNSopt               int
+	OriginIPEDNSoptPort           bool
 	HeaderServer                  string
 }
 
@@ -69,7 +170,73 @@ func (cliServerOptions *CLIServerOptions) AsServerOptions() *server.Options {
 		Domains:                       cliServerOptions.Domains,
 		DnsPort:                       cliServerOptions.DnsPort,
 		DnsTTL:                        cliServerOptions.DnsTTL,
+		TCPTTLOverride:                cliServerOptions.TCPTTLOverride,
+		DoHPort:                       cliServerOptions.DoHPort,
+		DnsTTLByType:                  parseTTLByType(cliServerOptions.DnsTTLByType),
+		DnsTTLJitter:                  cliServerOptions.DnsTTLJitter,
+		DnsEDNSUDPSize:                cliServerOptions.DnsEDNSUDPSize,
+		MaxStorageWritesPerSec:        cliServerOptions.MaxStorageWritesPerSec,
+		DnsLogFile:                    cliServerOptions.DnsLogFile,
+		DnsLogMaxSizeMB:               cliServerOptions.DnsLogMaxSizeMB,
+		DnsRateLimit:                  cliServerOptions.DnsRateLimit,
+		DnsRateBurst:                  cliServerOptions.DnsRateBurst,
+		DnsRateLimitExemptTrusted:     cliServerOptions.DnsRateLimitExemptTrusted,
 		DnsSubdomainRecords:           cliServerOptions.DnsSubdomainRecords,
+		CAARecords:                    cliServerOptions.CAARecords,
+		SequenceRecords:               parseSequenceRecords(cliServerOptions.DnsSequenceRecords),
+		DNAMERecords:                  parseDNAMERecords(cliServerOptions.DnsDNAMERecords),
+		Delegations:                   parseDelegations(cliServerOptions.DnsDelegations),
+		CDBypassRecords:               parseLabelIPv4Records("DnsCDBypassRecord", cliServerOptions.DnsCDBypassRecords),
+		DirectQueryOnlyRecords:        parseLabelIPv4Records("DnsDirectQueryRecord", cliServerOptions.DnsDirectQueryRecords),
+		DirectQuerySources:            cliServerOptions.DnsDirectQuerySources,
+		SplitHorizon:                  parseSplitHorizon(cliServerOptions.DnsSplitHorizon),
+		AnswerOrdering:                cliServerOptions.AnswerOrdering,
+		EDNSPadding:                   cliServerOptions.EDNSPadding,
+		StrictDomain:                  cliServerOptions.StrictDomain,
+		DnsAllowedQTypes:              cliServerOptions.DnsAllowedQTypes,
+		DNSSECKeyPath:                 cliServerOptions.DNSSECKeyPath,
+		DNSSECKSKPath:                 cliServerOptions.DNSSECKSKPath,
+		DnsDeniedQTypes:               cliServerOptions.DnsDeniedQTypes,
+		CDNSubtree:                    cliServerOptions.CDNSubtree,
+		CDNPool:                       cliServerOptions.CDNPool,
+		CDNTTL:                        cliServerOptions.CDNTTL,
+		FlakyLabels:                   cliServerOptions.FlakyLabels,
+		FlakyWindow:                   time.Duration(cliServerOptions.FlakyWindow) * time.Second,
+		DnsResponseDelay:              time.Duration(cliServerOptions.DnsResponseDelay) * time.Millisecond,
+		DnsDedupWindow:                time.Duration(cliServerOptions.DnsDedupWindow) * time.Second,
+		DnsIgnoreNames:                cliServerOptions.DnsIgnoreNames,
+		DnsIgnoreIDs:                  cliServerOptions.DnsIgnoreIDs,
+		ProxyProtocol:                 cliServerOptions.ProxyProtocol,
+		DnsMaxResponseDelay:           time.Duration(cliServerOptions.DnsMaxResponseDelay) * time.Millisecond,
+		MaxTrackedNames:               cliServerOptions.MaxTrackedNames,
+		HoneytokenLabels:              cliServerOptions.HoneytokenLabels,
+		HoneytokenWebhook:             cliServerOptions.HoneytokenWebhook,
+		WebhookURL:                    cliServerOptions.WebhookURL,
+		WebhookAuthHeader:             cliServerOptions.WebhookAuthHeader,
+		WebhookRetries:                cliServerOptions.WebhookRetries,
+		SyslogAddress:                 cliServerOptions.SyslogAddress,
+		SyslogFacility:                cliServerOptions.SyslogFacility,
+		KafkaBrokers:                  cliServerOptions.KafkaBrokers,
+		KafkaTopic:                    cliServerOptions.KafkaTopic,
+		KafkaUsername:                 cliServerOptions.KafkaUsername,
+		KafkaPassword:                 cliServerOptions.KafkaPassword,
+		KafkaSASLMechanism:            cliServerOptions.KafkaSASLMechanism,
+		DNSDiscovery:                  cliServerOptions.DNSDiscovery,
+		RefusePublicSuffixLabels:      cliServerOptions.RefusePublicSuffixLabels,
+		PublicSuffixListPath:          cliServerOptions.PublicSuffixListPath,
+		MailHost:                      cliServerOptions.MailHost,
+		NSRecords:                     parseNSRecords(cliServerOptions.NSRecords),
+		MXRecords:                     parseMXRecords(cliServerOptions.MXRecords),
+		MailSPF:                       cliServerOptions.MailSPF,
+		AuditEchoLabel:                cliServerOptions.AuditEchoLabel,
+		EchoTXT:                       cliServerOptions.EchoTXT,
+		HINFOCpu:                      cliServerOptions.HINFOCpu,
+		HINFOOs:                       cliServerOptions.HINFOOs,
+		SOASerial:                     cliServerOptions.SOASerial,
+		SOARefresh:                    cliServerOptions.SOARefresh,
+		SOARetry:                      cliServerOptions.SOARetry,
+		SOAExpire:                     cliServerOptions.SOAExpire,
+		SOAMinTTL:                     cliServerOptions.SOAMinTTL,
 		IPAddress:                     cliServerOptions.IPAddress,
 		IPv6Address:                   cliServerOptions.IPv6Address,
 		ListenIP:                      cliServerOptions.ListenIP,
@@ -94,20 +261,206 @@ func (cliServerOptions *CLIServerOptions) AsServerOptions() *server.Options {
 		DynamicResp:                   cliServerOptions.DynamicResp,
 		OriginURL:                     cliServerOptions.OriginURL,
 		RootTLD:                       cliServerOptions.RootTLD,
+		SignedLabels:                  cliServerOptions.SignedLabels,
+		LogUnsignedLabels:             cliServerOptions.LogUnsignedLabels,
+		TOTPLabels:                    cliServerOptions.TOTPLabels,
+		TOTPPeriod:                    time.Duration(cliServerOptions.TOTPPeriod) * time.Second,
+		TOTPSkew:                      cliServerOptions.TOTPSkew,
+		OfflineMode:                   cliServerOptions.OfflineMode,
+		OfflineIP:                     cliServerOptions.OfflineIP,
+		ACMELookupTimeout:             time.Duration(cliServerOptions.ACMELookupTimeout) * time.Second,
+		SinkholeIP:                    cliServerOptions.SinkholeIP,
+		SinkholeIPv6:                  cliServerOptions.SinkholeIPv6,
+		ANAMEUpstream:                 cliServerOptions.ANAMEUpstream,
+		ANAMECacheTTL:                 time.Duration(cliServerOptions.ANAMECacheTTL) * time.Second,
 		FTPDirectory:                  cliServerOptions.FTPDirectory,
 		CorrelationIdLength:           cliServerOptions.CorrelationIdLength,
 		CorrelationIdNonceLength:      cliServerOptions.CorrelationIdNonceLength,
+		CorrelationIdAlphabet:         cliServerOptions.CorrelationIdAlphabet,
+		CorrelationIdRegex:            cliServerOptions.CorrelationIdRegex,
+		CorrelationIdSeparators:       cliServerOptions.CorrelationIdSeparators,
 		ScanEverywhere:                cliServerOptions.ScanEverywhere,
+		ScanRawQuery:                  cliServerOptions.ScanRawQuery,
 		CertificatePath:               cliServerOptions.CertificatePath,
 		CustomRecords:                 cliServerOptions.CustomRecords,
+		StrictCustomRecords:           cliServerOptions.StrictCustomRecords,
+		DisableDefaultRecords:         cliServerOptions.DisableDefaultRecords,
 		PrivateKeyPath:                cliServerOptions.PrivateKeyPath,
 		OriginIPHeader:                cliServerOptions.OriginIPHeader,
 		DiskStorage:                   cliServerOptions.DiskStorage,
 		DiskStoragePath:               cliServerOptions.DiskStoragePath,
+		RedisAddress:                  cliServerOptions.RedisAddress,
+		RedisPassword:                 cliServerOptions.RedisPassword,
+		RedisDB:                       cliServerOptions.RedisDB,
 		EnableMetrics:                 cliServerOptions.EnableMetrics,
 		NoVersionHeader:               cliServerOptions.NoVersionHeader,
 		HeaderServer:                  cliServerOptions.HeaderServer,
 		RealIPFrom:                    cliServerOptions.RealIPFrom,
 		OriginIPEDNSopt:               cliServerOptions.OriginIPEDNSopt,
+		OriginIPEDNSoptPort:           cliServerOptions.OriginIPEDNSoptPort,
+	}
+}
+
+// ProtocolEvictionTTL parses the per protocol eviction ttls in the protocol=duration format
+func (cliServerOptions *CLIServerOptions) ProtocolEvictionTTL() map[string]time.Duration {
+	ttls := make(map[string]time.Duration)
+	for _, value := range cliServerOptions.ProtocolEviction {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid ProtocolEviction: %s, err: expected protocol=duration.", value)
+			continue
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil || ttl <= 0 {
+			gologger.Warning().Msgf("Invalid ProtocolEviction: %s, err: invalid duration.", value)
+			continue
+		}
+		ttls[strings.ToLower(parts[0])] = ttl
+	}
+	return ttls
+}
+
+// parseSequenceRecords parses sequence records in the subdomain=ip1;ip2 format
+func parseSequenceRecords(values []string) map[string][]string {
+	records := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid DnsSequenceRecord: %s, err: expected subdomain=ip1;ip2.", value)
+			continue
+		}
+		label := strings.ToLower(parts[0])
+		for _, ip := range strings.Split(parts[1], ";") {
+			if net.ParseIP(ip) == nil {
+				gologger.Warning().Msgf("Invalid DnsSequenceRecord: %s, err: Invalid IP address %s.", value, ip)
+				continue
+			}
+			records[label] = append(records[label], ip)
+		}
+	}
+	return records
+}
+
+// parseDNAMERecords parses DNAME records in the subdomain=target format
+func parseDNAMERecords(values []string) map[string]string {
+	records := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			gologger.Warning().Msgf("Invalid DnsDNAMERecord: %s, err: expected subdomain=target.", value)
+			continue
+		}
+		records[strings.ToLower(parts[0])] = parts[1]
+	}
+	return records
+}
+
+// parseDelegations parses the subzone delegations in the subdomain=host[=ip] format
+func parseDelegations(values []string) map[string][]string {
+	delegations := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			gologger.Warning().Msgf("Invalid DnsDelegation: %s, err: expected subdomain=host[=ip].", value)
+			continue
+		}
+		if _, ip, ok := strings.Cut(parts[1], "="); ok && net.ParseIP(ip) == nil {
+			gologger.Warning().Msgf("Invalid DnsDelegation: %s, err: invalid glue ip.", value)
+			continue
+		}
+		label := strings.ToLower(parts[0])
+		delegations[label] = append(delegations[label], parts[1])
+	}
+	return delegations
+}
+
+// parseTTLByType parses the per record type ttls in the type=ttl format
+func parseTTLByType(values []string) map[string]int {
+	ttls := make(map[string]int)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid DnsTTLByType: %s, err: expected type=ttl.", value)
+			continue
+		}
+		ttl, err := strconv.Atoi(parts[1])
+		if err != nil || ttl < 0 {
+			gologger.Warning().Msgf("Invalid DnsTTLByType: %s, err: invalid ttl.", value)
+			continue
+		}
+		ttls[strings.ToUpper(parts[0])] = ttl
+	}
+	return ttls
+}
+
+// parseNSRecords parses the name servers in the domain=host format
+func parseNSRecords(values []string) map[string][]string {
+	records := make(map[string][]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			gologger.Warning().Msgf("Invalid NSRecord: %s, err: expected domain=host.", value)
+			continue
+		}
+		records[parts[0]] = append(records[parts[0]], parts[1])
+	}
+	return records
+}
+
+// parseMXRecords parses the mail exchangers in the domain=pref host format
+// (or pref:host), values without a domain belonging to the previous one
+// e.g. example.com=10 mx1.example.com,20 mx2.example.com.
+func parseMXRecords(values []string) map[string][]server.MXRecord {
+	records := make(map[string][]server.MXRecord)
+	var domain string
+	for _, value := range values {
+		record := value
+		if parts := strings.SplitN(value, "=", 2); len(parts) == 2 {
+			domain, record = parts[0], parts[1]
+		}
+		pref, host, ok := strings.Cut(strings.TrimSpace(record), " ")
+		if !ok {
+			pref, host, ok = strings.Cut(record, ":")
+		}
+		host = strings.TrimSpace(host)
+		preference, err := strconv.ParseUint(pref, 10, 16)
+		if domain == "" || !ok || err != nil || host == "" {
+			gologger.Warning().Msgf("Invalid MXRecord: %s, err: expected domain=pref host.", value)
+			continue
+		}
+		records[domain] = append(records[domain], server.MXRecord{Host: host, Pref: uint16(preference)})
+	}
+	return records
+}
+
+// parseLabelIPv4Records parses the records of option in the subdomain=ip format
+func parseLabelIPv4Records(option string, values []string) map[string]string {
+	records := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid %s: %s, err: expected subdomain=ip.", option, value)
+			continue
+		}
+		if ip := net.ParseIP(parts[1]); ip == nil || ip.To4() == nil {
+			gologger.Warning().Msgf("Invalid %s: %s, err: Invalid IPv4 address.", option, value)
+			continue
+		}
+		records[strings.ToLower(parts[0])] = parts[1]
+	}
+	return records
+}
+
+// parseSplitHorizon parses split-horizon records in the cidr=ip format
+func parseSplitHorizon(values []string) []server.SplitHorizonRecord {
+	var records []server.SplitHorizonRecord
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid DnsSplitHorizon: %s, err: expected cidr=ip.", value)
+			continue
+		}
+		records = append(records, server.SplitHorizonRecord{CIDR: parts[0], IP: parts[1]})
 	}
+	return records
 }
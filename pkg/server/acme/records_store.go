@@ -24,8 +24,9 @@ func NewProvider() *Provider {
 	return &Provider{Mutex: sync.Mutex{}, recordMap: make(map[string]*RecordStore)}
 }
 
+// getZoneRecords returns the records of a zone, zone names being case-insensitive
 func (p *Provider) getZoneRecords(_ context.Context, zoneName string) *RecordStore {
-	return p.recordMap[zoneName]
+	return p.recordMap[strings.ToLower(zoneName)]
 }
 
 func compareRecords(a, b libdns.Record) bool {
@@ -51,7 +52,7 @@ func (p *Provider) AppendRecords(ctx context.Context, zoneName string, recs []li
 	zoneRecordStore := p.getZoneRecords(ctx, zoneName)
 	if zoneRecordStore == nil {
 		zoneRecordStore = new(RecordStore)
-		p.recordMap[zoneName] = zoneRecordStore
+		p.recordMap[strings.ToLower(zoneName)] = zoneRecordStore
 	}
 
 	// ACME DNS challenge need only one record, old record should be deleted
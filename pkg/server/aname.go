@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultANAMEUpstream resolves the ANAME targets when ANAMEUpstream is unset
+	defaultANAMEUpstream = "1.1.1.1:53"
+	// anameTimeout bounds the resolution of an ANAME target
+	anameTimeout = 2 * time.Second
+)
+
+// ANAMECache resolves the targets of the ANAME records through an upstream
+// resolver, keeping their A records for ttl. It is shared by the DNS listeners.
+type ANAMECache struct {
+	upstream string
+	ttl      time.Duration
+	client   *dns.Client
+	mu       sync.Mutex
+	entries  map[string]anameEntry
+}
+
+type anameEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewANAMECache returns a cache resolving through upstream (host:port),
+// a zero ttl disabling the caching.
+func NewANAMECache(upstream string, ttl time.Duration) *ANAMECache {
+	if upstream == "" {
+		upstream = defaultANAMEUpstream
+	}
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		upstream = net.JoinHostPort(upstream, "53")
+	}
+	return &ANAMECache{
+		upstream: upstream,
+		ttl:      ttl,
+		client:   &dns.Client{Timeout: anameTimeout},
+		entries:  make(map[string]anameEntry),
+	}
+}
+
+// Resolve returns the A records of target, following the CNAME chain
+// returned by the upstream resolver.
+func (c *ANAMECache) Resolve(target string) ([]net.IP, error) {
+	target = dns.Fqdn(strings.ToLower(target))
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[target]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(target, dns.TypeA)
+	m, _, err := c.client.Exchange(r, c.upstream)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not resolve aname target")
+	}
+	if m.Rcode != dns.RcodeSuccess {
+		return nil, errors.Errorf("could not resolve aname target %s: %s", target, dns.RcodeToString[m.Rcode])
+	}
+	var ips []net.IP
+	for _, rr := range m.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			ips = append(ips, a.A)
+		}
+	}
+
+	if c.ttl > 0 {
+		c.mu.Lock()
+		for name, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, name)
+			}
+		}
+		c.entries[target] = anameEntry{ips: ips, expires: now.Add(c.ttl)}
+		c.mu.Unlock()
+	}
+	return ips, nil
+}
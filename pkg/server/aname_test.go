@@ -0,0 +1,68 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// startTestUpstream answers the A queries of target.example.net. with a CNAME chain
+func startTestUpstream(t *testing.T, queries *int32) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	server := &dns.Server{PacketConn: conn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if r.Question[0].Name == "target.example.net." {
+			m.Answer = append(m.Answer,
+				&dns.CNAME{Hdr: dns.RR_Header{Name: "target.example.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: "lb.example.net."},
+				&dns.A{Hdr: dns.RR_Header{Name: "lb.example.net.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("198.51.100.10")},
+			)
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return conn.LocalAddr().String()
+}
+
+func TestANAMECache(t *testing.T) {
+	var queries int32
+	cache := NewANAMECache(startTestUpstream(t, &queries), time.Minute)
+
+	for i := 0; i < 2; i++ {
+		ips, err := cache.Resolve("TARGET.example.net")
+		require.Nil(t, err, "could not resolve aname target")
+		require.Len(t, ips, 1)
+		require.Equal(t, "198.51.100.10", ips[0].String(), "could not follow cname chain")
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&queries), "could not cache resolved target")
+
+	_, err := cache.Resolve("missing.example.net")
+	require.NotNil(t, err, "could not fail on nxdomain")
+}
+
+func TestDNSServerANAMERecords(t *testing.T) {
+	var queries int32
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("aname:\n  \"@\": target.example.net\n  www: target.example.net\n  broken: missing.example.net\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path, ANAMEUpstream: startTestUpstream(t, &queries)})
+
+	for _, name := range []string{"example.com", "www.example.com"} {
+		m := queryTestDNSServer(server, name, dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not get aname answer for %s", name)
+		require.Equal(t, "198.51.100.10", m.Answer[0].(*dns.A).A.String(), "could not flatten aname of %s", name)
+	}
+
+	m := queryTestDNSServer(server, "broken.example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not fall back on unresolved aname")
+}
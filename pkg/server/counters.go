@@ -0,0 +1,113 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxTrackedNames is the number of names tracked when MaxTrackedNames is unset
+const DefaultMaxTrackedNames = 100000
+
+const (
+	// sequenceCounterPrefix namespaces the sequence records counters
+	sequenceCounterPrefix = "sequence/"
+	// flakyCounterPrefix namespaces the flaky labels states
+	flakyCounterPrefix = "flaky/"
+	// dedupCounterPrefix namespaces the deduplicated DNS interactions
+	dedupCounterPrefix = "dedup/"
+)
+
+// NameCounters is a bounded set of per-name counters shared between
+// the DNS listeners of the server. The least recently used names are
+// evicted once the maximum number of tracked names is reached, so that
+// random subdomains can't grow the state unbounded.
+type NameCounters struct {
+	mu        sync.Mutex
+	maxNames  int
+	counters  map[string]*list.Element
+	lru       *list.List
+	evictions uint64
+}
+
+type nameCounter struct {
+	name    string
+	value   uint64
+	updated time.Time
+}
+
+// NewNameCounters returns a new empty set of counters tracking up to maxNames names.
+func NewNameCounters(maxNames int) *NameCounters {
+	if maxNames <= 0 {
+		maxNames = DefaultMaxTrackedNames
+	}
+	return &NameCounters{
+		maxNames: maxNames,
+		counters: make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// Next returns the current value of the counter for name and increments it.
+func (c *NameCounters) Next(name string) uint64 {
+	return c.NextWithin(name, 0)
+}
+
+// NextWithin is like Next but restarts the counter from zero when it was
+// last incremented more than window ago. A zero window never restarts it.
+func (c *NameCounters) NextWithin(name string, window time.Duration) uint64 {
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.counters[name]; ok {
+		c.lru.MoveToFront(element)
+		counter := element.Value.(*nameCounter)
+		if window > 0 && now.Sub(counter.updated) > window {
+			counter.value = 0
+		}
+		counter.updated = now
+		counter.value++
+		return counter.value - 1
+	}
+
+	if c.lru.Len() >= c.maxNames {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.counters, oldest.Value.(*nameCounter).name)
+		atomic.AddUint64(&c.evictions, 1)
+	}
+	c.counters[name] = c.lru.PushFront(&nameCounter{name: name, value: 1, updated: now})
+	return 0
+}
+
+// Values returns a snapshot of the current values of the counters
+// whose name starts with prefix, keyed by the name without prefix.
+func (c *NameCounters) Values(prefix string) map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	values := make(map[string]uint64)
+	for name, element := range c.counters {
+		if strings.HasPrefix(name, prefix) {
+			values[strings.TrimPrefix(name, prefix)] = element.Value.(*nameCounter).value
+		}
+	}
+	return values
+}
+
+// Len returns the number of tracked names.
+func (c *NameCounters) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len()
+}
+
+// Evictions returns the number of names evicted so far.
+func (c *NameCounters) Evictions() uint64 {
+	return atomic.LoadUint64(&c.evictions)
+}
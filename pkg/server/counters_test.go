@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameCountersEviction(t *testing.T) {
+	counters := NewNameCounters(2)
+
+	require.Equal(t, uint64(0), counters.Next("a"))
+	require.Equal(t, uint64(0), counters.Next("b"))
+	require.Equal(t, uint64(1), counters.Next("a"), "could not increment counter")
+	require.Equal(t, uint64(0), counters.Next("c"))
+
+	require.Equal(t, 2, counters.Len(), "could not bound tracked names")
+	require.Equal(t, uint64(1), counters.Evictions(), "could not count evictions")
+	require.Equal(t, map[string]uint64{"a": 2, "c": 1}, counters.Values(""), "could not evict least recently used name")
+}
+
+func TestNameCountersNextWithin(t *testing.T) {
+	counters := NewNameCounters(0)
+
+	require.Equal(t, uint64(0), counters.NextWithin("flaky", time.Minute))
+	require.Equal(t, uint64(1), counters.NextWithin("flaky", time.Minute), "could not keep counter within window")
+	require.Equal(t, uint64(0), counters.NextWithin("flaky", time.Nanosecond), "could not restart counter after window")
+}
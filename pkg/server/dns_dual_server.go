@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+
+	"github.com/projectdiscovery/gologger"
+	"go.uber.org/multierr"
+)
+
+// DualDNSServer serves the DNS queries over both UDP and TCP, reporting a
+// single readiness for the two listeners.
+type DualDNSServer struct {
+	UDP *DNSServer
+	TCP *DNSServer
+}
+
+// NewDualDNSServer returns a new DNS server listening on both UDP and TCP.
+func NewDualDNSServer(options *Options) *DualDNSServer {
+	return &DualDNSServer{
+		UDP: NewDNSServer("udp", options),
+		TCP: NewDNSServer("tcp", options),
+	}
+}
+
+// ListenAndServe binds both listeners before reporting them alive, failing
+// fast if either can't be bound. The failure of a listener stops the other.
+func (d *DualDNSServer) ListenAndServe(dnsAlive chan bool) {
+	if err := d.listen(); err != nil {
+		gologger.Error().Msgf("Could not listen for DNS on %s (%s)\n", d.UDP.server.Addr, err)
+		dnsAlive <- false
+		return
+	}
+	dnsAlive <- true
+
+	errs := make(chan error, 2)
+	for _, server := range []*DNSServer{d.UDP, d.TCP} {
+		go func(server *DNSServer) {
+			errs <- server.server.ActivateAndServe()
+		}(server)
+	}
+	failed := false
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil && !failed {
+			failed = true
+			gologger.Error().Msgf("Could not serve DNS on %s (%s)\n", d.UDP.server.Addr, err)
+			dnsAlive <- false
+			_ = d.Shutdown(context.Background())
+		}
+	}
+}
+
+// listen binds the UDP listener then the TCP one on the same port, the UDP
+// listener being closed if the TCP one can't be bound.
+func (d *DualDNSServer) listen() error {
+	if err := d.UDP.listen(); err != nil {
+		return err
+	}
+	// a zero port gets the one picked for UDP
+	d.TCP.server.Addr = d.UDP.server.PacketConn.LocalAddr().String()
+	if err := d.TCP.listen(); err != nil {
+		_ = d.UDP.server.PacketConn.Close()
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops both listeners and waits for the in-flight queries to be
+// answered or for ctx to be done.
+func (d *DualDNSServer) Shutdown(ctx context.Context) error {
+	return multierr.Combine(d.UDP.Shutdown(ctx), d.TCP.Shutdown(ctx))
+}
+
+// ReloadCustomRecords reloads the custom DNS records of both listeners
+func (d *DualDNSServer) ReloadCustomRecords() error {
+	return multierr.Combine(d.UDP.ReloadCustomRecords(), d.TCP.ReloadCustomRecords())
+}
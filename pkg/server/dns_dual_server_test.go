@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDualDNSServer(t *testing.T) {
+	options := &Options{ListenIP: "127.0.0.1"}
+	newTestDNSServer(t, options)
+	server := NewDualDNSServer(options)
+	started := make(chan struct{}, 2)
+	for _, s := range []*DNSServer{server.UDP, server.TCP} {
+		s.server.NotifyStartedFunc = func() { started <- struct{}{} }
+	}
+	dnsAlive := make(chan bool, 2)
+	go server.ListenAndServe(dnsAlive)
+	require.True(t, <-dnsAlive, "could not bind listeners")
+	<-started
+	<-started
+
+	addr := server.UDP.server.PacketConn.LocalAddr().String()
+	require.Equal(t, addr, server.TCP.server.Listener.Addr().String(), "could not share port")
+	for _, network := range []string{"udp", "tcp"} {
+		r := new(dns.Msg)
+		r.SetQuestion("test.example.com.", dns.TypeA)
+		m, _, err := (&dns.Client{Net: network}).Exchange(r, addr)
+		require.Nil(t, err, "could not query over %s", network)
+		require.Len(t, m.Answer, 1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.Nil(t, server.Shutdown(ctx), "could not shut down listeners")
+}
+
+func TestDualDNSServerBindFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	options := &Options{ListenIP: "127.0.0.1", DnsPort: port}
+	newTestDNSServer(t, options)
+	server := NewDualDNSServer(options)
+	dnsAlive := make(chan bool, 1)
+	server.ListenAndServe(dnsAlive)
+	require.False(t, <-dnsAlive, "could not fail on tcp bind failure")
+
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	require.Nil(t, err, "could not release udp listener")
+	conn.Close()
+}
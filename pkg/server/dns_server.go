@@ -1,89 +1,432 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	jsoniter "github.com/json-iterator/go"
+	"github.com/libdns/libdns"
 	"github.com/miekg/dns"
 	"github.com/pkg/errors"
 	"github.com/projectdiscovery/gologger"
 	"github.com/projectdiscovery/interactsh/pkg/server/acme"
+	sliceutil "github.com/projectdiscovery/utils/slice"
 	stringsutil "github.com/projectdiscovery/utils/strings"
 	"gopkg.in/yaml.v3"
 )
 
 var (
-	HEX_IP_REGEX = regexp.MustCompile("^[a-f0-9]{8}$")
+	HEX_IP_REGEX   = regexp.MustCompile("^[a-f0-9]{8}$")
+	HEX_IPV6_REGEX = regexp.MustCompile("^[a-f0-9]{32}$")
 )
 
+const (
+	// AnswerOrderingInsertion keeps records in the order handlers added them
+	AnswerOrderingInsertion = "insertion-order"
+	// AnswerOrderingRFC places CNAMEs before the records they alias and sorts additional records
+	AnswerOrderingRFC = "rfc-order"
+
+	// EDNSPaddingRequested pads responses to requests carrying a padding option
+	EDNSPaddingRequested = "requested"
+	// EDNSPaddingAlways pads every response
+	EDNSPaddingAlways = "always"
+
+	// StrictDomainNXDomain answers NXDOMAIN to queries outside the configured domains
+	StrictDomainNXDomain = "nxdomain"
+	// StrictDomainRefused answers REFUSED to queries outside the configured domains
+	StrictDomainRefused = "refused"
+)
+
+const (
+	// flakyPhaseServfail is the phase of the first query for a flaky name
+	flakyPhaseServfail = "servfail"
+	// flakyPhaseRetry is the phase of the retries answered normally
+	flakyPhaseRetry = "retry"
+)
+
+const (
+	// queryOriginDirect is the origin of queries sent directly by a client
+	queryOriginDirect = "direct"
+	// queryOriginRecursive is the origin of queries sent by a recursive resolver
+	queryOriginRecursive = "recursive"
+)
+
+// ednsPaddingBlockSize is the block size responses are padded to (RFC 8467)
+const ednsPaddingBlockSize = 468
+
+// defaultEDNSUDPSize is the UDP buffer size advertised when DnsEDNSUDPSize is unset (DNS flag day 2020)
+const defaultEDNSUDPSize = 1232
+
+// maxCNAMEChain is the maximum number of custom CNAMEs followed in an answer
+const maxCNAMEChain = 8
+
 // DNSServer is a DNS server instance that listens on port 53.
 type DNSServer struct {
 	options       *Options
-	mxDomains     map[string]string
+	mxDomains     map[string][]MXRecord
 	nsDomains     map[string][]string
 	ipAddress     net.IP
 	ipv6Address   net.IP
+	offlineIP     net.IP
+	sinkholeIP    net.IP
+	sinkholeIPv6  net.IP
+	splitHorizon  []splitHorizonNetwork
+	cdnSuffixes   []string
+	cdnPool       []net.IP
+	cdnCounter    uint64
+	suffixList    *publicSuffixList
+	encrypted     bool
+	flakyLabels   map[string]struct{}
+	honeytokens   map[string]struct{}
+	directSources []*net.IPNet
 	timeToLive    uint32
+	tcpTTL        uint32
+	ttlByType     map[uint16]uint32
+	ttlJitter     ttlJitter
+	allowedQTypes map[string]struct{}
+	deniedQTypes  map[string]struct{}
+	idRegex       *regexp.Regexp
+	dnssec        *dnssecSigner
 	server        *dns.Server
-	customRecords *customDNSRecords
+	customRecords atomic.Pointer[customDNSRecords]
+	soaSerial     atomic.Uint32
+	noIPWarning   sync.Once
 	TxtRecord     string // used for ACME verification
 }
 
 // NewDNSServer returns a new DNS server.
 func NewDNSServer(network string, options *Options) *DNSServer {
-	mxDomains := make(map[string]string)
+	mxDomains := make(map[string][]MXRecord)
 	nsDomains := make(map[string][]string)
 
 	for _, domain := range options.Domains {
 		dotdomain := dns.Fqdn(domain)
 
-		mxDomain := fmt.Sprintf("mail.%s", dotdomain)
-		mxDomains[dotdomain] = mxDomain
+		mailHost := "mail"
+		if options.MailHost != "" {
+			mailHost = strings.ToLower(options.MailHost)
+		}
+		mxDomain := fmt.Sprintf("%s.%s", mailHost, dotdomain)
+		mxDomains[dotdomain] = []MXRecord{{Host: mxDomain, Pref: 1}}
 
 		ns1Domain := fmt.Sprintf("ns1.%s", dotdomain)
 		ns2Domain := fmt.Sprintf("ns2.%s", dotdomain)
 		nsDomains[dotdomain] = []string{ns1Domain, ns2Domain}
 	}
+	// configured targets override the generated ones
+	for domain, hosts := range options.NSRecords {
+		dotdomain := dns.Fqdn(strings.ToLower(domain))
+		if _, ok := nsDomains[dotdomain]; !ok || len(hosts) == 0 {
+			gologger.Warning().Msgf("Invalid NSRecords domain: %s, err: not a configured domain.", domain)
+			continue
+		}
+		nsDomains[dotdomain] = nil
+		for _, host := range hosts {
+			nsDomains[dotdomain] = append(nsDomains[dotdomain], dns.Fqdn(strings.ToLower(host)))
+		}
+	}
+	for domain, records := range options.MXRecords {
+		dotdomain := dns.Fqdn(strings.ToLower(domain))
+		if _, ok := mxDomains[dotdomain]; !ok || len(records) == 0 {
+			gologger.Warning().Msgf("Invalid MXRecords domain: %s, err: not a configured domain.", domain)
+			continue
+		}
+		mxDomains[dotdomain] = nil
+		for _, record := range records {
+			mxDomains[dotdomain] = append(mxDomains[dotdomain], MXRecord{Host: dns.Fqdn(strings.ToLower(record.Host)), Pref: record.Pref})
+		}
+	}
 
 	server := &DNSServer{
-		options:       options,
-		ipAddress:     net.ParseIP(options.IPAddress),
-		ipv6Address:   net.ParseIP(options.IPv6Address),
-		mxDomains:     mxDomains,
-		nsDomains:     nsDomains,
-		timeToLive:    uint32(options.DnsTTL),
-		customRecords: newCustomDNSRecordsServer(options),
+		options:      options,
+		ipAddress:    net.ParseIP(options.IPAddress),
+		ipv6Address:  net.ParseIP(options.IPv6Address),
+		mxDomains:    mxDomains,
+		nsDomains:    nsDomains,
+		timeToLive:   uint32(options.DnsTTL),
+		splitHorizon: newSplitHorizonNetworks(options.SplitHorizon),
+		encrypted:    network == "tcp-tls" || network == "https",
+	}
+	if options.IPAddress != "" && (server.ipAddress == nil || server.ipAddress.To4() == nil) {
+		gologger.Warning().Msgf("Invalid IPAddress: %s, err: Invalid IPv4 address.", options.IPAddress)
+		server.ipAddress = nil
+	}
+	if options.IPv6Address != "" && server.ipv6Address == nil {
+		gologger.Warning().Msgf("Invalid IPv6Address: %s, err: Invalid IP address.", options.IPv6Address)
+	}
+	if options.SinkholeIP != "" {
+		if server.sinkholeIP = net.ParseIP(options.SinkholeIP); server.sinkholeIP == nil || server.sinkholeIP.To4() == nil {
+			gologger.Warning().Msgf("Invalid SinkholeIP: %s, err: Invalid IPv4 address.", options.SinkholeIP)
+			server.sinkholeIP = nil
+		}
+	}
+	if options.SinkholeIPv6 != "" {
+		if server.sinkholeIPv6 = net.ParseIP(options.SinkholeIPv6); server.sinkholeIPv6 == nil {
+			gologger.Warning().Msgf("Invalid SinkholeIPv6: %s, err: Invalid IP address.", options.SinkholeIPv6)
+		}
+	}
+	// the override covers the stream transports, DoT and DoH included
+	if network != "udp" && options.TCPTTLOverride > 0 {
+		server.tcpTTL = uint32(options.TCPTTLOverride)
+	}
+	for name, ttl := range options.DnsTTLByType {
+		rrtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			gologger.Warning().Msgf("Invalid DnsTTLByType type: %s, err: unknown record type.", name)
+			continue
+		}
+		if server.ttlByType == nil {
+			server.ttlByType = make(map[uint16]uint32)
+		}
+		server.ttlByType[rrtype] = uint32(ttl)
+	}
+	if options.DnsTTLJitter != "" {
+		jitter, err := parseTTLJitter(options.DnsTTLJitter)
+		if err != nil {
+			gologger.Warning().Msgf("Invalid DnsTTLJitter: %s, err: %s.", options.DnsTTLJitter, err)
+		} else {
+			server.ttlJitter = jitter
+		}
+	}
+	if options.DNSSECKeyPath != "" {
+		signer, err := newDNSSECSigner(options.DNSSECKeyPath, options.DNSSECKSKPath)
+		if err != nil {
+			gologger.Warning().Msgf("Could not load DNSSEC keys, responses will not be signed: %s", err)
+		} else {
+			server.dnssec = signer
+		}
+	}
+	if options.CorrelationIdRegex != "" {
+		idRegex, err := regexp.Compile(options.CorrelationIdRegex)
+		if err != nil {
+			gologger.Warning().Msgf("Invalid CorrelationIdRegex: %s, err: %s.", options.CorrelationIdRegex, err)
+		} else {
+			server.idRegex = idRegex
+		}
+	}
+	server.allowedQTypes = toQTypeSet(options.DnsAllowedQTypes)
+	server.deniedQTypes = toQTypeSet(options.DnsDeniedQTypes)
+	if options.CDNSubtree != "" {
+		for _, domain := range options.Domains {
+			server.cdnSuffixes = append(server.cdnSuffixes, "."+strings.ToLower(options.CDNSubtree)+"."+dns.Fqdn(domain))
+		}
+		for _, value := range options.CDNPool {
+			ip := net.ParseIP(value)
+			if ip == nil || ip.To4() == nil {
+				gologger.Warning().Msgf("Invalid CDNPool IP: %s, err: Invalid IPv4 address.", value)
+				continue
+			}
+			server.cdnPool = append(server.cdnPool, ip)
+		}
+	}
+	if options.OfflineMode {
+		server.offlineIP = net.ParseIP(options.OfflineIP)
+		if server.offlineIP == nil {
+			server.offlineIP = server.ipAddress
+		}
+	}
+	for _, source := range options.DirectQuerySources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); ip != nil && ip.To4() != nil {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			gologger.Warning().Msgf("Invalid DirectQuerySource: %s, err: %s.", source, err)
+			continue
+		}
+		server.directSources = append(server.directSources, network)
+	}
+	if len(options.HoneytokenLabels) > 0 {
+		server.honeytokens = make(map[string]struct{})
+		for _, label := range options.HoneytokenLabels {
+			server.honeytokens[strings.ToLower(label)] = struct{}{}
+		}
+	}
+	if len(options.FlakyLabels) > 0 {
+		server.flakyLabels = make(map[string]struct{})
+		for _, label := range options.FlakyLabels {
+			server.flakyLabels[strings.ToLower(label)] = struct{}{}
+		}
+	}
+	if options.RefusePublicSuffixLabels && options.PublicSuffixListPath != "" {
+		list, err := loadPublicSuffixList(options.PublicSuffixListPath)
+		if err != nil {
+			gologger.Error().Msgf("Could not load public suffix list, using the bundled one: %s\n", err)
+		}
+		server.suffixList = list
+	}
+	if options.SOASerial == 0 {
+		options.SOASerial = int(time.Now().Unix())
+	}
+	server.soaSerial.Store(uint32(options.SOASerial))
+	if options.SOAExpire == 0 {
+		options.SOAExpire = defaultSOAExpire
+	}
+	if options.SOAMinTTL == 0 {
+		options.SOAMinTTL = defaultSOAMinTTL
+	}
+	server.customRecords.Store(newCustomDNSRecordsServer(options))
+	if options.Counters == nil {
+		options.Counters = NewNameCounters(options.MaxTrackedNames)
+	}
+	if options.ANAMECache == nil {
+		options.ANAMECache = NewANAMECache(options.ANAMEUpstream, options.ANAMECacheTTL)
+	}
+	if len(options.HoneytokenLabels) > 0 && options.HoneytokenRecorder == nil {
+		options.HoneytokenRecorder = NewHoneytokenRecorder(options)
+	}
+	if options.DnsRateLimit > 0 && options.DnsRateLimiter == nil {
+		options.DnsRateLimiter = NewSourceLimiter(options.DnsRateLimit, options.DnsRateBurst, options.MaxTrackedNames)
+	}
+	if options.OnResult != nil && options.ResultDispatcher == nil {
+		options.ResultDispatcher = NewResultDispatcher(options.OnResult, resultWorkers)
+	}
+	if options.WebhookURL != "" && options.Webhook == nil {
+		options.Webhook = NewWebhook(options.WebhookURL, options.WebhookAuthHeader, options.WebhookRetries)
 	}
 	server.server = &dns.Server{
-		Addr:    options.ListenIP + fmt.Sprintf(":%d", options.DnsPort),
-		Net:     network,
-		Handler: server,
+		Addr:          options.ListenIP + fmt.Sprintf(":%d", options.DnsPort),
+		Net:           network,
+		Handler:       server,
+		MsgAcceptFunc: acceptMsg,
 	}
 	return server
 }
 
+// defaultACMELookupTimeout bounds the ACME challenge lookups when ACMELookupTimeout is unset
+const defaultACMELookupTimeout = 5 * time.Second
+
+// maxQuestions is the maximum number of questions of the accepted queries
+const maxQuestions = 8
+
+// acceptMsg accepts the queries accepted by miekg/dns along with the
+// queries carrying up to maxQuestions questions.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 && dh.Qdcount <= maxQuestions {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
 // ListenAndServe listens on dns ports for the server.
 func (h *DNSServer) ListenAndServe(dnsAlive chan bool) {
 	dnsAlive <- true
-	if err := h.server.ListenAndServe(); err != nil {
+	if err := h.listenAndServe(); err != nil {
 		gologger.Error().Msgf("Could not listen for %s DNS on %s (%s)\n", strings.ToUpper(h.server.Net), h.server.Addr, err)
 		dnsAlive <- false
 	}
 }
 
+// Shutdown stops the listener and waits for the in-flight queries to be
+// answered or for ctx to be done, ListenAndServe then returning.
+func (h *DNSServer) Shutdown(ctx context.Context) error {
+	return h.server.ShutdownContext(ctx)
+}
+
+// Close shuts the server down, waiting for the in-flight queries
+func (h *DNSServer) Close() error {
+	return h.Shutdown(context.Background())
+}
+
+// listenAndServe serves the queries, parsing the PROXY protocol headers
+// of the TCP connections from RealIPFrom if enabled.
+func (h *DNSServer) listenAndServe() error {
+	if !h.options.ProxyProtocol || h.server.Net != "tcp" {
+		return h.server.ListenAndServe()
+	}
+	if err := h.listen(); err != nil {
+		return err
+	}
+	return h.server.ActivateAndServe()
+}
+
+// listen binds the udp or tcp listener of the server, served by ActivateAndServe
+func (h *DNSServer) listen() error {
+	if h.server.Net == "udp" {
+		conn, err := net.ListenPacket("udp", h.server.Addr)
+		if err != nil {
+			return err
+		}
+		h.server.PacketConn = conn
+		return nil
+	}
+	listener, err := net.Listen("tcp", h.server.Addr)
+	if err != nil {
+		return err
+	}
+	if h.options.ProxyProtocol {
+		h.server.Listener = &proxyListener{Listener: listener, trusted: h.isRealIPSource}
+	} else {
+		h.server.Listener = listener
+	}
+	return nil
+}
+
+// queryConn is the connection a DNS query was received on
+type queryConn interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
 // ServeDNS is the default handler for DNS queries.
 func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := h.handleQuery(w, r)
+	h.logQuery(w, r, m)
+	if m == nil {
+		return
+	}
+	// delayed answers let clients detect the lookups by timing, each
+	// query being served on its own goroutine
+	if delay := h.getResponseDelay(r.Question[0].Name); delay > 0 {
+		time.Sleep(delay)
+	}
+	// udp answers larger than the requester buffer are truncated so that it retries over tcp
+	if h.server.Net == "udp" {
+		size := dns.MinMsgSize
+		if opt := r.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+		m.Truncate(size)
+	}
+	if err := w.WriteMsg(m); err != nil {
+		gologger.Warning().Msgf("Could not write DNS response: \n%s\n %s\n", m.String(), err)
+	}
+}
+
+// handleQuery returns the response to the query received on w, or nil if
+// the query must not be answered.
+func (h *DNSServer) handleQuery(w queryConn, r *dns.Msg) *dns.Msg {
 	atomic.AddUint64(&h.options.Stats.Dns, 1)
+	if !h.allowQuery(w, r) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		return m
+	}
+	if h.options.EnableMetrics {
+		// the latency includes the interaction storage writes
+		defer h.observeLatency(time.Now(), r)
+	}
 
 	m := new(dns.Msg)
 	m.SetReply(r)
@@ -91,15 +434,30 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 
 	// bail early for no queries.
 	if len(r.Question) == 0 {
-		return
+		return nil
+	}
+
+	// flaky names fail the first query and answer the retries
+	flakyPhase := h.checkFlakyPhase(r.Question[0].Name, w, r)
+	if flakyPhase == flakyPhaseServfail {
+		m.Rcode = dns.RcodeServerFailure
 	}
 
 	isDNSChallenge := false
 	for _, question := range r.Question {
+		if flakyPhase == flakyPhaseServfail {
+			break
+		}
 		domain := question.Name
 
+		if h.isPublicSuffixLabel(domain) {
+			gologger.Info().Msgf("Refusing public suffix label query for %s from %s\n", domain, h.getMsgHost(w, r))
+			m.Rcode = dns.RcodeRefused
+			continue
+		}
+
 		// Handle DNS server cases for ACME server
-		if strings.HasPrefix(strings.ToLower(domain), acme.DNSChallengeString) {
+		if !h.options.OfflineMode && strings.HasPrefix(strings.ToLower(domain), acme.DNSChallengeString) {
 			isDNSChallenge = true
 
 			gologger.Debug().Msgf("Got acme dns request: \n%s\n", r.String())
@@ -109,56 +467,193 @@ func (h *DNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 				h.handleSOA(domain, m)
 			case dns.TypeTXT:
 				err := h.handleACMETXTChallenge(domain, m)
-				if err != nil {
+				if errors.Is(err, context.DeadlineExceeded) {
+					// the acme client retries on server failures
+					gologger.Warning().Msgf("Timed out looking up the acme challenge records of %s\n", domain)
+					m.Rcode = dns.RcodeServerFailure
+				} else if err != nil {
 					fmt.Printf("handleACMETXTChallenge for zone %s err: %+v\n", domain, err)
-					return
+					return nil
 				}
 			case dns.TypeNS:
 				h.handleNS(domain, m)
 			case dns.TypeA:
-				h.handleACNAMEANY(domain, m)
+				h.handleACNAMEANY(domain, w, r, m)
 			case dns.TypeAAAA:
 				h.handleAAAACNAMEANY(domain, m)
 			}
 
 			gologger.Debug().Msgf("Got acme dns response: \n%s\n", m.String())
+		} else if rcode, ok := h.checkStrictDomain(question); ok {
+			m.Rcode = rcode
+		} else if h.handleDelegation(domain, m) {
+			// names under a delegated subzone get a referral
+			m.Authoritative = false
+		} else if !h.isQTypeAllowed(question.Qtype) {
+			// filtered types get an empty authoritative reply
+			continue
 		} else {
 			switch question.Qtype {
 			case dns.TypeA, dns.TypeCNAME, dns.TypeANY:
-				h.handleACNAMEANY(domain, m)
+				h.handleACNAMEANY(domain, w, r, m)
 			case dns.TypeAAAA:
 				h.handleAAAACNAMEANY(domain, m)
 			case dns.TypeMX:
 				h.handleMX(domain, m)
+			case dns.TypeCAA:
+				h.handleCAA(domain, m)
+			case dns.TypeSRV:
+				h.handleSRV(domain, m)
+			case dns.TypePTR:
+				h.handlePTR(domain, m)
+			case dns.TypeSVCB:
+				h.handleSVCB(domain, m)
+			case dns.TypeHTTPS:
+				h.handleHTTPS(domain, m)
+			case dns.TypeNAPTR:
+				h.handleNAPTR(domain, m)
 			case dns.TypeNS:
 				h.handleNS(domain, m)
 			case dns.TypeSOA:
 				h.handleSOA(domain, m)
 			case dns.TypeTXT:
-				h.handleTXT(domain, m)
+				h.handleTXT(domain, w, r, m)
+			case dns.TypeHINFO:
+				h.handleHINFO(domain, m)
+			case dns.TypeDNAME:
+				h.handleDNAME(domain, m)
+			case dns.TypeDNSKEY:
+				h.handleDNSKEY(domain, m)
+			case dns.TypeDS:
+				h.handleDS(domain, m)
 			}
 		}
 	}
+	// empty answers carry the SOA for negative caching as per RFC 2308
+	if len(m.Answer) == 0 && m.Authoritative && len(r.Question) > 0 && (m.Rcode == dns.RcodeSuccess || m.Rcode == dns.RcodeNameError) && !hasSOA(m.Ns) {
+		h.appendAuthoritySOA(r.Question[0].Name, m)
+	}
+	if h.options.AnswerOrdering == AnswerOrderingRFC {
+		orderRFC(m)
+	}
+
+	// EDNS queries get an OPT record advertising our buffer size and echoing the DO bit
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(h.ednsUDPSize(), opt.Do())
+	}
+
+	// validating resolvers set the DO bit to get the signatures
+	if opt := r.IsEdns0(); h.dnssec != nil && opt != nil && opt.Do() {
+		h.signResponse(m)
+	}
+
+	// padding only protects responses over encrypted transports
+	if h.encrypted {
+		h.padResponse(r, m)
+	}
+
 	if !isDNSChallenge {
-		// Write interaction for first question and dns request
-		h.handleInteraction(r.Question[0].Name, w, r, m)
+		// Write interaction for each question, the ids found in several
+		// questions being stored once
+		seen := make(map[string]struct{})
+		for _, question := range r.Question {
+			if h.isQTypeAllowed(question.Qtype) {
+				h.handleInteraction(question, flakyPhase, w, r, m, seen)
+			}
+		}
 	}
+	return m
+}
 
-	if err := w.WriteMsg(m); err != nil {
-		gologger.Warning().Msgf("Could not write DNS response: \n%s\n %s\n", m.String(), err)
+// logQuery writes the query and the rcode of its response m, if any, to the query log
+func (h *DNSServer) logQuery(w queryConn, r *dns.Msg, m *dns.Msg) {
+	if h.options.DnsQueryLog == nil || len(r.Question) == 0 {
+		return
+	}
+	entry := QueryLogEntry{
+		Timestamp:     time.Now(),
+		Protocol:      h.server.Net,
+		RemoteAddress: w.RemoteAddr().String(),
+		QName:         r.Question[0].Name,
+		QType:         dns.TypeToString[r.Question[0].Qtype],
+	}
+	if m != nil {
+		entry.Rcode = dns.RcodeToString[m.Rcode]
+	}
+	if !h.options.DnsQueryLog.Log(entry) {
+		atomic.AddUint64(&h.options.Stats.DnsLogDropped, 1)
+	}
+}
+
+// allowQuery returns false and counts the query as limited if its source
+// exceeded the DNS rate limit. Sources in RealIPFrom can be exempted, the
+// honeytoken queries always are.
+func (h *DNSServer) allowQuery(w queryConn, r *dns.Msg) bool {
+	if h.options.DnsRateLimiter == nil {
+		return true
+	}
+	// honeytoken hits are recorded whatever the rate of their source
+	if len(r.Question) > 0 && h.matchHoneytoken(r.Question[0].Name) != "" {
+		return true
 	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if h.options.DnsRateLimitExemptTrusted && h.isRealIPSource(host) {
+		return true
+	}
+	if h.options.DnsRateLimiter.Allow(h.getMsgHost(w, r)) {
+		return true
+	}
+	atomic.AddUint64(&h.options.Stats.DnsRateLimited, 1)
+	return false
+}
+
+// observeLatency records the time spent handling r since start
+func (h *DNSServer) observeLatency(start time.Time, r *dns.Msg) {
+	qtype := "OTHER"
+	if len(r.Question) > 0 {
+		if name := toQType(r.Question[0].Qtype); name != "" {
+			qtype = name
+		}
+	}
+	h.options.Stats.DnsLatency.Observe(h.server.Net, qtype, time.Since(start))
 }
 
-// handleACMETXTChallenge handles solving of ACME TXT challenge with the given provider
+// handleACMETXTChallenge handles solving of ACME TXT challenge with the given provider.
+// The records are answered lowercased whatever the casing of the query (0x20 encoding)
+// for the validators comparing the names case-sensitively.
 func (h *DNSServer) handleACMETXTChallenge(zone string, m *dns.Msg) error {
-	records, err := h.options.ACMEStore.GetRecords(context.Background(), strings.ToLower(zone))
-	if err != nil {
-		return err
+	name := strings.ToLower(zone)
+	timeout := h.options.ACMELookupTimeout
+	if timeout <= 0 {
+		timeout = defaultACMELookupTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the store ignores the context, a degraded one only blocking the lookup goroutine
+	type lookup struct {
+		records []libdns.Record
+		err     error
+	}
+	result := make(chan lookup, 1)
+	go func() {
+		records, err := h.options.ACMEStore.GetRecords(ctx, name)
+		result <- lookup{records: records, err: err}
+	}()
+	var records []libdns.Record
+	select {
+	case res := <-result:
+		if res.err != nil {
+			return res.err
+		}
+		records = res.records
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
 	rrs := []dns.RR{}
 	for _, record := range records {
-		txtHdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(record.TTL)}
+		txtHdr := dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(record.TTL)}
 		rrs = append(rrs, &dns.TXT{Hdr: txtHdr, Txt: []string{record.Value}})
 	}
 	m.Answer = append(m.Answer, rrs...)
@@ -166,161 +661,1231 @@ func (h *DNSServer) handleACMETXTChallenge(zone string, m *dns.Msg) error {
 }
 
 // handleACNAMEANY handles A, CNAME or ANY queries for DNS server
-func (h *DNSServer) handleACNAMEANY(zone string, m *dns.Msg) {
-	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.timeToLive}
+func (h *DNSServer) handleACNAMEANY(zone string, w queryConn, r *dns.Msg, m *dns.Msg) {
+	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeNS)}
 
-	// If we have a custom record serve it, or default IP
-	record := h.customRecords.checkCustomResponse(zone)
-	switch {
-	case record != "":
-		h.resultFunction(nsHeader, zone, net.ParseIP(record), m)
-	default:
-		h.resultFunction(nsHeader, zone, h.ipAddress, m)
+	// offline mode always serves the fixed IP
+	if h.options.OfflineMode {
+		h.resultFunction(nsHeader, zone, m, h.offlineIP)
+		return
 	}
-}
 
-// handleAAAACNAMEANY handles AAAA queries for DNS server
-func (h *DNSServer) handleAAAACNAMEANY(zone string, m *dns.Msg) {
-	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.timeToLive}
+	// unsigned labels only get the default IP
+	if h.options.SignedLabels && !h.hasSignedLabel(zone) {
+		h.resultFunction(nsHeader, zone, m, h.ipAddress)
+		return
+	}
 
-	// If we have a custom record serve it, or default IPv6
-	record := h.customRecords.checkCustomAAAAResponse(zone)
-	switch {
-	case record != "":
-		h.resultFunctionAAAA(nsHeader, zone, net.ParseIP(record), m)
-	default:
-		h.resultFunctionAAAA(nsHeader, zone, h.ipv6Address, m)
+	// expired or missing one-time labels only get the default IP
+	if h.options.TOTPLabels {
+		if _, valid := h.options.checkOTPLabel(zone); !valid {
+			h.resultFunction(nsHeader, zone, m, h.ipAddress)
+			return
+		}
 	}
-}
 
-func (h *DNSServer) resultFunction(nsHeader dns.RR_Header, zone string, ipAddress net.IP, m *dns.Msg) {
-	m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: ipAddress})
-	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
-	for _, dotDomain := range dotDomains {
-		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
-			for _, nsDomain := range nsDomains {
-				m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: nsDomain})
-				m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: nsDomain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
-			}
+	// names under a redirected subtree get the DNAME and the synthesized CNAME
+	if h.handleDNAMERedirect(zone, m) {
+		return
+	}
+
+	// checking-disabled queries get the bypass records
+	if r.CheckingDisabled {
+		if record := h.checkCDBypassResponse(zone); record != "" {
+			h.resultFunction(nsHeader, zone, m, net.ParseIP(record))
 			return
 		}
 	}
-}
 
-func (h *DNSServer) resultFunctionAAAA(nsHeader dns.RR_Header, zone string, ipAddress net.IP, m *dns.Msg) {
-	m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: h.timeToLive}, AAAA: ipAddress})
-	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
-	for _, dotDomain := range dotDomains {
-		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
-			for _, nsDomain := range nsDomains {
-				m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: nsDomain})
-				m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: nsDomain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.timeToLive}, A: h.ipAddress})
-			}
+	// direct-only records are not served to recursive resolvers
+	if h.getQueryOrigin(w, r) == queryOriginDirect {
+		if record := h.checkDirectQueryResponse(zone); record != "" {
+			h.resultFunction(nsHeader, zone, m, net.ParseIP(record))
 			return
 		}
 	}
-}
 
-func (h *DNSServer) handleMX(zone string, m *dns.Msg) {
-	nsHdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: h.timeToLive}
+	// the cdn subtree rotates through the pool with a low TTL
+	if ip := h.checkCDNResponse(zone); ip != nil {
+		h.resultFunction(nsHeader, zone, m, ip)
+		m.Answer[len(m.Answer)-1].Header().Ttl = uint32(h.options.CDNTTL)
+		return
+	}
 
-	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
-	for _, dotDomain := range dotDomains {
-		if mxdomain, ok := h.mxDomains[dotDomain]; ok {
-			m.Answer = append(m.Answer, &dns.MX{Hdr: nsHdr, Mx: mxdomain, Preference: 1})
+	// split-horizon sources get their dedicated IP
+	if len(h.splitHorizon) > 0 {
+		if ip := h.checkSplitHorizonResponse(h.getMsgHost(w, r)); ip != nil {
+			h.resultFunction(nsHeader, zone, m, ip)
 			return
 		}
 	}
+
+	// If we have a sequence or custom record serve it, or default IP
+	if record := h.checkSequenceResponse(zone); record != "" {
+		h.resultFunction(nsHeader, zone, m, net.ParseIP(record))
+		return
+	}
+	if h.handleANAME(nsHeader, zone, m) {
+		return
+	}
+	client := h.getMsgHost(w, r)
+	if h.handleCustomCNAME(zone, m, func(name string) {
+		h.resultFunction(nsHeader, name, m, h.customIPs(name, client)...)
+	}) {
+		return
+	}
+	h.resultFunction(nsHeader, zone, m, h.customIPs(zone, client)...)
 }
 
-func (h *DNSServer) handleNS(zone string, m *dns.Msg) {
-	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.timeToLive}
+// handleANAME answers the A records of the ANAME target of zone, falling back
+// to the other records when the target can't be resolved.
+func (h *DNSServer) handleANAME(nsHeader dns.RR_Header, zone string, m *dns.Msg) bool {
+	_, apex := h.nsDomains[strings.ToLower(zone)]
+	target := h.customRecords.Load().checkCustomANAME(zone, apex)
+	if target == "" || h.options.ANAMECache == nil {
+		return false
+	}
+	ips, err := h.options.ANAMECache.Resolve(target)
+	if err != nil {
+		gologger.Warning().Msgf("Could not resolve ANAME %s of %s: %s\n", target, zone, err)
+		return false
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	h.resultFunction(nsHeader, zone, m, ips...)
+	return true
+}
 
-	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
-	for _, dotDomain := range dotDomains {
-		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
-			for _, nsDomain := range nsDomains {
-				m.Answer = append(m.Answer, &dns.NS{Hdr: nsHeader, Ns: nsDomain})
-			}
-			return
+// customIPs returns the custom IPv4 addresses of zone or the default IP,
+// client being the address reflected for the reflect label.
+func (h *DNSServer) customIPs(zone, client string) []net.IP {
+	var ips []net.IP
+	for _, record := range h.customRecords.Load().checkCustomResponse(zone, client) {
+		if ip := net.ParseIP(record); ip != nil {
+			ips = append(ips, ip)
 		}
 	}
+	if len(ips) == 0 {
+		return []net.IP{h.defaultIP(zone)}
+	}
+	return ips
 }
 
-func (h *DNSServer) handleSOA(zone string, m *dns.Msg) {
-	nsHdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET}
-	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
-	for _, dotDomain := range dotDomains {
-		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
-			for _, nsDomain := range nsDomains {
-				m.Answer = append(m.Answer, &dns.SOA{Hdr: nsHdr, Ns: nsDomain, Mbox: acme.CertificateAuthority, Serial: 1, Expire: 60, Minttl: 60})
-				return
+// defaultIP returns the IPv4 address of the names without custom records,
+// the sinkhole one for the subdomains other than the server names.
+func (h *DNSServer) defaultIP(zone string) net.IP {
+	if h.sinkholeIP != nil && !h.isServerName(zone) {
+		return h.sinkholeIP
+	}
+	return h.ipAddress
+}
+
+// defaultIPv6 is the IPv6 counterpart of defaultIP
+func (h *DNSServer) defaultIPv6(zone string) net.IP {
+	if h.sinkholeIPv6 != nil && !h.isServerName(zone) {
+		return h.sinkholeIPv6
+	}
+	return h.ipv6Address
+}
+
+// isServerName returns true if zone is a configured domain, one of its
+// nameservers or the mail host, which keep resolving to the server itself.
+func (h *DNSServer) isServerName(zone string) bool {
+	lowerZone := strings.ToLower(zone)
+	for domain, nsHosts := range h.nsDomains {
+		if lowerZone == domain {
+			return true
+		}
+		for _, host := range nsHosts {
+			if lowerZone == host {
+				return true
 			}
 		}
 	}
+	return h.isMailHost(zone)
 }
 
-func (h *DNSServer) handleTXT(zone string, m *dns.Msg) {
-	m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{h.TxtRecord}})
+// handleCustomCNAME answers the custom CNAME chain of zone, followed while the
+// targets are under the configured domains and ending with the records added
+// by answer for the last target.
+func (h *DNSServer) handleCustomCNAME(zone string, m *dns.Msg, answer func(name string)) bool {
+	records := h.customRecords.Load()
+	target := records.checkCustomCNAME(zone)
+	if target == "" {
+		return false
+	}
+	name := zone
+	for i := 0; i < maxCNAMEChain; i++ {
+		m.Answer = append(m.Answer, &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeCNAME)}, Target: target})
+		if !h.isConfiguredDomain(target) {
+			return true
+		}
+		name, target = target, records.checkCustomCNAME(target)
+		if target == "" {
+			answer(name)
+			return true
+		}
+	}
+	gologger.Warning().Msgf("Custom CNAME chain of %s exceeds %d records\n", zone, maxCNAMEChain)
+	return true
 }
 
-func toQType(ttype uint16) (rtype string) {
-	switch ttype {
-	case dns.TypeA:
-		rtype = "A"
-	case dns.TypeNS:
-		rtype = "NS"
-	case dns.TypeCNAME:
-		rtype = "CNAME"
-	case dns.TypeSOA:
-		rtype = "SOA"
-	case dns.TypePTR:
-		rtype = "PTR"
-	case dns.TypeMX:
-		rtype = "MX"
-	case dns.TypeTXT:
-		rtype = "TXT"
-	case dns.TypeAAAA:
-		rtype = "AAAA"
+// isConfiguredDomain returns true if name is under one of the configured domains
+func (h *DNSServer) isConfiguredDomain(name string) bool {
+	for _, domain := range h.options.Domains {
+		if dns.IsSubDomain(dns.Fqdn(domain), name) {
+			return true
+		}
 	}
-	return
+	return false
 }
 
-// handleInteraction handles an interaction for the DNS server
-func (h *DNSServer) handleInteraction(domain string, w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
-	var uniqueID, fullID string
+// handleAAAACNAMEANY handles AAAA queries for DNS server
+func (h *DNSServer) handleAAAACNAMEANY(zone string, m *dns.Msg) {
+	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeNS)}
 
-	requestMsg := r.String()
-	responseMsg := m.String()
+	// custom CNAMEs are followed to the AAAA records of their target
+	if h.handleCustomCNAME(zone, m, func(name string) {
+		h.resultFunctionAAAA(nsHeader, name, h.customIPv6(name), m)
+	}) {
+		return
+	}
+	h.resultFunctionAAAA(nsHeader, zone, h.customIPv6(zone), m)
+}
 
-	gologger.Debug().Msgf("New DNS request: %s\n", requestMsg)
+// customIPv6 returns the custom IPv6 address of zone or the default one
+func (h *DNSServer) customIPv6(zone string) net.IP {
+	if record := h.customRecords.Load().checkCustomAAAAResponse(zone); record != "" {
+		return net.ParseIP(record)
+	}
+	return h.defaultIPv6(zone)
+}
 
-	var foundDomain string
-	for _, configuredDomain := range h.options.Domains {
-		configuredDotDomain := dns.Fqdn(configuredDomain)
-		if stringsutil.HasSuffixI(domain, configuredDotDomain) {
-			foundDomain = configuredDomain
-			break
+// getDNAMERecord returns the owner and target of the DNAME record covering zone.
+// The owner name itself is not redirected as per RFC 6672.
+func (h *DNSServer) getDNAMERecord(zone string) (owner, target string) {
+	lowerZone := strings.ToLower(zone)
+	for label, dnameTarget := range h.options.DNAMERecords {
+		for _, domain := range h.options.Domains {
+			dnameOwner := label + "." + dns.Fqdn(domain)
+			if lowerZone == dnameOwner || strings.HasSuffix(lowerZone, "."+dnameOwner) {
+				return zone[len(zone)-len(dnameOwner):], dns.Fqdn(dnameTarget)
+			}
+		}
+	}
+	return "", ""
+}
+
+// getDelegation returns the delegated subzone containing zone and its
+// name servers (host or host=glue ip), if any.
+func (h *DNSServer) getDelegation(zone string) (owner string, nameServers []string) {
+	lowerZone := strings.ToLower(zone)
+	for label, servers := range h.options.Delegations {
+		for _, domain := range h.options.Domains {
+			delegated := label + "." + dns.Fqdn(domain)
+			if lowerZone == delegated || strings.HasSuffix(lowerZone, "."+delegated) {
+				return delegated, servers
+			}
+		}
+	}
+	return "", nil
+}
+
+// handleDelegation answers names under a delegated subzone with a referral,
+// the NS records in the authority section and their glue in the additional
+// section, returning true if zone was delegated.
+func (h *DNSServer) handleDelegation(zone string, m *dns.Msg) bool {
+	owner, nameServers := h.getDelegation(zone)
+	if owner == "" {
+		return false
+	}
+	gologger.Debug().Msgf("Referring %s to delegated subzone %s\n", zone, owner)
+	for _, nameServer := range nameServers {
+		host, glue, _ := strings.Cut(nameServer, "=")
+		host = dns.Fqdn(host)
+		m.Ns = append(m.Ns, &dns.NS{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeNS)}, Ns: host})
+		ip := net.ParseIP(glue)
+		switch {
+		case ip == nil:
+		case ip.To4() != nil:
+			m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeA)}, A: ip})
+		default:
+			m.Extra = append(m.Extra, &dns.AAAA{Hdr: dns.RR_Header{Name: host, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeAAAA)}, AAAA: ip})
+		}
+	}
+	return true
+}
+
+// handleDNAMERedirect answers names below a DNAME owner with the DNAME
+// and the CNAME synthesized from it, returning true if zone was redirected.
+func (h *DNSServer) handleDNAMERedirect(zone string, m *dns.Msg) bool {
+	owner, target := h.getDNAMERecord(zone)
+	if owner == "" || len(zone) == len(owner) {
+		return false
+	}
+	synthesized := zone[:len(zone)-len(owner)] + target
+	if len(synthesized) > 255 {
+		m.Rcode = dns.RcodeYXDomain
+		return true
+	}
+	gologger.Debug().Msgf("Synthesizing CNAME %s -> %s from DNAME %s\n", zone, synthesized, owner)
+	m.Answer = append(m.Answer,
+		&dns.DNAME{Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeDNAME)}, Target: target},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeCNAME)}, Target: synthesized},
+	)
+	return true
+}
+
+// handleDNAME handles DNAME queries for DNS server
+func (h *DNSServer) handleDNAME(zone string, m *dns.Msg) {
+	owner, target := h.getDNAMERecord(zone)
+	if owner == "" {
+		return
+	}
+	if len(zone) != len(owner) {
+		h.handleDNAMERedirect(zone, m)
+		return
+	}
+	m.Answer = append(m.Answer, &dns.DNAME{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeDNAME, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeDNAME)}, Target: target})
+}
+
+// handleDNSKEY handles DNSKEY queries for the DNSSEC signed zone
+func (h *DNSServer) handleDNSKEY(zone string, m *dns.Msg) {
+	if h.dnssec == nil || !strings.EqualFold(zone, h.dnssec.zone) {
+		return
+	}
+	m.Answer = append(m.Answer, h.dnssec.dnskeys(h.ttl(dns.TypeDNSKEY))...)
+}
+
+// handleDS handles DS queries for the DNSSEC signed zone with the digest
+// of its KSK, as published at the parent zone.
+func (h *DNSServer) handleDS(zone string, m *dns.Msg) {
+	if h.dnssec == nil || !strings.EqualFold(zone, h.dnssec.zone) {
+		return
+	}
+	if ds := h.dnssec.ds(h.ttl(dns.TypeDS)); ds != nil {
+		m.Answer = append(m.Answer, ds)
+	}
+}
+
+// signResponse adds the RRSIGs of the answer and authority sections of m,
+// leaving m unsigned on errors.
+func (h *DNSServer) signResponse(m *dns.Msg) {
+	now := time.Now()
+	answer, err := h.dnssec.signSection(m.Answer, now)
+	if err != nil {
+		gologger.Warning().Msgf("Could not sign DNS response: %s\n", err)
+		return
+	}
+	ns, err := h.dnssec.signSection(m.Ns, now)
+	if err != nil {
+		gologger.Warning().Msgf("Could not sign DNS response: %s\n", err)
+		return
+	}
+	m.Answer, m.Ns = answer, ns
+}
+
+// checkStrictDomain returns the rcode answered to questions outside the configured
+// domains in strict mode. Reverse lookups are left to the PTR handler.
+func (h *DNSServer) checkStrictDomain(question dns.Question) (int, bool) {
+	if h.options.StrictDomain == "" || h.options.OfflineMode || question.Qtype == dns.TypePTR {
+		return 0, false
+	}
+	if h.isConfiguredDomain(question.Name) {
+		return 0, false
+	}
+	if h.options.StrictDomain == StrictDomainRefused {
+		return dns.RcodeRefused, true
+	}
+	return dns.RcodeNameError, true
+}
+
+// isPublicSuffixLabel returns true if the first label of zone is a public suffix to refuse
+func (h *DNSServer) isPublicSuffixLabel(zone string) bool {
+	if !h.options.RefusePublicSuffixLabels {
+		return false
+	}
+	label, _, _ := strings.Cut(zone, ".")
+	return label != "" && h.suffixList.contains(label)
+}
+
+// hasSignedLabel returns true if a label of the zone contains a signed correlation id
+func (h *DNSServer) hasSignedLabel(zone string) bool {
+	for _, label := range strings.Split(zone, ".") {
+		for _, sub := range splitLabelParts(label, h.options.correlationIdSeparators()) {
+			if h.options.isCorrelationID(strings.ToLower(sub)) && h.options.hasSignedID(label, sub) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitHorizonNetwork is a parsed split-horizon record
+type splitHorizonNetwork struct {
+	network *net.IPNet
+	ip      net.IP
+}
+
+func newSplitHorizonNetworks(records []SplitHorizonRecord) []splitHorizonNetwork {
+	var networks []splitHorizonNetwork
+	for _, record := range records {
+		_, network, err := net.ParseCIDR(record.CIDR)
+		if err != nil {
+			gologger.Warning().Msgf("Invalid SplitHorizon CIDR: %s, err: %s", record.CIDR, err)
+			continue
+		}
+		ip := net.ParseIP(record.IP)
+		if ip == nil || ip.To4() == nil {
+			gologger.Warning().Msgf("Invalid SplitHorizon IP: %s, err: Invalid IPv4 address.", record.IP)
+			continue
+		}
+		networks = append(networks, splitHorizonNetwork{network: network, ip: ip})
+	}
+	return networks
+}
+
+// checkSplitHorizonResponse returns the IP of the first split-horizon network containing host
+func (h *DNSServer) checkSplitHorizonResponse(host string) net.IP {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, splitHorizon := range h.splitHorizon {
+		if splitHorizon.network.Contains(ip) {
+			return splitHorizon.ip
+		}
+	}
+	return nil
+}
+
+// checkCDNResponse returns the next pool IP for zones under the cdn subtree
+func (h *DNSServer) checkCDNResponse(zone string) net.IP {
+	if len(h.cdnPool) == 0 {
+		return nil
+	}
+	for _, suffix := range h.cdnSuffixes {
+		if stringsutil.HasSuffixI(zone, suffix) {
+			return h.cdnPool[(atomic.AddUint64(&h.cdnCounter, 1)-1)%uint64(len(h.cdnPool))]
+		}
+	}
+	return nil
+}
+
+// checkSequenceResponse returns the next IP of the sequence configured for the zone
+func (h *DNSServer) checkSequenceResponse(zone string) string {
+	if len(h.options.SequenceRecords) == 0 {
+		return ""
+	}
+	parts := strings.SplitN(zone, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	label := strings.ToLower(parts[0])
+	ips := h.options.SequenceRecords[label]
+	if len(ips) == 0 {
+		return ""
+	}
+	return ips[h.options.Counters.Next(sequenceCounterPrefix+label)%uint64(len(ips))]
+}
+
+// checkFlakyPhase returns the phase of the (zone, source) pair if the first label of
+// zone is flaky: the first query fails and the retries within FlakyWindow succeed.
+func (h *DNSServer) checkFlakyPhase(zone string, w queryConn, r *dns.Msg) string {
+	if len(h.flakyLabels) == 0 {
+		return ""
+	}
+	label, _, _ := strings.Cut(strings.ToLower(zone), ".")
+	if _, ok := h.flakyLabels[label]; !ok {
+		return ""
+	}
+	key := flakyCounterPrefix + strings.ToLower(zone) + "|" + h.getMsgHost(w, r)
+	if h.options.Counters.NextWithin(key, h.options.FlakyWindow) > 0 {
+		return flakyPhaseRetry
+	}
+	return flakyPhaseServfail
+}
+
+// getResponseDelay returns the time to wait before answering zone, taken from
+// its delay<duration> label part (e.g. delay5s) or DnsResponseDelay.
+func (h *DNSServer) getResponseDelay(zone string) time.Duration {
+	delay, ok := parseDelayLabel(zone)
+	if !ok {
+		delay = h.options.DnsResponseDelay
+	}
+	maxDelay := h.options.DnsMaxResponseDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxResponseDelay
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// parseDelayLabel returns the duration of the first delay<duration> label part of zone
+func parseDelayLabel(zone string) (time.Duration, bool) {
+	for _, label := range strings.Split(strings.ToLower(zone), ".") {
+		if !strings.Contains(label, delayLabelPrefix) {
+			continue
+		}
+		for _, part := range splitSubdomainParts(label) {
+			value, ok := strings.CutPrefix(part, delayLabelPrefix)
+			if !ok {
+				continue
+			}
+			if delay, err := time.ParseDuration(value); err == nil && delay > 0 {
+				return delay, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// getQueryOrigin returns whether the query was sent directly by a client or by a
+// resolver, if direct-query records or sources are configured. This is a heuristic:
+// iterating resolvers usually clear the RD bit towards authoritative servers while
+// stubs set it, but forwarders and misbehaving resolvers keep it set.
+func (h *DNSServer) getQueryOrigin(w queryConn, r *dns.Msg) string {
+	if len(h.options.DirectQueryOnlyRecords) == 0 && len(h.directSources) == 0 {
+		return ""
+	}
+	if r.RecursionDesired {
+		return queryOriginDirect
+	}
+	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if ip := net.ParseIP(host); ip != nil {
+		for _, network := range h.directSources {
+			if network.Contains(ip) {
+				return queryOriginDirect
+			}
+		}
+	}
+	return queryOriginRecursive
+}
+
+// checkDirectQueryResponse returns the direct-only record for the first label of zone
+func (h *DNSServer) checkDirectQueryResponse(zone string) string {
+	label, _, _ := strings.Cut(zone, ".")
+	return h.options.DirectQueryOnlyRecords[strings.ToLower(label)]
+}
+
+// checkCDBypassResponse returns the bypass record for the first label of zone
+func (h *DNSServer) checkCDBypassResponse(zone string) string {
+	if len(h.options.CDBypassRecords) == 0 {
+		return ""
+	}
+	parts := strings.SplitN(zone, ".", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return h.options.CDBypassRecords[strings.ToLower(parts[0])]
+}
+
+// resultFunction appends an A record per address, in random order when there
+// are several, along with the NS authority of the zone. Without any address
+// only the SOA authority is answered.
+func (h *DNSServer) resultFunction(nsHeader dns.RR_Header, zone string, m *dns.Msg, ipAddresses ...net.IP) {
+	if len(ipAddresses) > 1 {
+		ipAddresses = append([]net.IP(nil), ipAddresses...)
+		rand.Shuffle(len(ipAddresses), func(i, j int) {
+			ipAddresses[i], ipAddresses[j] = ipAddresses[j], ipAddresses[i]
+		})
+	}
+	answered := false
+	for _, ipAddress := range ipAddresses {
+		if ipAddress == nil {
+			continue
+		}
+		m.Answer = append(m.Answer, &dns.A{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeA)}, A: ipAddress})
+		answered = true
+	}
+	if !answered {
+		h.answerNoIP(zone, m)
+		return
+	}
+	h.appendNSAuthority(nsHeader, zone, m)
+}
+
+// answerNoIP answers the SOA authority for a zone without address, warning
+// once about the missing IPAddress or IPv6Address.
+func (h *DNSServer) answerNoIP(zone string, m *dns.Msg) {
+	h.noIPWarning.Do(func() {
+		gologger.Warning().Msgf("No IP address to answer %s with, check the IPAddress and IPv6Address options\n", zone)
+	})
+	h.appendAuthoritySOA(zone, m)
+}
+
+// appendNSAuthority appends the name servers of zone to the authority
+// section, along with the glue of the ones under the configured domains.
+func (h *DNSServer) appendNSAuthority(nsHeader dns.RR_Header, zone string, m *dns.Msg) {
+	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
+	for _, dotDomain := range dotDomains {
+		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
+			for _, nsDomain := range nsDomains {
+				m.Ns = append(m.Ns, &dns.NS{Hdr: nsHeader, Ns: nsDomain})
+				if h.ipAddress != nil && h.isConfiguredDomain(nsDomain) {
+					m.Extra = append(m.Extra, &dns.A{Hdr: dns.RR_Header{Name: nsDomain, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeA)}, A: h.ipAddress})
+				}
+			}
+			return
+		}
+	}
+}
+
+func (h *DNSServer) resultFunctionAAAA(nsHeader dns.RR_Header, zone string, ipAddress net.IP, m *dns.Msg) {
+	if ipAddress == nil {
+		h.answerNoIP(zone, m)
+		return
+	}
+	m.Answer = append(m.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeAAAA)}, AAAA: ipAddress})
+	h.appendNSAuthority(nsHeader, zone, m)
+}
+
+func (h *DNSServer) handleMX(zone string, m *dns.Msg) {
+	nsHdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeMX, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeMX)}
+
+	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
+	for _, dotDomain := range dotDomains {
+		if mxRecords, ok := h.mxDomains[dotDomain]; ok {
+			for _, record := range mxRecords {
+				if h.options.MailHost != "" {
+					gologger.Verbose().Msgf("Got MX request for %s, answering mail host %s\n", zone, record.Host)
+				}
+				m.Answer = append(m.Answer, &dns.MX{Hdr: nsHdr, Mx: record.Host, Preference: record.Pref})
+			}
+			return
+		}
+	}
+}
+
+// handleCAA handles CAA queries for DNS server, answering the SOA in the
+// authority section when no CAA record is configured for the zone.
+func (h *DNSServer) handleCAA(zone string, m *dns.Msg) {
+	records := h.customRecords.Load().checkCustomCAAResponse(zone)
+	if len(records) == 0 {
+		h.appendAuthoritySOA(zone, m)
+		return
+	}
+	for _, record := range records {
+		m.Answer = append(m.Answer, &dns.CAA{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeCAA, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeCAA)}, Flag: record.flag, Tag: record.tag, Value: record.value})
+	}
+}
+
+// handleSRV handles SRV queries for DNS server, answering the custom record of the
+// _service._proto labels or port 0 of the first domain.
+func (h *DNSServer) handleSRV(zone string, m *dns.Msg) {
+	record, ok := h.customRecords.Load().checkCustomSRVResponse(zone)
+	if !ok {
+		record = srvRecord{target: dns.Fqdn(h.options.Domains[0])}
+	}
+	m.Answer = append(m.Answer, &dns.SRV{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeSRV)}, Priority: record.priority, Weight: record.weight, Port: record.port, Target: record.target})
+}
+
+// handlePTR handles PTR queries for DNS server, answering the first domain for the
+// reverse names of the server addresses and NXDOMAIN for the others.
+func (h *DNSServer) handlePTR(zone string, m *dns.Msg) {
+	for _, ip := range []net.IP{h.ipAddress, h.ipv6Address} {
+		if ip == nil {
+			continue
+		}
+		if reverse, err := dns.ReverseAddr(ip.String()); err == nil && strings.EqualFold(zone, reverse) {
+			m.Answer = append(m.Answer, &dns.PTR{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: h.ttl(dns.TypePTR)}, Ptr: dns.Fqdn(h.options.Domains[0])})
+			return
+		}
+	}
+	m.Rcode = dns.RcodeNameError
+	h.appendAuthoritySOA(zone, m)
+}
+
+// ttl returns the ttl of the records of rrtype
+func (h *DNSServer) ttl(rrtype uint16) uint32 {
+	if h.tcpTTL > 0 {
+		return h.ttlJitter.apply(h.tcpTTL)
+	}
+	ttl, ok := h.ttlByType[rrtype]
+	if !ok {
+		ttl = h.timeToLive
+	}
+	return h.ttlJitter.apply(ttl)
+}
+
+// ttlJitter is the random TTL offset range, in seconds or in percent of the TTL
+type ttlJitter struct {
+	value   int
+	percent bool
+}
+
+// parseTTLJitter parses an absolute (30) or relative (20%) jitter
+func parseTTLJitter(value string) (ttlJitter, error) {
+	number, percent := strings.CutSuffix(strings.TrimSpace(value), "%")
+	jitter, err := strconv.Atoi(number)
+	if err != nil || jitter < 0 || (percent && jitter > 100) {
+		return ttlJitter{}, errors.New("expected seconds or a percentage")
+	}
+	return ttlJitter{value: jitter, percent: percent}, nil
+}
+
+// apply returns ttl moved by a random offset within the jitter range,
+// drawn for each record.
+func (j ttlJitter) apply(ttl uint32) uint32 {
+	jitter := int64(j.value)
+	if j.percent {
+		jitter = int64(ttl) * jitter / 100
+	}
+	if jitter == 0 {
+		return ttl
+	}
+	jittered := int64(ttl) + rand.Int63n(2*jitter+1) - jitter
+	if jittered < 0 {
+		return 0
+	}
+	return uint32(jittered)
+}
+
+// handleSVCB handles SVCB queries for DNS server
+func (h *DNSServer) handleSVCB(zone string, m *dns.Msg) {
+	h.appendServiceBinding(zone, dns.TypeSVCB, m)
+}
+
+// handleHTTPS handles HTTPS queries for DNS server
+func (h *DNSServer) handleHTTPS(zone string, m *dns.Msg) {
+	h.appendServiceBinding(zone, dns.TypeHTTPS, m)
+}
+
+// appendServiceBinding answers the custom SVCB/HTTPS record of zone or a
+// service mode record hinting the server addresses.
+func (h *DNSServer) appendServiceBinding(zone string, rrtype uint16, m *dns.Msg) {
+	record, ok := h.customRecords.Load().checkCustomSVCBResponse(zone)
+	if !ok {
+		record = svcbRecord{Priority: 1, Target: ".", Params: "alpn=h2,http/1.1"}
+		if h.ipAddress != nil && h.ipAddress.To4() != nil {
+			record.Params += " ipv4hint=" + h.ipAddress.String()
+		}
+		if h.ipv6Address != nil {
+			record.Params += " ipv6hint=" + h.ipv6Address.String()
+		}
+	}
+	rr, err := record.build(zone, rrtype, h.ttl(rrtype))
+	if err != nil {
+		gologger.Warning().Msgf("Could not build %s record for %s: %s\n", dns.TypeToString[rrtype], zone, err)
+		return
+	}
+	m.Answer = append(m.Answer, rr)
+}
+
+// handleNAPTR handles NAPTR queries for DNS server
+func (h *DNSServer) handleNAPTR(zone string, m *dns.Msg) {
+	records := h.customRecords.Load().checkCustomNAPTRResponse(zone)
+	if len(records) == 0 {
+		h.appendAuthoritySOA(zone, m)
+		return
+	}
+	for _, record := range records {
+		m.Answer = append(m.Answer, &dns.NAPTR{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeNAPTR, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeNAPTR)}, Order: record.Order, Preference: record.Preference, Flags: record.Flags, Service: record.Service, Regexp: record.Regexp, Replacement: dns.Fqdn(record.Replacement)})
+	}
+}
+
+// ReloadCustomRecords reloads the custom DNS records and increments the SOA serial
+// so that caching resolvers re-fetch them. The serial follows the reload timestamp
+// and stays monotonic across reloads within the same second.
+func (h *DNSServer) ReloadCustomRecords() error {
+	records, err := loadCustomDNSRecords(h.options)
+	if err != nil {
+		return err
+	}
+	h.customRecords.Store(records)
+	for {
+		current := h.soaSerial.Load()
+		next := current + 1
+		if now := uint32(time.Now().Unix()); now > next {
+			next = now
+		}
+		if h.soaSerial.CompareAndSwap(current, next) {
+			gologger.Info().Msgf("Reloaded custom DNS records from %s, SOA serial %d\n", h.options.CustomRecords, next)
+			return nil
+		}
+	}
+}
+
+const (
+	// defaultSOAExpire is the expire timer of the SOA record when SOAExpire is unset
+	defaultSOAExpire = 60
+	// defaultSOAMinTTL is the minimum ttl of the SOA record when SOAMinTTL is unset
+	defaultSOAMinTTL = 60
+)
+
+// soaRecord returns the SOA record of the name server with the configured timers,
+// its ttl bounding the negative caching of the answers with min(ttl, Minttl).
+func (h *DNSServer) soaRecord(hdr dns.RR_Header, ns string) *dns.SOA {
+	hdr.Ttl = h.ttl(dns.TypeSOA)
+	return &dns.SOA{
+		Hdr:     hdr,
+		Ns:      ns,
+		Mbox:    acme.CertificateAuthority,
+		Serial:  h.soaSerial.Load(),
+		Refresh: uint32(h.options.SOARefresh),
+		Retry:   uint32(h.options.SOARetry),
+		Expire:  uint32(h.options.SOAExpire),
+		Minttl:  uint32(h.options.SOAMinTTL),
+	}
+}
+
+// appendAuthoritySOA adds the SOA of the domain containing zone to the authority section
+func (h *DNSServer) appendAuthoritySOA(zone string, m *dns.Msg) {
+	dotDomain := dns.Fqdn(h.options.Domains[0])
+	for _, domain := range h.options.Domains {
+		if dns.IsSubDomain(dns.Fqdn(domain), zone) {
+			dotDomain = dns.Fqdn(domain)
+			break
+		}
+	}
+	if nsDomains, ok := h.nsDomains[dotDomain]; ok && len(nsDomains) > 0 {
+		nsHdr := dns.RR_Header{Name: dotDomain, Rrtype: dns.TypeSOA, Class: dns.ClassINET}
+		m.Ns = append(m.Ns, h.soaRecord(nsHdr, nsDomains[0]))
+	}
+}
+
+// hasSOA returns true if records hold a SOA record
+func hasSOA(records []dns.RR) bool {
+	for _, record := range records {
+		if record.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *DNSServer) handleNS(zone string, m *dns.Msg) {
+	nsHeader := dns.RR_Header{Name: zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeNS)}
+
+	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
+	for _, dotDomain := range dotDomains {
+		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
+			for _, nsDomain := range nsDomains {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: nsHeader, Ns: nsDomain})
+			}
+			return
+		}
+	}
+}
+
+func (h *DNSServer) handleSOA(zone string, m *dns.Msg) {
+	nsHdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET}
+	dotDomains := []string{zone, dns.Fqdn(h.options.Domains[0])}
+	for _, dotDomain := range dotDomains {
+		if nsDomains, ok := h.nsDomains[dotDomain]; ok {
+			for _, nsDomain := range nsDomains {
+				m.Answer = append(m.Answer, h.soaRecord(nsHdr, nsDomain))
+				return
+			}
+		}
+	}
+}
+
+func (h *DNSServer) handleTXT(zone string, w queryConn, r *dns.Msg, m *dns.Msg) {
+	if h.isAuditEchoName(zone) {
+		audit := fmt.Sprintf("src=%s;ts=%s", h.getMsgHost(w, r), time.Now().UTC().Format(time.RFC3339))
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{audit}})
+		return
+	}
+	if h.options.DNSDiscovery && h.isDiscoveryName(zone) {
+		gologger.Verbose().Msgf("Got capabilities discovery request for %s\n", zone)
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeTXT)}, Txt: h.getCapabilities().txt()})
+		return
+	}
+	if h.options.MailSPF != "" && h.isMailHost(zone) {
+		gologger.Verbose().Msgf("Got SPF request for mail host %s\n", zone)
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeTXT)}, Txt: []string{h.options.MailSPF}})
+		return
+	}
+	if values := h.customRecords.Load().checkCustomTXTResponse(zone); len(values) > 0 {
+		for _, value := range values {
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeTXT)}, Txt: splitTXT(value)})
+		}
+		return
+	}
+	// the name is echoed as received, keeping the 0x20 casing of the resolver
+	if h.options.EchoTXT {
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{zone}})
+		return
+	}
+	m.Answer = append(m.Answer, &dns.TXT{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 0}, Txt: []string{h.TxtRecord}})
+}
+
+// maxTXTStringLength is the max length of a character-string of a TXT record
+const maxTXTStringLength = 255
+
+// splitTXT splits value into the character-strings of a TXT record
+func splitTXT(value string) []string {
+	var parts []string
+	for len(value) > maxTXTStringLength {
+		parts = append(parts, value[:maxTXTStringLength])
+		value = value[maxTXTStringLength:]
+	}
+	return append(parts, value)
+}
+
+// isAuditEchoName returns true if the first label of zone is the audit echo label
+func (h *DNSServer) isAuditEchoName(zone string) bool {
+	if h.options.AuditEchoLabel == "" {
+		return false
+	}
+	label, _, _ := strings.Cut(zone, ".")
+	return strings.EqualFold(label, h.options.AuditEchoLabel)
+}
+
+// isMailHost returns true if zone is the mail host answered for MX queries
+func (h *DNSServer) isMailHost(zone string) bool {
+	for _, mxRecords := range h.mxDomains {
+		for _, record := range mxRecords {
+			if strings.EqualFold(zone, record.Host) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discoveryLabel is the label of the capabilities discovery TXT record
+const discoveryLabel = "_interactsh"
+
+const (
+	// delayLabelPrefix prefixes the label parts delaying the answer, e.g. delay5s
+	delayLabelPrefix = "delay"
+	// defaultMaxResponseDelay caps the answer delays when DnsMaxResponseDelay is unset
+	defaultMaxResponseDelay = 10 * time.Second
+)
+
+// serverCapabilities is advertised to clients through the discovery TXT record
+type serverCapabilities struct {
+	Version                  string
+	Protocols                []string
+	Features                 []string
+	CorrelationIdLength      int
+	CorrelationIdNonceLength int
+}
+
+// txt returns the capabilities as key=value TXT strings
+func (c *serverCapabilities) txt() []string {
+	return []string{
+		"v=" + c.Version,
+		"protocols=" + strings.Join(c.Protocols, ","),
+		"features=" + strings.Join(c.Features, ","),
+		fmt.Sprintf("cidl=%d", c.CorrelationIdLength),
+		fmt.Sprintf("cidn=%d", c.CorrelationIdNonceLength),
+	}
+}
+
+func (h *DNSServer) isDiscoveryName(zone string) bool {
+	for _, domain := range h.options.Domains {
+		if strings.EqualFold(zone, discoveryLabel+"."+dns.Fqdn(domain)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *DNSServer) getCapabilities() *serverCapabilities {
+	capabilities := &serverCapabilities{
+		Version:                  h.options.Version,
+		Protocols:                []string{"dns", "http", "smtp", "ldap"},
+		CorrelationIdLength:      h.options.CorrelationIdLength,
+		CorrelationIdNonceLength: h.options.CorrelationIdNonceLength,
+	}
+	if len(h.options.CertFiles) > 0 || h.options.CertificatePath != "" {
+		capabilities.Protocols = append(capabilities.Protocols, "https", "smtps")
+	}
+	features := map[string]bool{
+		"auth":            h.options.Auth,
+		"wildcard":        h.options.RootTLD,
+		"scan-everywhere": h.options.ScanEverywhere,
+		"dynamic-resp":    h.options.DynamicResp,
+		"signed-labels":   h.options.SignedLabels,
+		"totp-labels":     h.options.TOTPLabels,
+		"metrics":         h.options.EnableMetrics,
+	}
+	for feature, enabled := range features {
+		if enabled {
+			capabilities.Features = append(capabilities.Features, feature)
+		}
+	}
+	sort.Strings(capabilities.Features)
+	return capabilities
+}
+
+func (h *DNSServer) handleHINFO(zone string, m *dns.Msg) {
+	if h.options.HINFOCpu == "" && h.options.HINFOOs == "" {
+		return
+	}
+	m.Answer = append(m.Answer, &dns.HINFO{Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeHINFO, Class: dns.ClassINET, Ttl: h.ttl(dns.TypeHINFO)}, Cpu: h.options.HINFOCpu, Os: h.options.HINFOOs})
+}
+
+// orderRFC moves CNAME records ahead of the data they alias in the answer
+// section and sorts the additional section deterministically, keeping the
+// OPT pseudo-record last.
+func orderRFC(m *dns.Msg) {
+	sort.SliceStable(m.Answer, func(i, j int) bool {
+		return answerRank(m.Answer[i]) < answerRank(m.Answer[j])
+	})
+	sort.SliceStable(m.Extra, func(i, j int) bool {
+		hi, hj := m.Extra[i].Header(), m.Extra[j].Header()
+		if (hi.Rrtype == dns.TypeOPT) != (hj.Rrtype == dns.TypeOPT) {
+			return hj.Rrtype == dns.TypeOPT
+		}
+		if hi.Name != hj.Name {
+			return hi.Name < hj.Name
+		}
+		if hi.Rrtype != hj.Rrtype {
+			return hi.Rrtype < hj.Rrtype
+		}
+		return m.Extra[i].String() < m.Extra[j].String()
+	})
+}
+
+// ednsUDPSize returns the UDP buffer size advertised in the OPT records of the responses
+func (h *DNSServer) ednsUDPSize() uint16 {
+	if h.options.DnsEDNSUDPSize > 0 {
+		return uint16(h.options.DnsEDNSUDPSize)
+	}
+	return defaultEDNSUDPSize
+}
+
+// padResponse pads the OPT record of the response to a multiple of
+// ednsPaddingBlockSize as per RFC 7830 depending on the EDNSPadding mode.
+func (h *DNSServer) padResponse(r *dns.Msg, m *dns.Msg) {
+	requestOpt := r.IsEdns0()
+	switch h.options.EDNSPadding {
+	case EDNSPaddingAlways:
+	case EDNSPaddingRequested:
+		if requestOpt == nil || !hasEDNSPadding(requestOpt) {
+			return
+		}
+	default:
+		return
+	}
+
+	opt := m.IsEdns0()
+	if opt == nil {
+		udpSize := uint16(dns.MinMsgSize)
+		if requestOpt != nil {
+			udpSize = requestOpt.UDPSize()
+		}
+		m.SetEdns0(udpSize, false)
+		opt = m.IsEdns0()
+	}
+	// the padding option header takes 4 bytes
+	length := m.Len() + 4
+	padding := (ednsPaddingBlockSize - length%ednsPaddingBlockSize) % ednsPaddingBlockSize
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, padding)})
+}
+
+// hasEDNSPadding returns true if the OPT record carries a padding option
+func hasEDNSPadding(opt *dns.OPT) bool {
+	for _, option := range opt.Option {
+		if option.Option() == dns.EDNS0PADDING {
+			return true
+		}
+	}
+	return false
+}
+
+// answerRank orders DNAME before the synthesized CNAME before the other records
+func answerRank(rr dns.RR) int {
+	switch rr.Header().Rrtype {
+	case dns.TypeDNAME:
+		return 0
+	case dns.TypeCNAME:
+		return 1
+	}
+	return 2
+}
+
+func toQType(ttype uint16) (rtype string) {
+	switch ttype {
+	case dns.TypeA:
+		rtype = "A"
+	case dns.TypeNS:
+		rtype = "NS"
+	case dns.TypeCNAME:
+		rtype = "CNAME"
+	case dns.TypeSOA:
+		rtype = "SOA"
+	case dns.TypePTR:
+		rtype = "PTR"
+	case dns.TypeMX:
+		rtype = "MX"
+	case dns.TypeCAA:
+		rtype = "CAA"
+	case dns.TypeSRV:
+		rtype = "SRV"
+	case dns.TypeSVCB:
+		rtype = "SVCB"
+	case dns.TypeHTTPS:
+		rtype = "HTTPS"
+	case dns.TypeNAPTR:
+		rtype = "NAPTR"
+	case dns.TypeTXT:
+		rtype = "TXT"
+	case dns.TypeAAAA:
+		rtype = "AAAA"
+	case dns.TypeHINFO:
+		rtype = "HINFO"
+	case dns.TypeDNAME:
+		rtype = "DNAME"
+	case dns.TypeDNSKEY:
+		rtype = "DNSKEY"
+	case dns.TypeDS:
+		rtype = "DS"
+	}
+	return
+}
+
+// toQTypeSet returns the set of the upper-cased query type names
+func toQTypeSet(qtypes []string) map[string]struct{} {
+	if len(qtypes) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(qtypes))
+	for _, qtype := range qtypes {
+		set[strings.ToUpper(strings.TrimSpace(qtype))] = struct{}{}
+	}
+	return set
+}
+
+// isQTypeAllowed returns true if the query type passes the DnsAllowedQTypes
+// and DnsDeniedQTypes filters.
+func (h *DNSServer) isQTypeAllowed(qtype uint16) bool {
+	name := toQType(qtype)
+	if h.allowedQTypes != nil {
+		if _, ok := h.allowedQTypes[name]; !ok {
+			return false
+		}
+	}
+	_, denied := h.deniedQTypes[name]
+	return !denied
+}
+
+// matchIDRegex extracts the correlation id of name with CorrelationIdRegex,
+// the first capture group (or the whole match) being the candidate id.
+func (h *DNSServer) matchIDRegex(name string) (uniqueID, fullID, unsignedID string) {
+	match := h.idRegex.FindStringSubmatch(name)
+	if match == nil {
+		return
+	}
+	candidate := match[0]
+	if len(match) > 1 {
+		candidate = match[1]
+	}
+	normalized := strings.ToLower(candidate)
+	if !h.options.isCorrelationID(normalized) {
+		return
+	}
+	if h.options.SignedLabels && !h.options.hasSignedID(name, normalized) {
+		return "", "", normalized
+	}
+	return normalized, match[0], ""
+}
+
+// scanRawQuery scans the wire bytes of r for the correlation ids in their
+// order, catching the ids outside of the textual question such as in the
+// EDNS options.
+func (h *DNSServer) scanRawQuery(r *dns.Msg) (uniqueIDs, fullIDs []string, unsignedID string) {
+	raw, err := r.Pack()
+	if err != nil {
+		return
+	}
+	chunks := bytes.FieldsFunc(raw, func(c rune) bool {
+		return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9')
+	})
+	for _, chunk := range chunks {
+		for part := range stringsutil.SlideWithLength(string(chunk), h.options.GetIdLength()) {
+			normalizedPart := strings.ToLower(part)
+			if !h.options.isCorrelationID(normalizedPart) {
+				continue
+			}
+			if h.options.SignedLabels && !h.options.hasSignedID(string(chunk), normalizedPart) {
+				unsignedID = normalizedPart
+				continue
+			}
+			uniqueIDs, fullIDs = append(uniqueIDs, normalizedPart), append(fullIDs, part)
+		}
+	}
+	return
+}
+
+// handleInteraction handles an interaction for a question of the DNS server,
+// skipping the unique ids in seen.
+func (h *DNSServer) handleInteraction(question dns.Question, flakyPhase string, w queryConn, r *dns.Msg, m *dns.Msg, seen map[string]struct{}) {
+	var uniqueID, fullID, matchMethod, unsignedID string
+	domain := question.Name
+	if matchIgnoreList(h.options.DnsIgnoreNames, strings.TrimSuffix(domain, ".")) {
+		gologger.Debug().Msgf("Ignoring DNS interaction for %s\n", domain)
+		return
+	}
+
+	requestMsg := r.String()
+	responseMsg := m.String()
+	nsid, udpSize := getEDNSMetadata(r)
+
+	if label := h.matchHoneytoken(domain); label != "" {
+		interaction := &Interaction{
+			Protocol:     "dns",
+			UniqueID:     label,
+			FullId:       domain,
+			QType:        toQType(question.Qtype),
+			AnswerIPs:    getAnswerIPs(m),
+			RawRequest:   requestMsg,
+			RawResponse:  responseMsg,
+			LocalPort:    getLocalPort(w),
+			ClientSubnet: h.getClientSubnet(w, r),
+			EDNSNSID:     nsid,
+			EDNSUDPSize:  udpSize,
+			Timestamp:    time.Now(),
+		}
+		interaction.RemoteAddress, interaction.OriginAddress, interaction.OriginPort = h.getMsgOrigin(w, r)
+		if opt := r.IsEdns0(); opt != nil {
+			interaction.EDNS = opt.String()
+		}
+		h.options.HoneytokenRecorder.Record(interaction)
+	}
+
+	gologger.Debug().Msgf("New DNS request: %s\n", requestMsg)
+
+	var foundDomain string
+	for _, configuredDomain := range h.options.Domains {
+		configuredDotDomain := dns.Fqdn(configuredDomain)
+		if stringsutil.HasSuffixI(domain, configuredDotDomain) {
+			foundDomain = configuredDomain
+			break
 		}
 	}
 
 	// if root-tld is enabled stores any interaction towards the main domain
 	if h.options.RootTLD && foundDomain != "" {
 		correlationID := foundDomain
-		host := h.getMsgHost(w, r)
+		remote, origin, port := h.getMsgOrigin(w, r)
 		interaction := &Interaction{
-			Protocol:      "dns",
-			UniqueID:      domain,
-			FullId:        domain,
-			QType:         toQType(r.Question[0].Qtype),
-			RawRequest:    requestMsg,
-			RawResponse:   responseMsg,
-			RemoteAddress: host,
-			Timestamp:     time.Now(),
-		}
-
-		if nil != h.options.OnResult {
-			h.options.OnResult(interaction)
+			Protocol:         "dns",
+			UniqueID:         domain,
+			FullId:           domain,
+			QType:            toQType(question.Qtype),
+			AnswerIPs:        getAnswerIPs(m),
+			RawRequest:       requestMsg,
+			RawResponse:      responseMsg,
+			RemoteAddress:    remote,
+			OriginAddress:    origin,
+			OriginPort:       port,
+			LocalPort:        getLocalPort(w),
+			CheckingDisabled: r.CheckingDisabled,
+			EDNSPadded:       m.IsEdns0() != nil && hasEDNSPadding(m.IsEdns0()),
+			FlakyPhase:       flakyPhase,
+			QueryOrigin:      h.getQueryOrigin(w, r),
+			ClientSubnet:     h.getClientSubnet(w, r),
+			EDNSNSID:         nsid,
+			EDNSUDPSize:      udpSize,
+			Timestamp:        time.Now(),
 		}
 
 		buffer := &bytes.Buffer{}
@@ -328,32 +1893,72 @@ func (h *DNSServer) handleInteraction(domain string, w dns.ResponseWriter, r *dn
 			gologger.Warning().Msgf("Could not encode root tld dns interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("Root TLD DNS Interaction: \n%s\n", buffer.String())
-			if err := h.options.Storage.AddInteractionWithId(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.addInteractionWithId(correlationID, buffer.Bytes())
+			if err != nil && err != errStorageShed {
 				gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 			}
+			if err != errStorageShed {
+				h.options.publishInteraction(correlationID, interaction, buffer.Bytes())
+			}
+		}
+	}
+
+	if foundDomain != "" && h.idRegex != nil {
+		uniqueID, fullID, unsignedID = h.matchIDRegex(domain)
+		if uniqueID != "" {
+			matchMethod = "regex"
 		}
 	}
 
-	if foundDomain != "" {
+	// the heuristics extract the ids not matched by the regex
+	if foundDomain != "" && uniqueID == "" {
 		if h.options.ScanEverywhere {
+			var rawIDs, rawFullIDs []string
+			var rawUnsignedID string
+			if h.options.ScanRawQuery {
+				rawIDs, rawFullIDs, rawUnsignedID = h.scanRawQuery(r)
+			}
 			chunks := stringsutil.SplitAny(requestMsg, ".\n\t\"'")
 			for _, chunk := range chunks {
 				for part := range stringsutil.SlideWithLength(chunk, h.options.GetIdLength()) {
 					normalizedPart := strings.ToLower(part)
 					if h.options.isCorrelationID(normalizedPart) {
+						if h.options.SignedLabels && !h.options.hasSignedID(chunk, normalizedPart) {
+							unsignedID = normalizedPart
+							continue
+						}
 						uniqueID = normalizedPart
 						fullID = part
+						matchMethod = "scan-everywhere"
 					}
 				}
 			}
+			// the text form hex-encodes the binary data such as the EDNS
+			// options, only the raw scan finding the ids it carries. An id of
+			// the text form also on the wire is kept, the first id on the wire
+			// (that of the question if any) replacing the hex-encoded matches.
+			if len(rawIDs) > 0 && !sliceutil.Contains(rawIDs, uniqueID) {
+				uniqueID, fullID, matchMethod = rawIDs[0], rawFullIDs[0], "scan-raw"
+			}
+			if unsignedID == "" {
+				unsignedID = rawUnsignedID
+			}
 		} else {
 			parts := strings.Split(domain, ".")
 			for i, part := range parts {
-				subParts := splitSubdomainParts(part)
+				subParts := splitLabelParts(part, h.options.correlationIdSeparators())
 				for _, sub := range subParts {
+					// resolvers randomize the casing of the names (0x20 encoding)
+					// while the correlation ids are stored lowercased
+					sub = strings.ToLower(sub)
 					if h.options.isCorrelationID(sub) {
+						if h.options.SignedLabels && !h.options.hasSignedID(part, sub) {
+							unsignedID = sub
+							continue
+						}
 						uniqueID = sub
 						fullID = part
+						matchMethod = "label"
 						if i+1 <= len(parts) {
 							fullID = strings.Join(parts[:i+1], ".")
 						}
@@ -363,38 +1968,139 @@ func (h *DNSServer) handleInteraction(domain string, w dns.ResponseWriter, r *dn
 		}
 	}
 
+	if uniqueID != "" && h.options.TOTPLabels {
+		if found, valid := h.options.checkOTPLabel(domain); !valid {
+			if found {
+				gologger.Info().Msgf("expired-otp DNS interaction for %s from %s\n", uniqueID, h.getMsgHost(w, r))
+			}
+			uniqueID = ""
+		}
+	}
+
+	if uniqueID == "" && unsignedID != "" && h.options.LogUnsignedLabels {
+		gologger.Info().Msgf("Unsigned DNS interaction for %s from %s\n", unsignedID, h.getMsgHost(w, r))
+	}
+
+	if uniqueID != "" && (matchIgnoreList(h.options.DnsIgnoreIDs, uniqueID) || matchIgnoreList(h.options.DnsIgnoreIDs, h.options.getCorrelationID(uniqueID))) {
+		gologger.Debug().Msgf("Ignoring DNS interaction for %s\n", uniqueID)
+		return
+	}
+	if _, ok := seen[uniqueID]; ok {
+		return
+	}
 	if uniqueID != "" {
+		seen[uniqueID] = struct{}{}
+		remote, origin, port := h.getMsgOrigin(w, r)
+		if h.isDuplicateInteraction(uniqueID, question.Qtype, h.getMsgHost(w, r)) {
+			atomic.AddUint64(&h.options.Stats.DnsDeduplicated, 1)
+			return
+		}
 		correlationID := h.options.getCorrelationID(uniqueID)
-		host := h.getMsgHost(w, r)
 		interaction := &Interaction{
-			Protocol:      "dns",
-			UniqueID:      uniqueID,
-			FullId:        fullID,
-			QType:         toQType(r.Question[0].Qtype),
-			RawRequest:    requestMsg,
-			RawResponse:   responseMsg,
-			RemoteAddress: host,
-			Timestamp:     time.Now(),
+			Protocol:         "dns",
+			UniqueID:         uniqueID,
+			FullId:           fullID,
+			QType:            toQType(question.Qtype),
+			AnswerIPs:        getAnswerIPs(m),
+			MatchMethod:      matchMethod,
+			RawRequest:       requestMsg,
+			RawResponse:      responseMsg,
+			RemoteAddress:    remote,
+			OriginAddress:    origin,
+			OriginPort:       port,
+			LocalPort:        getLocalPort(w),
+			CheckingDisabled: r.CheckingDisabled,
+			EDNSPadded:       m.IsEdns0() != nil && hasEDNSPadding(m.IsEdns0()),
+			FlakyPhase:       flakyPhase,
+			QueryOrigin:      h.getQueryOrigin(w, r),
+			ClientSubnet:     h.getClientSubnet(w, r),
+			EDNSNSID:         nsid,
+			EDNSUDPSize:      udpSize,
+			Timestamp:        time.Now(),
 		}
 		buffer := &bytes.Buffer{}
 		if err := jsoniter.NewEncoder(buffer).Encode(interaction); err != nil {
 			gologger.Warning().Msgf("Could not encode dns interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("DNS Interaction: \n%s\n", buffer.String())
-			if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.addInteraction(correlationID, buffer.Bytes())
+			if err != nil && err != errStorageShed {
 				gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 			}
+			if err != errStorageShed {
+				h.options.publishInteraction(correlationID, interaction, buffer.Bytes())
+			}
 		}
 	}
 }
 
-func (h *DNSServer) getMsgHost(w dns.ResponseWriter, r *dns.Msg) string {
-	host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-	if h.options.OriginIPEDNSopt < 0 {
-		return host
+// matchIgnoreList returns true if value matches one of the entries of list,
+// case-insensitively, entries starting with * matching the values ending with them.
+func matchIgnoreList(list []string, value string) bool {
+	for _, entry := range list {
+		entry = strings.TrimSuffix(entry, ".")
+		if suffix, ok := strings.CutPrefix(entry, "*"); ok {
+			if stringsutil.HasSuffixI(value, suffix) {
+				return true
+			}
+		} else if strings.EqualFold(value, entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDuplicateInteraction returns true if the (uniqueID, qtype, source) tuple
+// was already seen within DnsDedupWindow.
+func (h *DNSServer) isDuplicateInteraction(uniqueID string, qtype uint16, host string) bool {
+	if h.options.DnsDedupWindow <= 0 {
+		return false
+	}
+	key := dedupCounterPrefix + uniqueID + "|" + dns.TypeToString[qtype] + "|" + host
+	return h.options.Counters.NextWithin(key, h.options.DnsDedupWindow) > 0
+}
+
+// getAnswerIPs returns the addresses of the A/AAAA records of the answer
+func getAnswerIPs(m *dns.Msg) []string {
+	var ips []string
+	for _, rr := range m.Answer {
+		switch record := rr.(type) {
+		case *dns.A:
+			ips = append(ips, record.A.String())
+		case *dns.AAAA:
+			ips = append(ips, record.AAAA.String())
+		}
+	}
+	return ips
+}
+
+// getEDNSMetadata returns the NSID and advertised UDP buffer size of the OPT record of r
+func getEDNSMetadata(r *dns.Msg) (nsid string, udpSize uint16) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return "", 0
 	}
+	for _, option := range opt.Option {
+		if option, ok := option.(*dns.EDNS0_NSID); ok {
+			nsid = option.Nsid
+		}
+	}
+	return nsid, opt.UDPSize()
+}
+
+// getLocalPort returns the local port the request was received on
+func getLocalPort(w queryConn) int {
+	switch addr := w.LocalAddr().(type) {
+	case *net.UDPAddr:
+		return addr.Port
+	case *net.TCPAddr:
+		return addr.Port
+	}
+	return 0
+}
 
-	isTrusted := false
+// isRealIPSource returns true if host is trusted to send the real client address
+func (h *DNSServer) isRealIPSource(host string) bool {
 	checkIP := net.ParseIP(host)
 
 	for _, test := range h.options.RealIPFrom {
@@ -402,25 +2108,68 @@ func (h *DNSServer) getMsgHost(w dns.ResponseWriter, r *dns.Msg) string {
 			_, cidr, err := net.ParseCIDR(test)
 			if err != nil {
 				gologger.Error().Msgf("Invalid CIDR format: %s, err: %s", test, err)
+				continue
 			}
 			if cidr.Contains(checkIP) {
-				isTrusted = true
-				break
+				return true
 			}
 		} else {
 			ip := net.ParseIP(test)
 			if ip == nil {
 				gologger.Error().Msgf("Invalid IP address: %s", test)
+				continue
 			}
 			if ip.Equal(checkIP) {
-				isTrusted = true
-				break
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// getClientSubnet returns the EDNS Client Subnet (RFC 7871) of queries sent
+// by a resolver trusted in RealIPFrom, e.g. 198.51.100.0/24.
+func (h *DNSServer) getClientSubnet(w queryConn, r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		subnet, ok := option.(*dns.EDNS0_SUBNET)
+		if !ok || subnet.Address == nil {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+		if !h.isRealIPSource(host) {
+			return ""
+		}
+		bits := 32
+		if subnet.Family == 2 {
+			bits = 128
+		}
+		network := &net.IPNet{IP: subnet.Address, Mask: net.CIDRMask(int(subnet.SourceNetmask), bits)}
+		return network.String()
+	}
+	return ""
+}
+
+// getMsgHost returns the client address of the query, the one carried by
+// the origin option if any or the connecting address.
+func (h *DNSServer) getMsgHost(w queryConn, r *dns.Msg) string {
+	remote, origin, _ := h.getMsgOrigin(w, r)
+	if origin != "" {
+		return origin
+	}
+	return remote
+}
 
-	if !isTrusted {
-		return host
+// getMsgOrigin returns the connecting address of the query along with the
+// client address carried by the origin option of the trusted sources and
+// its source port when OriginIPEDNSoptPort is set.
+func (h *DNSServer) getMsgOrigin(w queryConn, r *dns.Msg) (remote, origin string, port int) {
+	remote, _, _ = net.SplitHostPort(w.RemoteAddr().String())
+	if h.options.OriginIPEDNSopt < 0 || !h.isRealIPSource(remote) {
+		return remote, "", 0
 	}
 
 	for _, extra := range r.Extra {
@@ -430,28 +2179,212 @@ func (h *DNSServer) getMsgHost(w dns.ResponseWriter, r *dns.Msg) string {
 				switch opt := option.(type) {
 				case *dns.EDNS0_LOCAL:
 					if opt.Code == uint16(h.options.OriginIPEDNSopt) {
-						ip := net.IP(opt.Data)
-						testHost := ip.String()
-						if net.ParseIP(testHost) == nil {
+						data := opt.Data
+						if h.options.OriginIPEDNSoptPort && len(data) >= 2 {
+							data, port = data[:len(data)-2], int(binary.BigEndian.Uint16(data[len(data)-2:]))
+						}
+						ip := parseOriginIP(data)
+						if ip == nil {
 							gologger.Warning().Msgf("Invalid origin IP address: %s\n", opt.String())
-							return host
+							return remote, "", 0
 						}
-						return testHost
+						return remote, ip.String(), port
 					}
 				}
 			}
 		}
 	}
 
-	return host
+	return remote, "", 0
+}
+
+// parseOriginIP returns the address of an origin IP option payload, either
+// 4 or 16 bytes long, v4-mapped IPv6 addresses being returned as IPv4.
+func parseOriginIP(data []byte) net.IP {
+	switch len(data) {
+	case net.IPv4len, net.IPv6len:
+		ip := make(net.IP, len(data))
+		copy(ip, data)
+		if v4 := ip.To4(); v4 != nil {
+			return v4
+		}
+		return ip
+	}
+	return nil
 }
 
 // customDNSRecords is a server for custom dns records
 type customDNSRecords struct {
-	records            map[string]string
+	records            map[string][]string
+	recordWeights      map[string][]int
 	v6Records          map[string]string
+	wildcardRecords    map[string][]string
+	wildcardWeights    map[string][]int
+	wildcardV6Records  map[string]string
 	subdomainRecords   map[string]string
 	subdomainV6Records map[string]string
+	mapV4Labels        map[string]struct{}
+	caaRecords         map[string][]caaRecord
+	srvRecords         map[string]srvRecord
+	cnameRecords       map[string]string
+	svcbRecords        map[string]svcbRecord
+	naptrRecords       map[string][]naptrRecord
+	txtRecords         map[string][]string
+	cidrRecords        map[string]*net.IPNet
+	anameRecords       map[string]string
+	// strict makes invalid records fail the load, err being the first one
+	strict bool
+	err    error
+}
+
+// naptrRecord is a custom NAPTR record, e.g. for ENUM/SIP
+type naptrRecord struct {
+	Order       uint16 `yaml:"order"`
+	Preference  uint16 `yaml:"preference"`
+	Flags       string `yaml:"flags"`
+	Service     string `yaml:"service"`
+	Regexp      string `yaml:"regexp"`
+	Replacement string `yaml:"replacement"`
+}
+
+// checkCustomCNAME returns the CNAME target of the first label of zone
+func (c *customDNSRecords) checkCustomCNAME(zone string) string {
+	label, _, _ := strings.Cut(zone, ".")
+	return c.cnameRecords[strings.ToLower(label)]
+}
+
+// checkCustomNAPTRResponse returns the NAPTR records of the first label of zone
+func (c *customDNSRecords) checkCustomNAPTRResponse(zone string) []naptrRecord {
+	label, _, _ := strings.Cut(strings.ToLower(zone), ".")
+	return c.naptrRecords[label]
+}
+
+// anameApexLabel is the ANAME record key of the configured domains themselves
+const anameApexLabel = "@"
+
+// checkCustomANAME returns the ANAME target of the first label of zone, or
+// of the apex key when zone is a configured domain.
+func (c *customDNSRecords) checkCustomANAME(zone string, apex bool) string {
+	if apex {
+		return c.anameRecords[anameApexLabel]
+	}
+	label, _, _ := strings.Cut(strings.ToLower(zone), ".")
+	return c.anameRecords[label]
+}
+
+// checkCustomTXTResponse returns the TXT values of the first label of zone,
+// falling back to its dash separated parts, e.g. campaign1-<correlation-id>.
+func (c *customDNSRecords) checkCustomTXTResponse(zone string) []string {
+	label, _, _ := strings.Cut(strings.ToLower(zone), ".")
+	if values, ok := c.txtRecords[label]; ok {
+		return values
+	}
+	for _, part := range splitSubdomainParts(label) {
+		if values, ok := c.txtRecords[part]; ok && part != label {
+			return values
+		}
+	}
+	return nil
+}
+
+// svcbRecord is a custom SVCB/HTTPS record with its key=value params
+type svcbRecord struct {
+	Priority uint16 `yaml:"priority"`
+	Target   string `yaml:"target"`
+	Params   string `yaml:"params"`
+}
+
+// build returns the SVCB or HTTPS resource record of the record for zone
+func (r svcbRecord) build(zone string, rrtype uint16, ttl uint32) (dns.RR, error) {
+	target := r.Target
+	if target == "" {
+		target = "."
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %d %s %s", zone, ttl, dns.TypeToString[rrtype], r.Priority, dns.Fqdn(target), r.Params))
+}
+
+// checkCustomSVCBResponse returns the SVCB/HTTPS record of the first label of zone
+func (c *customDNSRecords) checkCustomSVCBResponse(zone string) (svcbRecord, bool) {
+	label, _, _ := strings.Cut(strings.ToLower(zone), ".")
+	record, ok := c.svcbRecords[label]
+	return record, ok
+}
+
+// srvRecord is a custom SRV record in the <priority> <weight> <port> <target> format
+type srvRecord struct {
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+}
+
+// parseSRVRecord parses a SRV record in the <priority> <weight> <port> <target> format
+func parseSRVRecord(value string) (srvRecord, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 4 {
+		return srvRecord{}, errors.New("expected <priority> <weight> <port> <target>")
+	}
+	var numbers [3]uint16
+	for i := range numbers {
+		number, err := strconv.ParseUint(fields[i], 10, 16)
+		if err != nil {
+			return srvRecord{}, errors.Wrapf(err, "invalid number %s", fields[i])
+		}
+		numbers[i] = uint16(number)
+	}
+	return srvRecord{priority: numbers[0], weight: numbers[1], port: numbers[2], target: dns.Fqdn(fields[3])}, nil
+}
+
+// checkCustomSRVResponse returns the SRV record of the _service._proto labels of zone
+func (c *customDNSRecords) checkCustomSRVResponse(zone string) (srvRecord, bool) {
+	parts := strings.SplitN(strings.ToLower(zone), ".", 3)
+	if len(parts) != 3 {
+		return srvRecord{}, false
+	}
+	record, ok := c.srvRecords[parts[0]+"."+parts[1]]
+	return record, ok
+}
+
+// caaRecord is a custom CAA record in the <flag> <tag> "<value>" format
+type caaRecord struct {
+	flag  uint8
+	tag   string
+	value string
+}
+
+// parseCAARecord parses a CAA record in the <flag> <tag> "<value>" format
+func parseCAARecord(value string) (caaRecord, error) {
+	fields := strings.SplitN(strings.TrimSpace(value), " ", 3)
+	if len(fields) != 3 {
+		return caaRecord{}, errors.New("expected <flag> <tag> \"<value>\"")
+	}
+	flag, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return caaRecord{}, errors.Wrap(err, "invalid flag")
+	}
+	return caaRecord{flag: uint8(flag), tag: fields[1], value: strings.Trim(strings.TrimSpace(fields[2]), "\"")}, nil
+}
+
+// addCAARecord adds the CAA record value for name
+func (c *customDNSRecords) addCAARecord(name, value string) {
+	record, err := parseCAARecord(value)
+	if err != nil {
+		gologger.Warning().Msgf("Invalid CAA record: %s=%s, err: %s.", name, value, err)
+		return
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	c.caaRecords[name] = append(c.caaRecords[name], record)
+}
+
+// checkCustomCAAResponse returns the CAA records of zone, looking up
+// the full name first and its first label then.
+func (c *customDNSRecords) checkCustomCAAResponse(zone string) []caaRecord {
+	name := strings.TrimSuffix(strings.ToLower(zone), ".")
+	if records, ok := c.caaRecords[name]; ok {
+		return records
+	}
+	label, _, _ := strings.Cut(name, ".")
+	return c.caaRecords[label]
 }
 
 // defaultCustomRecords is the list of default custom DNS records
@@ -468,6 +2401,23 @@ var defaultCustomV6Records = map[string]string{
 }
 
 func newCustomDNSRecordsServer(options *Options) *customDNSRecords {
+	server, err := loadCustomDNSRecords(options)
+	if err != nil {
+		gologger.Error().Msgf("Could not read custom DNS records: %s", err)
+	}
+	return server
+}
+
+// ValidateCustomRecords loads the custom records of options, returning the
+// error reading them or, with StrictCustomRecords, the first invalid record.
+func ValidateCustomRecords(options *Options) error {
+	_, err := loadCustomDNSRecords(options)
+	return err
+}
+
+// loadCustomDNSRecords returns the custom records of options along with the
+// error reading the custom records file, if any.
+func loadCustomDNSRecords(options *Options) (*customDNSRecords, error) {
 	subdomainRecords := make(map[string]string)
 	subdomainV6Records := make(map[string]string)
 	for _, m := range options.DnsSubdomainRecords {
@@ -487,31 +2437,126 @@ func newCustomDNSRecordsServer(options *Options) *customDNSRecords {
 	}
 
 	server := &customDNSRecords{
-		records:            make(map[string]string),
+		records:            make(map[string][]string),
+		recordWeights:      make(map[string][]int),
 		v6Records:          make(map[string]string),
+		wildcardRecords:    make(map[string][]string),
+		wildcardWeights:    make(map[string][]int),
+		wildcardV6Records:  make(map[string]string),
 		subdomainRecords:   subdomainRecords,
 		subdomainV6Records: subdomainV6Records,
+		mapV4Labels:        make(map[string]struct{}),
+		caaRecords:         make(map[string][]caaRecord),
+		srvRecords:         make(map[string]srvRecord),
+		cnameRecords:       make(map[string]string),
+		svcbRecords:        make(map[string]svcbRecord),
+		naptrRecords:       make(map[string][]naptrRecord),
+		txtRecords:         make(map[string][]string),
+		cidrRecords:        make(map[string]*net.IPNet),
+		anameRecords:       make(map[string]string),
+		strict:             options.StrictCustomRecords,
+	}
+	for _, record := range options.CAARecords {
+		parts := strings.SplitN(record, "=", 2)
+		if len(parts) != 2 {
+			gologger.Warning().Msgf("Invalid CAARecord: %s, err: expected domain=<flag> <tag> \"<value>\".", record)
+			continue
+		}
+		server.addCAARecord(parts[0], parts[1])
 	}
 
 	input := options.CustomRecords
-	for k, v := range defaultCustomRecords {
-		server.records[k] = v
-	}
-	for k, v := range defaultCustomV6Records {
-		server.v6Records[k] = v
+	if !options.DisableDefaultRecords {
+		for k, v := range defaultCustomRecords {
+			if ip, ok := server.checkIP(k, v, true); ok {
+				server.records[k] = []string{ip}
+			}
+		}
+		for k, v := range defaultCustomV6Records {
+			if ip, ok := server.checkIP(k, v, false); ok {
+				server.v6Records[k] = ip
+			}
+		}
 	}
 
 	if input != "" {
 		if err := server.readRecordsFromFile(input); err != nil {
-			gologger.Error().Msgf("Could not read custom DNS records: %s", err)
+			return server, err
 		}
 	}
-	return server
+	if server.err != nil {
+		return server, server.err
+	}
+	server.reportCounts(options.Stats)
+	return server, nil
+}
+
+// invalidRecord warns about an invalid custom record, failing the load in strict mode
+func (c *customDNSRecords) invalidRecord(format string, args ...interface{}) {
+	gologger.Warning().Msgf(format, args...)
+	if c.strict && c.err == nil {
+		c.err = errors.Errorf(format, args...)
+	}
+}
+
+// checkIP returns the trimmed ip of a custom record and whether it is a
+// valid address of the IPv4 (or IPv6) family.
+func (c *customDNSRecords) checkIP(label, value string, v4 bool) (string, bool) {
+	value = strings.TrimSpace(value)
+	ip := net.ParseIP(value)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		c.invalidRecord("Invalid custom record: %s=%s, err: Invalid IP address.", label, value)
+		return "", false
+	}
+	return value, true
+}
+
+// reportCounts logs the sizes of the custom record maps and updates their metrics
+func (c *customDNSRecords) reportCounts(stats *Metrics) {
+	gologger.Info().Msgf("Loaded custom DNS records: %d ipv4, %d ipv6, %d subdomain ipv4, %d subdomain ipv6", len(c.records), len(c.v6Records), len(c.subdomainRecords), len(c.subdomainV6Records))
+	if stats == nil {
+		return
+	}
+	atomic.StoreUint64(&stats.CustomRecords.IPv4, uint64(len(c.records)))
+	atomic.StoreUint64(&stats.CustomRecords.IPv6, uint64(len(c.v6Records)))
+	atomic.StoreUint64(&stats.CustomRecords.SubdomainIPv4, uint64(len(c.subdomainRecords)))
+	atomic.StoreUint64(&stats.CustomRecords.SubdomainIPv6, uint64(len(c.subdomainV6Records)))
 }
 
 type customRecordConfig struct {
-	IPv4 map[string]string `yaml:"ipv4"`
-	IPv6 map[string]string `yaml:"ipv6"`
+	IPv4  map[string]ipList        `yaml:"ipv4"`
+	IPv6  map[string]string        `yaml:"ipv6"`
+	MapV4 []string                 `yaml:"mapv4"`
+	CAA   map[string][]string      `yaml:"caa"`
+	SRV   map[string]string        `yaml:"srv"`
+	CNAME map[string]string        `yaml:"cname"`
+	SVCB  map[string]svcbRecord    `yaml:"svcb"`
+	NAPTR map[string][]naptrRecord `yaml:"naptr"`
+	TXT   map[string][]string      `yaml:"txt"`
+	CIDR  map[string]string        `yaml:"cidr"`
+	ANAME map[string]string        `yaml:"aname"`
+}
+
+// ipList is a list of ips given as a comma-separated string or a sequence
+type ipList []string
+
+// UnmarshalYAML decodes the comma-separated or sequence list of ips
+func (l *ipList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = nil
+		for _, ip := range strings.Split(value.Value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				*l = append(*l, ip)
+			}
+		}
+		return nil
+	}
+	var ips []string
+	if err := value.Decode(&ips); err != nil {
+		return err
+	}
+	*l = ips
+	return nil
 }
 
 func (c *customDNSRecords) readRecordsFromFile(input string) error {
@@ -521,31 +2566,331 @@ func (c *customDNSRecords) readRecordsFromFile(input string) error {
 	}
 	defer file.Close()
 
+	switch {
+	case strings.EqualFold(filepath.Ext(input), ".csv"):
+		return c.readRecordsFromCSV(file)
+	case strings.EqualFold(filepath.Ext(input), ".hosts"), filepath.Base(input) == "hosts":
+		return c.readRecordsFromHosts(file)
+	}
+
 	var data customRecordConfig
 
 	if err := yaml.NewDecoder(file).Decode(&data); err != nil {
 		return errors.Wrap(err, "could not decode file")
 	}
 	for k, v := range data.IPv4 {
-		c.records[strings.ToLower(k)] = v
+		ips, weights := parseWeightedIPs(k, v)
+		ips, weights = c.checkIPs(k, ips, weights)
+		if len(ips) == 0 {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(strings.ToLower(k), "*"); ok {
+			c.wildcardRecords[prefix] = ips
+			if weights != nil {
+				c.wildcardWeights[prefix] = weights
+			}
+			continue
+		}
+		c.records[strings.ToLower(k)] = ips
+		if weights != nil {
+			c.recordWeights[strings.ToLower(k)] = weights
+		}
 	}
 	for k, v := range data.IPv6 {
+		v, ok := c.checkIP(k, v, false)
+		if !ok {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(strings.ToLower(k), "*"); ok {
+			c.wildcardV6Records[prefix] = v
+			continue
+		}
 		c.v6Records[strings.ToLower(k)] = v
 	}
+	for _, k := range data.MapV4 {
+		c.mapV4Labels[strings.ToLower(k)] = struct{}{}
+	}
+	for k, v := range data.SRV {
+		record, err := parseSRVRecord(v)
+		if err != nil {
+			gologger.Warning().Msgf("Invalid SRV record: %s=%s, err: %s.", k, v, err)
+			continue
+		}
+		c.srvRecords[strings.ToLower(k)] = record
+	}
+	for k, v := range data.SVCB {
+		if _, err := v.build("svcb.", dns.TypeSVCB, 0); err != nil {
+			gologger.Warning().Msgf("Invalid SVCB record: %s, err: %s.", k, err)
+			continue
+		}
+		c.svcbRecords[strings.ToLower(k)] = v
+	}
+	for k, v := range data.CNAME {
+		if _, ok := dns.IsDomainName(v); !ok || v == "" {
+			gologger.Warning().Msgf("Invalid CNAME record: %s=%s, err: Invalid target.", k, v)
+			continue
+		}
+		c.cnameRecords[strings.ToLower(k)] = dns.Fqdn(v)
+	}
+	for k, v := range data.NAPTR {
+		c.naptrRecords[strings.ToLower(k)] = v
+	}
+	for k, v := range data.TXT {
+		c.txtRecords[strings.ToLower(k)] = v
+	}
+	for k, v := range data.CIDR {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(v))
+		if err != nil || network.IP.To4() == nil {
+			c.invalidRecord("Invalid CIDR record: %s=%s, err: Invalid IPv4 range.", k, v)
+			continue
+		}
+		c.cidrRecords[strings.ToLower(k)] = network
+	}
+	for k, v := range data.ANAME {
+		if _, ok := dns.IsDomainName(v); !ok || v == "" {
+			c.invalidRecord("Invalid ANAME record: %s=%s, err: Invalid target.", k, v)
+			continue
+		}
+		c.anameRecords[strings.ToLower(k)] = dns.Fqdn(v)
+	}
+	for k, values := range data.CAA {
+		for _, v := range values {
+			c.addCAARecord(k, v)
+		}
+	}
+
+	return nil
+}
+
+// checkIPs drops the invalid IPv4 addresses of a record along with their weights
+func (c *customDNSRecords) checkIPs(label string, ips []string, weights []int) ([]string, []int) {
+	valid := ips[:0]
+	var validWeights []int
+	for i, ip := range ips {
+		if ip, ok := c.checkIP(label, ip, true); ok {
+			valid = append(valid, ip)
+			if weights != nil {
+				validWeights = append(validWeights, weights[i])
+			}
+		}
+	}
+	return valid, validWeights
+}
+
+// parseWeightedIPs splits the "ip|weight" entries of a record into its ips
+// and their weights, nil if no entry is weighted. Weights default to 1.
+func parseWeightedIPs(label string, values []string) ([]string, []int) {
+	var weighted bool
+	ips := make([]string, 0, len(values))
+	weights := make([]int, 0, len(values))
+	for _, value := range values {
+		ip, weightValue, ok := strings.Cut(value, "|")
+		weight := 1
+		if ok {
+			weighted = true
+			parsed, err := strconv.Atoi(strings.TrimSpace(weightValue))
+			if err != nil || parsed < 0 {
+				gologger.Warning().Msgf("Invalid custom record weight: %s=%s, err: expected a positive integer.", label, value)
+				continue
+			}
+			weight = parsed
+		}
+		ips = append(ips, strings.TrimSpace(ip))
+		weights = append(weights, weight)
+	}
+	if !weighted {
+		return ips, nil
+	}
+	return ips, weights
+}
 
+// pickWeighted returns the ip selected by cumulative weight among ips,
+// or all of them if they are not weighted.
+func (c *customDNSRecords) pickWeighted(ips []string, weights []int) []string {
+	if len(weights) != len(ips) || len(ips) == 0 {
+		return ips
+	}
+	var total int
+	for _, weight := range weights {
+		total += weight
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for i, weight := range weights {
+		if n < weight {
+			return []string{ips[i]}
+		}
+		n -= weight
+	}
 	return nil
 }
 
-func (c *customDNSRecords) checkCustomResponse(zone string) string {
+// readRecordsFromHosts reads records from a hosts-format file (IP hostname...),
+// using the first label of each hostname.
+func (c *customDNSRecords) readRecordsFromHosts(file io.Reader) error {
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if idx := strings.Index(line, "#"); idx >= 0 {
+			line = line[:idx]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			gologger.Warning().Msgf("Invalid hosts record: %s, err: expected ip hostname.", line)
+			continue
+		}
+		for _, hostname := range fields[1:] {
+			label, _, _ := strings.Cut(hostname, ".")
+			c.addRecord(label, fields[0], "")
+		}
+	}
+	return errors.Wrap(scanner.Err(), "could not read hosts file")
+}
+
+// readRecordsFromCSV reads records from a CSV file (label,ip,type,ttl) where
+// type and ttl are optional. Records share the DNS server ttl, a warning
+// being logged if the ttl column is set.
+func (c *customDNSRecords) readRecordsFromCSV(file io.Reader) error {
+	reader := csv.NewReader(file)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	var ignoredTTLs int
+	for {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			if ignoredTTLs > 0 {
+				gologger.Warning().Msgf("Ignoring the ttl column of %d CSV records, err: Records share the DNS server ttl.", ignoredTTLs)
+			}
+			return nil
+		}
+		if err != nil {
+			if _, ok := err.(*csv.ParseError); ok {
+				gologger.Warning().Msgf("Invalid CSV record: %s", err)
+				continue
+			}
+			return errors.Wrap(err, "could not read csv file")
+		}
+		if len(fields) < 2 {
+			gologger.Warning().Msgf("Invalid CSV record: %s, err: expected label,ip,type,ttl.", strings.Join(fields, ","))
+			continue
+		}
+		if strings.EqualFold(fields[0], "label") {
+			continue
+		}
+		var recordType string
+		if len(fields) > 2 {
+			recordType = strings.ToUpper(fields[2])
+		}
+		if len(fields) > 3 && strings.TrimSpace(fields[3]) != "" {
+			ignoredTTLs++
+		}
+		c.addRecord(fields[0], fields[1], recordType)
+	}
+}
+
+// addRecord adds the ip for label to the records matching its family,
+// recordType (A or AAAA) being checked against the ip when set.
+func (c *customDNSRecords) addRecord(label, value, recordType string) {
+	value = strings.TrimSpace(value)
+	ip := net.ParseIP(value)
+	if label == "" || ip == nil {
+		c.invalidRecord("Invalid custom record: %s=%s, err: Invalid IP address.", label, value)
+		return
+	}
+	isV4 := ip.To4() != nil
+	switch {
+	case recordType == "A" && !isV4, recordType == "AAAA" && isV4:
+		c.invalidRecord("Invalid custom record: %s=%s, err: Address does not match type %s.", label, value, recordType)
+	case recordType != "" && recordType != "A" && recordType != "AAAA":
+		c.invalidRecord("Invalid custom record: %s=%s, err: Unsupported type %s.", label, value, recordType)
+	case isV4:
+		records := c.records
+		label = strings.ToLower(label)
+		if prefix, ok := strings.CutSuffix(label, "*"); ok {
+			records, label = c.wildcardRecords, prefix
+		}
+		if !sliceutil.Contains(records[label], value) {
+			records[label] = append(records[label], value)
+		}
+	default:
+		if prefix, ok := strings.CutSuffix(strings.ToLower(label), "*"); ok {
+			c.wildcardV6Records[prefix] = value
+			return
+		}
+		c.v6Records[strings.ToLower(label)] = value
+	}
+}
+
+// reflectLabel is the reserved label answered with the address of the client
+const reflectLabel = "whatismyip"
+
+// checkCustomResponse returns the custom IPv4 addresses of zone, exact labels
+// taking precedence over the subdomain parts and then the wildcard records.
+// The reflect label gets client when it is an IPv4 address.
+func (c *customDNSRecords) checkCustomResponse(zone, client string) []string {
 	parts := strings.SplitN(zone, ".", 2)
 	if len(parts) != 2 {
-		return ""
+		return nil
 	}
-	if value, ok := c.records[strings.ToLower(parts[0])]; ok {
-		return value
+	label := strings.ToLower(parts[0])
+	if label == reflectLabel {
+		if ip := net.ParseIP(client); ip != nil && ip.To4() != nil {
+			return []string{client}
+		}
+	}
+	if values, ok := c.records[label]; ok {
+		return c.pickWeighted(values, c.recordWeights[label])
+	}
+	if ip, ok := c.checkCIDRResponse(label); ok {
+		return []string{ip}
+	}
+	if ip := c.checkSubdomainPartsResponse(parts[0]); ip != "" {
+		return []string{ip}
+	}
+	values, prefix := matchWildcardLabel(c.wildcardRecords, label)
+	return c.pickWeighted(values, c.wildcardWeights[prefix])
+}
+
+// checkCIDRResponse returns a random address of the range of label, or the
+// address at the hex index of <label>-<index> labels, e.g. pool-1f.
+func (c *customDNSRecords) checkCIDRResponse(label string) (string, bool) {
+	if network, ok := c.cidrRecords[label]; ok {
+		return cidrAddress(network, rand.Uint64()), true
+	}
+	parts := splitSubdomainParts(label)
+	if len(parts) != 2 || len(parts[1]) > 8 {
+		return "", false
+	}
+	network, ok := c.cidrRecords[parts[0]]
+	if !ok {
+		return "", false
+	}
+	index, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return "", false
 	}
+	return cidrAddress(network, index), true
+}
+
+// cidrAddress returns the address at index of network, wrapping around its size
+func cidrAddress(network *net.IPNet, index uint64) string {
+	ones, bits := network.Mask.Size()
+	base := uint64(binary.BigEndian.Uint32(network.IP.To4()))
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, uint32(base+index%(uint64(1)<<(bits-ones))))
+	return ip.String()
+}
 
-	subParts := splitSubdomainParts(parts[0])
+// checkSubdomainPartsResponse returns a random IPv4 address of the dash separated
+// parts of label, "" standing for the server address.
+func (c *customDNSRecords) checkSubdomainPartsResponse(label string) string {
+	subParts := splitSubdomainParts(label)
 	if len(subParts) == 1 {
 		return ""
 	}
@@ -575,11 +2920,24 @@ func (c *customDNSRecords) checkCustomAAAAResponse(zone string) string {
 	if len(parts) != 2 {
 		return ""
 	}
-	if value, ok := c.v6Records[strings.ToLower(parts[0])]; ok {
+	label := strings.ToLower(parts[0])
+	if value, ok := c.v6Records[label]; ok {
 		return value
 	}
+	if value := c.checkMappedV4Response(label); value != "" {
+		return value
+	}
+	if ip := c.checkSubdomainPartsAAAAResponse(parts[0]); ip != "" {
+		return ip
+	}
+	value, _ := matchWildcardLabel(c.wildcardV6Records, label)
+	return value
+}
 
-	subParts := splitSubdomainParts(parts[0])
+// checkSubdomainPartsAAAAResponse returns a random IPv6 address of the dash
+// separated parts of label, "" standing for the server address.
+func (c *customDNSRecords) checkSubdomainPartsAAAAResponse(label string) string {
+	subParts := splitSubdomainParts(label)
 	if len(subParts) == 1 {
 		return ""
 	}
@@ -588,6 +2946,12 @@ func (c *customDNSRecords) checkCustomAAAAResponse(zone string) string {
 	for _, part := range subParts {
 		if part == "" {
 			ips = append(ips, "") // "" represent options.IPv6Address
+		} else if ok := HEX_IPV6_REGEX.MatchString(part); ok {
+			ip, err := hex.DecodeString(part)
+			if err != nil {
+				continue
+			}
+			ips = append(ips, net.IP(ip).String())
 		} else if ans, ok := c.subdomainV6Records[strings.ToLower(part)]; ok {
 			ips = append(ips, ans)
 		}
@@ -598,11 +2962,51 @@ func (c *customDNSRecords) checkCustomAAAAResponse(zone string) string {
 	return ips[rand.Intn(len(ips))]
 }
 
+// matchWildcardLabel returns the record of the most specific wildcard prefix
+// matching label along with the prefix, "" being the catch-all "*" record.
+func matchWildcardLabel[T any](records map[string]T, label string) (T, string) {
+	for i := len(label); i >= 0; i-- {
+		if value, ok := records[label[:i]]; ok {
+			return value, label[:i]
+		}
+	}
+	var value T
+	return value, ""
+}
+
+// checkMappedV4Response returns the IPv4-mapped IPv6 address of the
+// IPv4 custom record for labels configured with mapv4.
+func (c *customDNSRecords) checkMappedV4Response(label string) string {
+	if _, ok := c.mapV4Labels[label]; !ok {
+		return ""
+	}
+	values, ok := c.records[label]
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	value := values[0]
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		gologger.Warning().Msgf("Invalid mapv4 record: %s, err: Invalid IPv4 address %s.", label, value)
+		return ""
+	}
+	return "::ffff:" + ip.String()
+}
+
+// defaultCorrelationIdSeparators split the labels into the parts checked for
+// correlation ids when CorrelationIdSeparators is unset
+const defaultCorrelationIdSeparators = "-_"
+
 func splitSubdomainParts(s string) []string {
+	return splitLabelParts(s, defaultCorrelationIdSeparators)
+}
+
+// splitLabelParts splits s on any of the separators characters
+func splitLabelParts(s, separators string) []string {
 	var r []string
 	p := ""
 	for _, c := range s {
-		if c == '-' || c == '_' {
+		if strings.ContainsRune(separators, c) {
 			r, p = append(r, p), ""
 		} else {
 			p = p + string(c)
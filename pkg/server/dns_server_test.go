@@ -0,0 +1,1678 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/libdns/libdns"
+	"github.com/miekg/dns"
+	"github.com/projectdiscovery/interactsh/pkg/server/acme"
+	"github.com/projectdiscovery/interactsh/pkg/settings"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+// testResponseWriter is a dns.ResponseWriter capturing the written message
+type testResponseWriter struct {
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	msg        *dns.Msg
+}
+
+func newTestResponseWriter(network string) *testResponseWriter {
+	if network == "tcp" {
+		return &testResponseWriter{
+			remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000},
+			localAddr:  &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+		}
+	}
+	return &testResponseWriter{
+		remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 53000},
+		localAddr:  &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53},
+	}
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr         { return w.localAddr }
+func (w *testResponseWriter) RemoteAddr() net.Addr        { return w.remoteAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+func newTestDNSServer(t *testing.T, options *Options) *DNSServer {
+	if options.Domains == nil {
+		options.Domains = []string{"example.com"}
+	}
+	if options.IPAddress == "" {
+		options.IPAddress = "203.0.113.1"
+	}
+	if options.Storage == nil {
+		store, err := storage.New(&storage.Options{})
+		require.Nil(t, err, "could not create storage")
+		options.Storage = store
+	}
+	if options.Stats == nil {
+		options.Stats = &Metrics{}
+	}
+	return NewDNSServer("udp", options)
+}
+
+func queryTestDNSServer(server *DNSServer, name string, qtype uint16) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(name), qtype)
+	w := newTestResponseWriter("udp")
+	server.ServeDNS(w, r)
+	return w.msg
+}
+
+func TestDNSServerSequenceRecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		SequenceRecords: map[string][]string{"rebind": {"1.1.1.1", "127.0.0.1"}},
+	})
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		m := queryTestDNSServer(server, "Rebind.example.com", dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not get answer")
+		got = append(got, m.Answer[0].(*dns.A).A.String())
+	}
+	require.Equal(t, []string{"1.1.1.1", "127.0.0.1", "1.1.1.1"}, got, "could not get sequential answers")
+	require.Equal(t, uint64(3), server.options.Counters.Values(sequenceCounterPrefix)["rebind"], "could not get counter value")
+}
+
+func TestDNSServerOfflineMode(t *testing.T) {
+	server := newTestDNSServer(t, &Options{OfflineMode: true, OfflineIP: "127.0.0.2"})
+
+	for _, name := range []string{"aws.example.com", "_acme-challenge.example.com", "anything.example.com"} {
+		m := queryTestDNSServer(server, name, dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not get answer for %s", name)
+		require.Equal(t, "127.0.0.2", m.Answer[0].(*dns.A).A.String(), "could not get offline ip for %s", name)
+	}
+}
+
+func TestDNSServerSplitHorizon(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		SplitHorizon: []SplitHorizonRecord{
+			{CIDR: "10.0.0.0/8", IP: "10.1.1.1"},
+			{CIDR: "192.0.2.0/24", IP: "10.2.2.2"},
+		},
+	})
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not get answer")
+	require.Equal(t, "10.2.2.2", m.Answer[0].(*dns.A).A.String(), "could not get split-horizon ip")
+}
+
+func TestDNSServerMappedV4Records(t *testing.T) {
+	records := &customDNSRecords{
+		records:     map[string][]string{"aws": {"169.254.169.254"}, "bad": {"not-an-ip"}},
+		v6Records:   map[string]string{},
+		mapV4Labels: map[string]struct{}{"aws": {}, "bad": {}},
+	}
+
+	require.Equal(t, "::ffff:169.254.169.254", records.checkCustomAAAAResponse("aws.example.com."), "could not get mapped address")
+	require.Equal(t, "", records.checkCustomAAAAResponse("bad.example.com."), "could not skip invalid address")
+}
+
+func TestOrderRFC(t *testing.T) {
+	a, _ := dns.NewRR("www.example.com. 60 IN A 127.0.0.1")
+	cname, _ := dns.NewRR("alias.example.com. 60 IN CNAME www.example.com.")
+	ns2, _ := dns.NewRR("ns2.example.com. 60 IN A 127.0.0.1")
+	ns1, _ := dns.NewRR("ns1.example.com. 60 IN A 127.0.0.1")
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+
+	m := &dns.Msg{Answer: []dns.RR{a, cname}, Extra: []dns.RR{opt, ns2, ns1}}
+	orderRFC(m)
+	require.Equal(t, []dns.RR{cname, a}, m.Answer, "could not order answer section")
+	require.Equal(t, []dns.RR{ns1, ns2, opt}, m.Extra, "could not order additional section")
+}
+
+func TestDNSServerSignedLabels(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		SignedLabels:             true,
+		Token:                    "token",
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	m := queryTestDNSServer(server, "aws."+uniqueID+".example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip for unsigned label")
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 0, "could not skip unsigned interaction")
+
+	signed := uniqueID + "-" + SignLabel(uniqueID, "token")
+	m = queryTestDNSServer(server, "aws."+signed+".example.com", dns.TypeA)
+	require.Equal(t, "169.254.169.254", m.Answer[0].(*dns.A).A.String(), "could not get custom ip for signed label")
+	require.Len(t, item.Data, 1, "could not store signed interaction")
+}
+
+func TestDNSServerDiscovery(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		DNSDiscovery:             true,
+		Version:                  "1.0.0",
+		ScanEverywhere:           true,
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+
+	m := queryTestDNSServer(server, "_Interactsh.example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get discovery answer")
+	require.Equal(t, []string{"v=1.0.0", "protocols=dns,http,smtp,ldap", "features=scan-everywhere", "cidl=20", "cidn=13"}, m.Answer[0].(*dns.TXT).Txt, "could not get capabilities")
+}
+
+func TestDNSServerTCPTTLOverride(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsTTL: 3600, TCPTTLOverride: 1, DnsTTLByType: map[string]int{"mx": 60}})
+	tcpServer := NewDNSServer("tcp", server.options)
+	dohServer := NewDNSServer("https", server.options)
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, uint32(3600), m.Answer[0].Header().Ttl, "could not get udp ttl")
+	m = queryTestDNSServer(server, "example.com", dns.TypeMX)
+	require.Equal(t, uint32(60), m.Answer[0].Header().Ttl, "could not get udp mx ttl")
+	for _, stream := range []*DNSServer{tcpServer, dohServer} {
+		m = queryTestDNSServer(stream, "test.example.com", dns.TypeA)
+		require.Equal(t, uint32(1), m.Answer[0].Header().Ttl, "could not get tcp ttl")
+		m = queryTestDNSServer(stream, "example.com", dns.TypeMX)
+		require.Equal(t, uint32(1), m.Answer[0].Header().Ttl, "could not override mx ttl over tcp")
+	}
+}
+
+func TestDNSServerDNAMERecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		DNAMERecords: map[string]string{"redirect": "target.test"},
+	})
+
+	m := queryTestDNSServer(server, "www.Redirect.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 2, "could not get dname answers")
+	dname := m.Answer[0].(*dns.DNAME)
+	require.Equal(t, "Redirect.example.com.", dname.Hdr.Name, "could not get dname owner")
+	require.Equal(t, "target.test.", dname.Target, "could not get dname target")
+	require.Equal(t, "www.target.test.", m.Answer[1].(*dns.CNAME).Target, "could not get synthesized cname")
+
+	m = queryTestDNSServer(server, "redirect.example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip for dname owner")
+
+	m = queryTestDNSServer(server, "redirect.example.com", dns.TypeDNAME)
+	require.Len(t, m.Answer, 1, "could not get dname record")
+}
+
+func TestDNSServerDelegations(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		Delegations:              map[string][]string{"sub": {"ns1.sub.example.com=198.51.100.1", "ns2.example.net"}},
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	m := queryTestDNSServer(server, uniqueID+".Sub.example.com", dns.TypeA)
+	require.False(t, m.Authoritative, "could not answer referral")
+	require.Empty(t, m.Answer, "could not skip answer")
+	require.Len(t, m.Ns, 2, "could not get delegated name servers")
+	require.Equal(t, "sub.example.com.", m.Ns[0].Header().Name, "could not get delegation owner")
+	require.Equal(t, "ns2.example.net.", m.Ns[1].(*dns.NS).Ns, "could not get delegated name server")
+	require.Len(t, m.Extra, 1, "could not get glue")
+	require.Equal(t, "198.51.100.1", m.Extra[0].(*dns.A).A.String(), "could not get glue ip")
+
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store delegated interaction")
+
+	m = queryTestDNSServer(server, "notsub.example.com", dns.TypeA)
+	require.True(t, m.Authoritative, "could not answer outside delegation")
+	require.Len(t, m.Answer, 1, "could not answer outside delegation")
+}
+
+func TestDNSServerCDBypassRecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		CDBypassRecords: map[string]string{"bypass": "10.0.0.1"},
+	})
+
+	m := queryTestDNSServer(server, "bypass.example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip without cd bit")
+
+	r := new(dns.Msg)
+	r.SetQuestion("bypass.example.com.", dns.TypeA)
+	r.CheckingDisabled = true
+	w := newTestResponseWriter("udp")
+	server.ServeDNS(w, r)
+	require.Equal(t, "10.0.0.1", w.msg.Answer[0].(*dns.A).A.String(), "could not get bypass ip with cd bit")
+}
+
+func TestDNSServerAnswerIPs(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	queryTestDNSServer(server, "aws."+uniqueID+".example.com", dns.TypeA)
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store interaction")
+
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, []string{"169.254.169.254"}, interaction.AnswerIPs, "could not get answer ips")
+}
+
+func TestDNSServerMixedCaseCorrelationID(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	mangled := "C6rJ61AcIaEuTn2aE680Cg5uGbOyYyYyN"
+	for _, scanEverywhere := range []bool{false, true} {
+		server := newTestDNSServer(t, &Options{
+			ScanEverywhere:           scanEverywhere,
+			CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+			CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+		})
+		correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+		require.Nil(t, server.options.Storage.SetID(correlationID))
+
+		queryTestDNSServer(server, "Www."+mangled+".EXAMPLE.com", dns.TypeA)
+		queryTestDNSServer(server, strings.ToUpper(uniqueID)+".example.com", dns.TypeA)
+		item, err := server.options.Storage.GetCacheItem(correlationID)
+		require.Nil(t, err)
+		require.Len(t, item.Data, 2, "could not store mixed-case interactions (scan everywhere: %v)", scanEverywhere)
+
+		var interaction Interaction
+		require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+		require.Equal(t, uniqueID, interaction.UniqueID, "could not normalize unique id")
+		require.Contains(t, interaction.FullId, mangled, "could not keep full id casing")
+	}
+}
+
+func TestDNSServerScanRawQuery(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	for _, scanRaw := range []bool{false, true} {
+		server := newTestDNSServer(t, &Options{
+			ScanEverywhere:           true,
+			ScanRawQuery:             scanRaw,
+			CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+			CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+		})
+		require.Nil(t, server.options.Storage.SetID(correlationID))
+
+		r := new(dns.Msg)
+		r.SetQuestion("test.example.com.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		opt := r.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte(uniqueID)})
+		server.ServeDNS(newTestResponseWriter("udp"), r)
+
+		item, err := server.options.Storage.GetCacheItem(correlationID)
+		require.Nil(t, err)
+		if !scanRaw {
+			require.Empty(t, item.Data, "could not skip id of edns option without raw scan")
+			continue
+		}
+		require.Len(t, item.Data, 1, "could not store id of edns option")
+		var interaction Interaction
+		require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+		require.Equal(t, "scan-raw", interaction.MatchMethod, "could not get raw match method")
+
+		queryTestDNSServer(server, uniqueID+".example.com", dns.TypeA)
+		item, err = server.options.Storage.GetCacheItem(correlationID)
+		require.Nil(t, err)
+		require.Nil(t, json.Unmarshal([]byte(item.Data[1]), &interaction))
+		require.Equal(t, "scan-everywhere", interaction.MatchMethod, "could not dedupe id found by text scan")
+	}
+
+	// the id of the question wins over a different one carried by the edns data
+	const optionID = "c6rj61aciaeutn2ae681cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		ScanEverywhere:           true,
+		ScanRawQuery:             true,
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+	require.Nil(t, server.options.Storage.SetID(optionID[:settings.CorrelationIdLengthDefault]))
+	r := new(dns.Msg)
+	r.SetQuestion(uniqueID+".example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	opt := r.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0LOCALSTART, Data: []byte(optionID)})
+	server.ServeDNS(newTestResponseWriter("udp"), r)
+
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not keep id of the question")
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, uniqueID, interaction.UniqueID, "could not keep id found by text scan")
+	item, err = server.options.Storage.GetCacheItem(optionID[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Empty(t, item.Data, "could not let text scan win over raw scan")
+}
+
+func TestDNSServerCorrelationIdRegex(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdRegex:       `^q([a-z0-9]+)q\.`,
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	queryTestDNSServer(server, "q"+uniqueID+"q.example.com", dns.TypeA)
+	queryTestDNSServer(server, "www."+uniqueID+".example.com", dns.TypeA)
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 2, "could not store interactions")
+
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, uniqueID, interaction.UniqueID, "could not extract id of capture group")
+	require.Equal(t, "regex", interaction.MatchMethod)
+	require.Nil(t, json.Unmarshal([]byte(item.Data[1]), &interaction))
+	require.Equal(t, "label", interaction.MatchMethod, "could not fall back to label heuristic")
+}
+
+func TestSplitLabelParts(t *testing.T) {
+	require.Equal(t, []string{"a", "b", "c"}, splitSubdomainParts("a-b_c"), "could not split on default separators")
+	require.Equal(t, []string{"a-b", "c"}, splitLabelParts("a-b_c", "_"), "could not split on custom separators")
+	require.Equal(t, []string{"a-b_c"}, splitLabelParts("a-b_c", "."), "could not keep label without separators")
+}
+
+func TestDNSServerDashedCorrelationID(t *testing.T) {
+	const uniqueID = "c6rj61acia-utn2ae680cg5ugboyyyyyn"
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	for _, separators := range []string{"", "_"} {
+		server := newTestDNSServer(t, &Options{
+			CorrelationIdAlphabet:    "abcdefghijklmnopqrstuvwxyz0123456789-",
+			CorrelationIdSeparators:  separators,
+			CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+			CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+		})
+		require.Nil(t, server.options.Storage.SetID(correlationID))
+
+		queryTestDNSServer(server, "www_"+uniqueID+".example.com", dns.TypeA)
+		item, err := server.options.Storage.GetCacheItem(correlationID)
+		require.Nil(t, err)
+		if separators == "" {
+			require.NotNil(t, server.options.ValidateCorrelationID(), "could not reject alphabet containing a separator")
+			require.Empty(t, item.Data, "could not split dashed id on default separators")
+			continue
+		}
+		require.Nil(t, server.options.ValidateCorrelationID())
+		require.Len(t, item.Data, 1, "could not match dashed id")
+	}
+}
+
+func TestDNSServerMultipleQuestions(t *testing.T) {
+	const firstID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	const secondID = "c6rj61aciaeutn2ae690cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	for _, id := range []string{firstID, secondID} {
+		require.Nil(t, server.options.Storage.SetID(id[:settings.CorrelationIdLengthDefault]))
+	}
+
+	r := new(dns.Msg)
+	r.SetQuestion(firstID+".example.com.", dns.TypeA)
+	r.Question = append(r.Question,
+		dns.Question{Name: secondID + ".example.com.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET},
+		dns.Question{Name: "www." + firstID + ".example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+	)
+	server.ServeDNS(newTestResponseWriter("udp"), r)
+
+	item, err := server.options.Storage.GetCacheItem(firstID[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not dedupe id of several questions")
+	item, err = server.options.Storage.GetCacheItem(secondID[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store id of second question")
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, "TXT", interaction.QType, "could not get qtype of second question")
+
+	require.Equal(t, dns.MsgAccept, acceptMsg(dns.Header{Qdcount: 3}), "could not accept several questions")
+	require.Equal(t, dns.MsgReject, acceptMsg(dns.Header{Qdcount: maxQuestions + 1}), "could not reject too many questions")
+}
+
+func TestDNSServerOnResult(t *testing.T) {
+	const id = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	results := make(chan interface{}, 1)
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+		OnResult:                 func(out interface{}) { results <- out },
+	})
+	require.NotNil(t, server.options.ResultDispatcher, "could not create result dispatcher")
+	require.Nil(t, server.options.Storage.SetID(id[:settings.CorrelationIdLengthDefault]))
+
+	queryTestDNSServer(server, id+".example.com", dns.TypeA)
+	select {
+	case out := <-results:
+		interaction, ok := out.(*Interaction)
+		require.True(t, ok, "could not get interaction result")
+		require.Equal(t, id, interaction.UniqueID, "could not get result of correlation id")
+	case <-time.After(time.Second):
+		require.Fail(t, "could not get result of correlation id")
+	}
+
+	// queued results are handed to the callback on close
+	queryTestDNSServer(server, id+".example.com", dns.TypeA)
+	require.Nil(t, server.options.ResultDispatcher.Close(), "could not close result dispatcher")
+	require.Len(t, results, 1, "could not run queued callback on close")
+	require.False(t, server.options.ResultDispatcher.Dispatch(&Interaction{}), "could not drop result after close")
+}
+
+func TestDNSServerDedupWindow(t *testing.T) {
+	const id = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+		DnsDedupWindow:           time.Minute,
+	})
+	require.Nil(t, server.options.Storage.SetID(id[:settings.CorrelationIdLengthDefault]))
+
+	queryTestDNSServer(server, id+".example.com", dns.TypeA)
+	queryTestDNSServer(server, id+".example.com", dns.TypeA)
+	queryTestDNSServer(server, id+".example.com", dns.TypeAAAA)
+
+	item, err := server.options.Storage.GetCacheItem(id[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Len(t, item.Data, 2, "could not suppress duplicate interaction")
+	require.Equal(t, uint64(1), server.options.Stats.DnsDeduplicated, "could not count duplicate interaction")
+}
+
+func TestDNSServerRefusePublicSuffixLabels(t *testing.T) {
+	server := newTestDNSServer(t, &Options{RefusePublicSuffixLabels: true})
+
+	m := queryTestDNSServer(server, "com.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, m.Rcode, "could not refuse public suffix label")
+	require.Len(t, m.Answer, 0, "could not skip answer for public suffix label")
+
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer regular label")
+}
+
+func TestLoadPublicSuffixList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "psl.dat")
+	require.Nil(t, os.WriteFile(path, []byte("// comment\ncom\n*.ck\n!www.ck\n"), 0600))
+
+	list, err := loadPublicSuffixList(path)
+	require.Nil(t, err)
+	require.True(t, list.contains("COM"), "could not match public suffix")
+	require.False(t, list.contains("ck"), "could not skip parent of wildcard rule")
+	require.True(t, list.contains("Foo.ck"), "could not match wildcard rule")
+	require.False(t, list.contains("a.foo.ck"), "could not match wildcard rule on one label")
+	require.False(t, list.contains("www.ck"), "could not match exception rule")
+	require.False(t, list.contains("net"), "could not skip unlisted suffix")
+}
+
+func TestDNSServerTOTPLabels(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		TOTPLabels:               true,
+		TOTPPeriod:               30 * time.Second,
+		Token:                    "token",
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	expired := TOTPCode("token", time.Now().Add(-time.Hour), 30*time.Second)
+	m := queryTestDNSServer(server, "aws.otp-"+expired+"."+uniqueID+".example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip for expired code")
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 0, "could not skip expired interaction")
+
+	current := TOTPCode("token", time.Now(), 30*time.Second)
+	m = queryTestDNSServer(server, "aws.otp-"+current+"."+uniqueID+".example.com", dns.TypeA)
+	require.Equal(t, "169.254.169.254", m.Answer[0].(*dns.A).A.String(), "could not get custom ip for current code")
+	require.Len(t, item.Data, 1, "could not store current interaction")
+}
+
+func TestCustomDNSRecordsFileFormats(t *testing.T) {
+	dir := t.TempDir()
+	hostsPath := filepath.Join(dir, "records.hosts")
+	require.Nil(t, os.WriteFile(hostsPath, []byte("# comment\n10.0.0.1 internal internal.example.com\n::1 local6\ninvalid\n"), 0600))
+	csvPath := filepath.Join(dir, "records.csv")
+	require.Nil(t, os.WriteFile(csvPath, []byte("label,ip,type,ttl\ndb,10.0.0.2,A,60\ndb6,fd00::2,AAAA,60\nbad,10.0.0.3,AAAA\nweb,10.0.0.4\n"), 0600))
+
+	records := &customDNSRecords{records: map[string][]string{}, v6Records: map[string]string{}, wildcardRecords: map[string][]string{}, wildcardV6Records: map[string]string{}}
+	require.Nil(t, records.readRecordsFromFile(hostsPath))
+	require.Nil(t, records.readRecordsFromFile(csvPath))
+
+	require.Equal(t, map[string][]string{"internal": {"10.0.0.1"}, "db": {"10.0.0.2"}, "web": {"10.0.0.4"}}, records.records, "could not get ipv4 records")
+	require.Equal(t, map[string]string{"local6": "::1", "db6": "fd00::2"}, records.v6Records, "could not get ipv6 records")
+}
+
+func TestCustomDNSRecordsInvalidIPs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  good: \"10.0.0.1 \"\n  mixed: [\"10.0.0.2\", \"10.0.0.300\"]\n  bad: \"fd00::1\"\nipv6:\n  bad6: \"10.0.0.3\"\n"), 0600))
+
+	records, err := loadCustomDNSRecords(&Options{CustomRecords: path})
+	require.Nil(t, err, "could not skip invalid records")
+	require.Equal(t, []string{"10.0.0.1"}, records.records["good"], "could not trim record ip")
+	require.Equal(t, []string{"10.0.0.2"}, records.records["mixed"], "could not drop invalid ip")
+	require.NotContains(t, records.records, "bad", "could not skip ipv6 address of ipv4 record")
+	require.NotContains(t, records.v6Records, "bad6", "could not skip ipv4 address of ipv6 record")
+
+	err = ValidateCustomRecords(&Options{CustomRecords: path, StrictCustomRecords: true})
+	require.NotNil(t, err, "could not reject invalid records in strict mode")
+}
+
+func TestDNSServerWithoutIPAddress(t *testing.T) {
+	server := newTestDNSServer(t, &Options{IPAddress: "invalid"})
+	require.Nil(t, server.ipAddress, "could not reject invalid ip address")
+
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := queryTestDNSServer(server, "test.example.com", qtype)
+		require.Empty(t, msg.Answer, "could not skip answer without ip")
+		require.Len(t, msg.Ns, 1, "could not answer soa authority")
+		require.Equal(t, dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+		_, err := msg.Pack()
+		require.Nil(t, err, "could not pack response")
+	}
+}
+
+func TestDNSServerEDNSPadding(t *testing.T) {
+	server := newTestDNSServer(t, &Options{EDNSPadding: EDNSPaddingRequested})
+	tlsServer := NewDNSServer("tcp-tls", server.options)
+
+	newRequest := func(padding bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("test.example.com.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		if padding {
+			opt := r.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{})
+		}
+		return r
+	}
+
+	w := newTestResponseWriter("tcp")
+	tlsServer.ServeDNS(w, newRequest(true))
+	require.NotNil(t, w.msg.IsEdns0(), "could not get opt record")
+	require.True(t, hasEDNSPadding(w.msg.IsEdns0()), "could not pad response")
+	packed, err := w.msg.Pack()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(packed)%ednsPaddingBlockSize, "could not pad to block size")
+
+	w = newTestResponseWriter("tcp")
+	tlsServer.ServeDNS(w, newRequest(false))
+	require.False(t, hasEDNSPadding(w.msg.IsEdns0()), "could not skip unrequested padding")
+
+	w = newTestResponseWriter("udp")
+	server.ServeDNS(w, newRequest(true))
+	require.False(t, hasEDNSPadding(w.msg.IsEdns0()), "could not skip padding over plaintext transport")
+}
+
+func TestDNSServerEDNSReply(t *testing.T) {
+	server := newTestDNSServer(t, &Options{})
+
+	r := new(dns.Msg)
+	r.SetQuestion("test.example.com.", dns.TypeA)
+	r.SetEdns0(4096, true)
+	w := newTestResponseWriter("udp")
+	server.ServeDNS(w, r)
+	opt := w.msg.IsEdns0()
+	require.NotNil(t, opt, "could not echo opt record")
+	require.Equal(t, uint16(defaultEDNSUDPSize), opt.UDPSize(), "could not advertise default udp size")
+	require.True(t, opt.Do(), "could not echo do bit")
+
+	server = newTestDNSServer(t, &Options{DnsEDNSUDPSize: 4000})
+	r = new(dns.Msg)
+	r.SetQuestion("test.example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	w = newTestResponseWriter("udp")
+	server.ServeDNS(w, r)
+	require.Equal(t, uint16(4000), w.msg.IsEdns0().UDPSize(), "could not advertise configured udp size")
+	require.False(t, w.msg.IsEdns0().Do(), "could not keep do bit unset")
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Nil(t, m.IsEdns0(), "could not answer non-edns query without opt record")
+}
+
+func TestDNSServerFlakyLabels(t *testing.T) {
+	server := newTestDNSServer(t, &Options{FlakyLabels: []string{"flaky"}, FlakyWindow: time.Minute})
+
+	m := queryTestDNSServer(server, "Flaky.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeServerFailure, m.Rcode, "could not fail first query")
+	require.Len(t, m.Answer, 0, "could not skip answer on first query")
+
+	m = queryTestDNSServer(server, "flaky.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer retry")
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip on retry")
+
+	m = queryTestDNSServer(server, "stable.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer regular name")
+}
+
+func TestDNSServerMailHostSPF(t *testing.T) {
+	server := newTestDNSServer(t, &Options{MailHost: "mx1", MailSPF: "v=spf1 ip4:203.0.113.1 -all"})
+
+	m := queryTestDNSServer(server, "example.com", dns.TypeMX)
+	require.Len(t, m.Answer, 1, "could not get mx answer")
+	require.Equal(t, "mx1.example.com.", m.Answer[0].(*dns.MX).Mx, "could not get mail host")
+
+	m = queryTestDNSServer(server, "MX1.example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get spf answer")
+	require.Equal(t, []string{"v=spf1 ip4:203.0.113.1 -all"}, m.Answer[0].(*dns.TXT).Txt, "could not get spf record")
+}
+
+func TestDNSServerHoneytokenLabels(t *testing.T) {
+	received := make(chan Interaction, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var interaction Interaction
+		_ = json.NewDecoder(r.Body).Decode(&interaction)
+		received <- interaction
+	}))
+	defer webhook.Close()
+
+	server := newTestDNSServer(t, &Options{
+		Token:             "token",
+		HoneytokenLabels:  []string{"backup-db"},
+		HoneytokenWebhook: webhook.URL,
+		DnsRateLimit:      1,
+	})
+	require.Nil(t, server.options.Storage.SetID("token"))
+
+	// the source exceeds the rate limit, its honeytoken hits being answered
+	queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		m := queryTestDNSServer(server, "Backup-DB.example.com", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not bypass rate limit for honeytoken")
+	}
+	select {
+	case interaction := <-received:
+		require.True(t, interaction.Honeytoken, "could not flag honeytoken")
+		require.Equal(t, "backup-db", interaction.UniqueID, "could not get honeytoken label")
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "could not receive honeytoken webhook")
+	}
+	<-received
+
+	recorder := server.options.HoneytokenRecorder
+	require.Nil(t, recorder.Close())
+	require.Nil(t, recorder.Close(), "could not close recorder twice")
+	require.False(t, recorder.Record(&Interaction{UniqueID: "backup-db"}), "could not drop hit after close")
+
+	item, err := server.options.Storage.GetCacheItem("token")
+	require.Nil(t, err)
+	require.Len(t, item.Data, 2, "could not store every honeytoken interaction")
+}
+
+func TestDNSServerAuditEchoLabel(t *testing.T) {
+	server := newTestDNSServer(t, &Options{AuditEchoLabel: "whoami"})
+
+	m := queryTestDNSServer(server, "WhoAmI.example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get audit answer")
+	txt := m.Answer[0].(*dns.TXT).Txt
+	require.Len(t, txt, 1, "could not get audit record")
+	require.True(t, strings.HasPrefix(txt[0], "src=192.0.2.1;ts="), "could not get audit source")
+	_, err := time.Parse(time.RFC3339, strings.TrimPrefix(txt[0], "src=192.0.2.1;ts="))
+	require.Nil(t, err, "could not parse audit timestamp")
+}
+
+func TestDNSServerDirectQueryOnlyRecords(t *testing.T) {
+	query := func(server *DNSServer, recursionDesired bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("reach.example.com.", dns.TypeA)
+		r.RecursionDesired = recursionDesired
+		w := newTestResponseWriter("udp")
+		server.ServeDNS(w, r)
+		return w.msg
+	}
+
+	server := newTestDNSServer(t, &Options{
+		DirectQueryOnlyRecords: map[string]string{"reach": "10.0.0.1"},
+	})
+	require.Equal(t, "10.0.0.1", query(server, true).Answer[0].(*dns.A).A.String(), "could not get direct-only ip for direct query")
+	require.Equal(t, "203.0.113.1", query(server, false).Answer[0].(*dns.A).A.String(), "could not get default ip for recursive query")
+
+	server = newTestDNSServer(t, &Options{
+		DirectQueryOnlyRecords: map[string]string{"reach": "10.0.0.1"},
+		DirectQuerySources:     []string{"192.0.2.1"},
+	})
+	require.Equal(t, "10.0.0.1", query(server, false).Answer[0].(*dns.A).A.String(), "could not get direct-only ip for allowed source")
+}
+
+func TestDNSServerCAARecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		CAARecords: []string{`example.com=0 issue "letsencrypt.org"`, `ca=128 issuewild ";"`},
+	})
+
+	m := queryTestDNSServer(server, "example.com", dns.TypeCAA)
+	require.Len(t, m.Answer, 1, "could not get caa answer")
+	caa := m.Answer[0].(*dns.CAA)
+	require.Equal(t, uint8(0), caa.Flag, "could not get caa flag")
+	require.Equal(t, "issue", caa.Tag, "could not get caa tag")
+	require.Equal(t, "letsencrypt.org", caa.Value, "could not get caa value")
+
+	m = queryTestDNSServer(server, "ca.example.com", dns.TypeCAA)
+	require.Len(t, m.Answer, 1, "could not get caa answer for label")
+	require.Equal(t, uint8(128), m.Answer[0].(*dns.CAA).Flag, "could not get caa flag for label")
+
+	m = queryTestDNSServer(server, "none.example.com", dns.TypeCAA)
+	require.Len(t, m.Answer, 0, "could not get empty caa answer")
+	require.Len(t, m.Ns, 1, "could not get soa in authority section")
+	require.Equal(t, "example.com.", m.Ns[0].Header().Name, "could not get soa owner")
+}
+
+func TestDNSServerSRVRecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{})
+	record, err := parseSRVRecord("10 5 389 ldap.example.com")
+	require.Nil(t, err)
+	server.customRecords.Load().srvRecords["_ldap._tcp"] = record
+
+	m := queryTestDNSServer(server, "_LDAP._tcp.example.com", dns.TypeSRV)
+	require.Len(t, m.Answer, 1, "could not get srv answer")
+	srv := m.Answer[0].(*dns.SRV)
+	require.Equal(t, uint16(389), srv.Port, "could not get srv port")
+	require.Equal(t, "ldap.example.com.", srv.Target, "could not get srv target")
+
+	m = queryTestDNSServer(server, "_sip._udp.example.com", dns.TypeSRV)
+	require.Len(t, m.Answer, 1, "could not get default srv answer")
+	require.Equal(t, "example.com.", m.Answer[0].(*dns.SRV).Target, "could not get default srv target")
+
+	_, err = parseSRVRecord("10 5 ldap.example.com")
+	require.NotNil(t, err, "could not reject invalid srv record")
+}
+
+func TestDNSServerPTR(t *testing.T) {
+	server := newTestDNSServer(t, &Options{IPv6Address: "2001:db8::1"})
+
+	for _, ip := range []string{"203.0.113.1", "2001:db8::1"} {
+		reverse, err := dns.ReverseAddr(ip)
+		require.Nil(t, err)
+		m := queryTestDNSServer(server, reverse, dns.TypePTR)
+		require.Len(t, m.Answer, 1, "could not get ptr answer for %s", ip)
+		require.Equal(t, "example.com.", m.Answer[0].(*dns.PTR).Ptr, "could not get ptr target for %s", ip)
+	}
+
+	m := queryTestDNSServer(server, "1.2.0.192.in-addr.arpa", dns.TypePTR)
+	require.Equal(t, dns.RcodeNameError, m.Rcode, "could not get nxdomain for other address")
+	require.Len(t, m.Ns, 1, "could not get soa in authority section")
+}
+
+func TestDNSServerSVCBRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("svcb:\n  www:\n    priority: 2\n    target: cdn.example.com\n    params: \"alpn=h2,h3 port=8443\"\n  bad:\n    priority: 1\n    params: \"unknown\"\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	m := queryTestDNSServer(server, "www.example.com", dns.TypeHTTPS)
+	require.Len(t, m.Answer, 1, "could not get https answer")
+	https := m.Answer[0].(*dns.HTTPS)
+	require.Equal(t, uint16(2), https.Priority, "could not get https priority")
+	require.Equal(t, "cdn.example.com.", https.Target, "could not get https target")
+	require.Len(t, https.Value, 2, "could not get https params")
+
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeSVCB)
+	require.Len(t, m.Answer, 1, "could not get default svcb answer")
+	require.Contains(t, m.Answer[0].String(), `ipv4hint="203.0.113.1"`, "could not get server ip hint")
+	_, ok := server.customRecords.Load().checkCustomSVCBResponse("bad.example.com.")
+	require.False(t, ok, "could not skip invalid svcb record")
+}
+
+func TestDNSServerNAPTRRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("naptr:\n  sip:\n    - order: 100\n      preference: 10\n      flags: U\n      service: E2U+sip\n      regexp: \"!^.*$!sip:info@example.com!\"\n      replacement: \".\"\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	m := queryTestDNSServer(server, "sip.example.com", dns.TypeNAPTR)
+	require.Len(t, m.Answer, 1, "could not get naptr answer")
+	naptr := m.Answer[0].(*dns.NAPTR)
+	require.Equal(t, uint16(100), naptr.Order, "could not get naptr order")
+	require.Equal(t, "E2U+sip", naptr.Service, "could not get naptr service")
+	require.Equal(t, "!^.*$!sip:info@example.com!", naptr.Regexp, "could not get naptr regexp")
+
+	m = queryTestDNSServer(server, "other.example.com", dns.TypeNAPTR)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not get noerror response")
+	require.Empty(t, m.Answer, "could not get empty answer")
+	require.Len(t, m.Ns, 1, "could not get soa authority")
+}
+
+func TestDNSServerTXTRecords(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("txt:\n  verify:\n    - site-verification=abc\n    - "+long+"\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+	server.TxtRecord = "default"
+
+	m := queryTestDNSServer(server, "verify.example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 2, "could not get txt answers")
+	require.Equal(t, []string{"site-verification=abc"}, m.Answer[0].(*dns.TXT).Txt, "could not get txt value")
+	require.Equal(t, []string{long[:255], long[255:]}, m.Answer[1].(*dns.TXT).Txt, "could not split long txt value")
+
+	m = queryTestDNSServer(server, "other.example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get default txt answer")
+	require.Equal(t, []string{"default"}, m.Answer[0].(*dns.TXT).Txt, "could not get default txt value")
+}
+
+func TestDNSServerTXTRecordsByLabel(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("txt:\n  campaign1:\n    - tag=campaign1\n"), 0600))
+	server := newTestDNSServer(t, &Options{
+		CustomRecords:            path,
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	server.TxtRecord = "default"
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	m := queryTestDNSServer(server, "campaign1-"+uniqueID+".example.com", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get txt answer")
+	require.Equal(t, []string{"tag=campaign1"}, m.Answer[0].(*dns.TXT).Txt, "could not get label txt value")
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store interaction of custom txt query")
+
+	m = queryTestDNSServer(server, uniqueID+".example.com", dns.TypeTXT)
+	require.Equal(t, []string{"default"}, m.Answer[0].(*dns.TXT).Txt, "could not fall back to default txt value")
+}
+
+func TestDNSServerCIDRRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("cidr:\n  pool: 10.0.0.0/24\n  bad: 2001:db8::/64\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	for i := 0; i < 10; i++ {
+		m := queryTestDNSServer(server, "pool.example.com", dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not get cidr answer")
+		require.True(t, network.Contains(m.Answer[0].(*dns.A).A), "could not get address within range")
+	}
+
+	m := queryTestDNSServer(server, "pool-1f.example.com", dns.TypeA)
+	require.Equal(t, "10.0.0.31", m.Answer[0].(*dns.A).A.String(), "could not get indexed address")
+	m = queryTestDNSServer(server, "pool-101.example.com", dns.TypeA)
+	require.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String(), "could not wrap indexed address")
+	_, ok := server.customRecords.Load().checkCIDRResponse("bad")
+	require.False(t, ok, "could not skip invalid cidr record")
+}
+
+func TestDNSServerReflectLabel(t *testing.T) {
+	server := newTestDNSServer(t, &Options{})
+
+	m := queryTestDNSServer(server, "whatismyip.test.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not get reflected answer")
+	require.Equal(t, "192.0.2.1", m.Answer[0].(*dns.A).A.String(), "could not reflect client address")
+
+	m = queryTestDNSServer(server, "other.test.example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default address")
+}
+
+func TestDNSServerSinkhole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  custom: 198.51.100.1\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path, IPv6Address: "2001:db8::1", SinkholeIP: "192.0.2.53", SinkholeIPv6: "2001:db8::53"})
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, "192.0.2.53", m.Answer[0].(*dns.A).A.String(), "could not answer sinkhole ip")
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeAAAA)
+	require.Equal(t, "2001:db8::53", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not answer sinkhole ipv6")
+	m = queryTestDNSServer(server, "custom.example.com", dns.TypeA)
+	require.Equal(t, "198.51.100.1", m.Answer[0].(*dns.A).A.String(), "could not answer custom record")
+	for _, name := range []string{"example.com", "ns1.example.com"} {
+		m = queryTestDNSServer(server, name, dns.TypeA)
+		require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not answer server ip for %s", name)
+	}
+}
+
+func TestDNSServerNegativeAnswerSOA(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsDeniedQTypes: []string{"SRV"}, DnsTTL: 3600, SOAMinTTL: 60})
+
+	for _, qtype := range []uint16{dns.TypeHINFO, dns.TypeLOC, dns.TypeSRV} {
+		m := queryTestDNSServer(server, "test.example.com", qtype)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode)
+		require.Empty(t, m.Answer)
+		require.Len(t, m.Ns, 1, "could not get authority for empty %s answer", dns.TypeToString[qtype])
+		soa, ok := m.Ns[0].(*dns.SOA)
+		require.True(t, ok, "could not get soa authority for empty %s answer", dns.TypeToString[qtype])
+		require.Equal(t, "example.com.", soa.Hdr.Name, "could not get soa of the zone")
+		require.Equal(t, uint32(3600), soa.Hdr.Ttl, "could not set soa ttl")
+		require.Equal(t, uint32(60), soa.Minttl, "could not set soa minimum ttl")
+	}
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeCAA)
+	require.Len(t, m.Ns, 1, "could not keep a single soa authority")
+
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	for _, rr := range m.Ns {
+		require.NotEqual(t, dns.TypeSOA, rr.Header().Rrtype, "could not skip soa on answered query")
+	}
+}
+
+func TestDNSServerIgnoreLists(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	const ignoredID = "c6rj61aciaeutn2ae681cg5ugboyyyyyn"
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	server := newTestDNSServer(t, &Options{
+		DnsIgnoreNames:           []string{"*.Probe.example.com"},
+		DnsIgnoreIDs:             []string{ignoredID[:settings.CorrelationIdLengthDefault]},
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+	require.Nil(t, server.options.Storage.SetID(ignoredID[:settings.CorrelationIdLengthDefault]))
+
+	m := queryTestDNSServer(server, uniqueID+".PROBE.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not answer ignored name")
+	queryTestDNSServer(server, uniqueID+".example.com", dns.TypeA)
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not skip ignored name")
+
+	queryTestDNSServer(server, strings.ToUpper(ignoredID)+".example.com", dns.TypeA)
+	item, err = server.options.Storage.GetCacheItem(ignoredID[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Empty(t, item.Data, "could not skip ignored id")
+}
+
+func TestDNSServerCustomCNAMEAAAA(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv6:\n  app: 2001:db8::5\ncname:\n  alias: app.example.com\n  ext: target.example.org\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path, IPv6Address: "2001:db8::1"})
+
+	m := queryTestDNSServer(server, "alias.example.com", dns.TypeAAAA)
+	require.Len(t, m.Answer, 2, "could not follow cname for aaaa query")
+	require.Equal(t, "app.example.com.", m.Answer[0].(*dns.CNAME).Target, "could not get cname")
+	require.Equal(t, "app.example.com.", m.Answer[1].Header().Name, "could not resolve cname target")
+	require.Equal(t, "2001:db8::5", m.Answer[1].(*dns.AAAA).AAAA.String(), "could not get aaaa of cname target")
+
+	m = queryTestDNSServer(server, "ext.example.com", dns.TypeAAAA)
+	require.Len(t, m.Answer, 1, "could not skip resolving external target")
+	require.Equal(t, "target.example.org.", m.Answer[0].(*dns.CNAME).Target, "could not get external cname")
+
+	m = queryTestDNSServer(server, "other.example.com", dns.TypeAAAA)
+	require.Equal(t, "2001:db8::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not get default ipv6")
+}
+
+func TestDNSServerShutdown(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		server := newTestDNSServer(t, &Options{ListenIP: "127.0.0.1"})
+		server.server.Net = network
+		started := make(chan struct{})
+		server.server.NotifyStartedFunc = func() { close(started) }
+		done := make(chan error, 1)
+		go func() { done <- server.listenAndServe() }()
+		<-started
+
+		var addr string
+		if network == "udp" {
+			addr = server.server.PacketConn.LocalAddr().String()
+		} else {
+			addr = server.server.Listener.Addr().String()
+		}
+		r := new(dns.Msg)
+		r.SetQuestion("test.example.com.", dns.TypeA)
+		m, _, err := (&dns.Client{Net: network}).Exchange(r, addr)
+		require.Nil(t, err, "could not query %s server", network)
+		require.Len(t, m.Answer, 1)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		require.Nil(t, server.Shutdown(ctx), "could not shut down %s server", network)
+		cancel()
+		require.Nil(t, <-done, "could not return cleanly from %s listener", network)
+		require.NotNil(t, server.Close(), "could not report already stopped server")
+	}
+}
+
+func TestDNSServerACMELookupTimeout(t *testing.T) {
+	store := acme.NewProvider()
+	_, err := store.AppendRecords(context.Background(), "_acme-challenge.example.com.", []libdns.Record{{Type: "TXT", Value: "token", TTL: time.Minute}})
+	require.Nil(t, err)
+	server := newTestDNSServer(t, &Options{ACMEStore: store, ACMELookupTimeout: 50 * time.Millisecond})
+
+	m := queryTestDNSServer(server, "_acme-challenge.example.com", dns.TypeTXT)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode)
+	require.Len(t, m.Answer, 1, "could not get challenge record")
+
+	// a degraded store holds its lock
+	store.Lock()
+	defer store.Unlock()
+	m = queryTestDNSServer(server, "_acme-challenge.example.com", dns.TypeTXT)
+	require.NotNil(t, m, "could not answer on lookup timeout")
+	require.Equal(t, dns.RcodeServerFailure, m.Rcode, "could not answer servfail on lookup timeout")
+}
+
+func TestDNSServerACMEChallengeCasing(t *testing.T) {
+	store := acme.NewProvider()
+	_, err := store.AppendRecords(context.Background(), "_acme-challenge.Example.com.", []libdns.Record{{Type: "TXT", Value: "token"}})
+	require.Nil(t, err)
+	server := newTestDNSServer(t, &Options{ACMEStore: store})
+
+	for _, name := range []string{"_acme-challenge.example.com", "_ACME-challenge.EXAMPLE.com"} {
+		m := queryTestDNSServer(server, name, dns.TypeTXT)
+		require.NotNil(t, m, "could not answer %s", name)
+		require.Len(t, m.Answer, 1, "could not get challenge record of %s", name)
+		require.Equal(t, "_acme-challenge.example.com.", m.Answer[0].Header().Name, "could not normalize the name of %s", name)
+		require.Equal(t, []string{"token"}, m.Answer[0].(*dns.TXT).Txt)
+		require.Equal(t, dns.Fqdn(name), m.Question[0].Name, "could not echo the question of %s", name)
+	}
+}
+
+func TestDNSServerDisableDefaultRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  custom: 198.51.100.1\n"), 0600))
+
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+	m := queryTestDNSServer(server, "aws.example.com", dns.TypeA)
+	require.Equal(t, "169.254.169.254", m.Answer[0].(*dns.A).A.String(), "could not answer default record")
+	m = queryTestDNSServer(server, "localhost.example.com", dns.TypeAAAA)
+	require.Equal(t, "::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not answer default ipv6 record")
+
+	server = newTestDNSServer(t, &Options{CustomRecords: path, DisableDefaultRecords: true})
+	m = queryTestDNSServer(server, "aws.example.com", dns.TypeA)
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not disable default record")
+	m = queryTestDNSServer(server, "localhost.example.com", dns.TypeAAAA)
+	require.Empty(t, m.Answer, "could not disable default ipv6 record")
+	m = queryTestDNSServer(server, "custom.example.com", dns.TypeA)
+	require.Equal(t, "198.51.100.1", m.Answer[0].(*dns.A).A.String(), "could not answer configured record")
+}
+
+func TestDNSServerTTLByType(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsTTL: 3600, DnsTTLByType: map[string]int{"A": 30, "mx": 300, "BOGUS": 1}})
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not get a answer")
+	require.Equal(t, uint32(30), m.Answer[0].Header().Ttl, "could not get a ttl")
+
+	m = queryTestDNSServer(server, "example.com", dns.TypeMX)
+	require.NotEmpty(t, m.Answer, "could not get mx answer")
+	require.Equal(t, uint32(300), m.Answer[0].Header().Ttl, "could not get mx ttl")
+
+	m = queryTestDNSServer(server, "example.com", dns.TypeNS)
+	require.NotEmpty(t, m.Answer, "could not get ns answer")
+	require.Equal(t, uint32(3600), m.Answer[0].Header().Ttl, "could not fall back to dns ttl")
+}
+
+func TestDNSServerMultipleARecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  lb: 10.0.0.1, 10.0.0.2\n  pool:\n    - 10.0.1.1\n    - 10.0.1.2\n    - 10.0.1.3\n  single: 10.0.2.1\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	answerIPs := func(m *dns.Msg) []string {
+		var ips []string
+		for _, rr := range m.Answer {
+			ips = append(ips, rr.(*dns.A).A.String())
+		}
+		return ips
+	}
+	require.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, answerIPs(queryTestDNSServer(server, "lb.example.com", dns.TypeA)), "could not get comma-separated records")
+	require.Equal(t, []string{"10.0.2.1"}, answerIPs(queryTestDNSServer(server, "single.example.com", dns.TypeA)), "could not get single record")
+
+	orders := make(map[string]struct{})
+	for i := 0; i < 50; i++ {
+		ips := answerIPs(queryTestDNSServer(server, "pool.example.com", dns.TypeA))
+		require.ElementsMatch(t, []string{"10.0.1.1", "10.0.1.2", "10.0.1.3"}, ips, "could not get sequence records")
+		orders[strings.Join(ips, ",")] = struct{}{}
+	}
+	require.Greater(t, len(orders), 1, "could not rotate record order")
+}
+
+func TestDNSServerWeightedRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  db: \"10.0.0.1|80,10.0.0.2|20\"\n  canary: \"10.0.1.1|0,10.0.1.2\"\n  db*: \"10.0.2.1|1,10.0.2.2|0\"\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		m := queryTestDNSServer(server, "db.example.com", dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not pick a single weighted record")
+		counts[m.Answer[0].(*dns.A).A.String()]++
+	}
+	require.InDelta(t, 800, counts["10.0.0.1"], 100, "could not respect record weights")
+	require.Equal(t, 1000, counts["10.0.0.1"]+counts["10.0.0.2"], "could not pick configured records")
+
+	for i := 0; i < 20; i++ {
+		m := queryTestDNSServer(server, "canary.example.com", dns.TypeA)
+		require.Equal(t, "10.0.1.2", m.Answer[0].(*dns.A).A.String(), "could not default weight to 1")
+		m = queryTestDNSServer(server, "db-replica.example.com", dns.TypeA)
+		require.Equal(t, "10.0.2.1", m.Answer[0].(*dns.A).A.String(), "could not weight wildcard records")
+	}
+}
+
+func TestDNSServerCustomCNAME(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  app: 10.0.0.5\ncname:\n  alias: app.example.com\n  chain: alias.example.com\n  ext: target.example.org\n  loop: loop.example.com\n"), 0600))
+	server := newTestDNSServer(t, &Options{
+		CustomRecords:            path,
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	m := queryTestDNSServer(server, "chain."+uniqueID+".example.com", dns.TypeA)
+	require.Len(t, m.Answer, 3, "could not follow cname chain")
+	require.Equal(t, "alias.example.com.", m.Answer[0].(*dns.CNAME).Target, "could not get cname")
+	require.Equal(t, "app.example.com.", m.Answer[1].(*dns.CNAME).Target, "could not get chained cname")
+	require.Equal(t, "app.example.com.", m.Answer[2].Header().Name, "could not resolve cname target")
+	require.Equal(t, "10.0.0.5", m.Answer[2].(*dns.A).A.String(), "could not resolve cname target")
+
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store interaction")
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, "chain."+uniqueID, interaction.FullId, "could not log queried name")
+
+	m = queryTestDNSServer(server, "ext.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not skip resolving external target")
+	require.Equal(t, "target.example.org.", m.Answer[0].(*dns.CNAME).Target, "could not get external cname")
+
+	m = queryTestDNSServer(server, "loop.example.com", dns.TypeA)
+	require.Len(t, m.Answer, maxCNAMEChain, "could not bound cname chain")
+}
+
+func TestDNSServerNSMXRecords(t *testing.T) {
+	server := newTestDNSServer(t, &Options{
+		NSRecords: map[string][]string{"Example.com": {"a.ns.example.com", "b.ns.example.com", "ns.example.net"}},
+		MXRecords: map[string][]MXRecord{"example.com": {{Host: "mx1.example.com", Pref: 10}, {Host: "mx2.example.com", Pref: 20}}},
+	})
+
+	m := queryTestDNSServer(server, "example.com", dns.TypeNS)
+	require.Len(t, m.Answer, 3, "could not get configured name servers")
+	require.Equal(t, "ns.example.net.", m.Answer[2].(*dns.NS).Ns, "could not get external name server")
+
+	m = queryTestDNSServer(server, "example.com", dns.TypeMX)
+	require.Len(t, m.Answer, 2, "could not get configured mail exchangers")
+	require.Equal(t, "mx2.example.com.", m.Answer[1].(*dns.MX).Mx, "could not get mail exchanger")
+	require.Equal(t, uint16(20), m.Answer[1].(*dns.MX).Preference, "could not get mail exchanger preference")
+
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Len(t, m.Ns, 3, "could not get name servers authority")
+	require.Len(t, m.Extra, 2, "could not skip glue of external name server")
+
+	m = queryTestDNSServer(newTestDNSServer(t, &Options{}), "example.com", dns.TypeNS)
+	require.Equal(t, "ns1.example.com.", m.Answer[0].(*dns.NS).Ns, "could not fall back to ns1")
+}
+
+func TestDNSServerTTLJitter(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsTTL: 100, DnsTTLJitter: "20%"})
+
+	ttls := make(map[uint32]struct{})
+	for i := 0; i < 50; i++ {
+		m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+		ttl := m.Answer[0].Header().Ttl
+		require.GreaterOrEqual(t, ttl, uint32(80), "could not bound ttl jitter")
+		require.LessOrEqual(t, ttl, uint32(120), "could not bound ttl jitter")
+		ttls[ttl] = struct{}{}
+	}
+	require.Greater(t, len(ttls), 1, "could not jitter ttl")
+
+	server = newTestDNSServer(t, &Options{DnsTTL: 100})
+	for i := 0; i < 5; i++ {
+		m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+		require.Equal(t, uint32(100), m.Answer[0].Header().Ttl, "could not keep deterministic ttl")
+	}
+
+	_, err := parseTTLJitter("150%")
+	require.NotNil(t, err, "could not reject invalid jitter")
+	jitter, err := parseTTLJitter("30")
+	require.Nil(t, err, "could not parse absolute jitter")
+	require.Equal(t, ttlJitter{value: 30}, jitter, "could not parse absolute jitter")
+}
+
+func TestDNSServerSOATimers(t *testing.T) {
+	server := newTestDNSServer(t, &Options{SOASerial: 2024010101, SOARefresh: 7200, SOARetry: 900, SOAExpire: 1209600, SOAMinTTL: 300})
+
+	m := queryTestDNSServer(server, "example.com", dns.TypeSOA)
+	require.NotEmpty(t, m.Answer, "could not get soa answer")
+	soa := m.Answer[0].(*dns.SOA)
+	require.Equal(t, uint32(2024010101), soa.Serial, "could not get soa serial")
+	require.Equal(t, uint32(7200), soa.Refresh, "could not get soa refresh")
+	require.Equal(t, uint32(900), soa.Retry, "could not get soa retry")
+	require.Equal(t, uint32(1209600), soa.Expire, "could not get soa expire")
+	require.Equal(t, uint32(300), soa.Minttl, "could not get soa minttl")
+
+	server = newTestDNSServer(t, &Options{})
+	m = queryTestDNSServer(server, "example.com", dns.TypeSOA)
+	require.NotEmpty(t, m.Answer, "could not get soa answer")
+	soa = m.Answer[0].(*dns.SOA)
+	require.Greater(t, soa.Serial, uint32(1), "could not get startup timestamp serial")
+	require.Equal(t, uint32(60), soa.Expire, "could not get default soa expire")
+	require.Equal(t, uint32(60), soa.Minttl, "could not get default soa minttl")
+}
+
+func TestDNSServerReloadCustomRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  app: 10.0.0.1\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path, SOASerial: 1})
+
+	m := queryTestDNSServer(server, "app.example.com", dns.TypeA)
+	require.Equal(t, "10.0.0.1", m.Answer[0].(*dns.A).A.String(), "could not get custom record")
+	serial := queryTestDNSServer(server, "example.com", dns.TypeSOA).Answer[0].(*dns.SOA).Serial
+	require.Equal(t, uint32(1), serial, "could not get configured serial")
+
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  app: 10.0.0.2\n"), 0600))
+	require.Nil(t, server.ReloadCustomRecords(), "could not reload custom records")
+	m = queryTestDNSServer(server, "app.example.com", dns.TypeA)
+	require.Equal(t, "10.0.0.2", m.Answer[0].(*dns.A).A.String(), "could not get reloaded record")
+	reloaded := queryTestDNSServer(server, "example.com", dns.TypeSOA).Answer[0].(*dns.SOA).Serial
+	require.Greater(t, reloaded, serial, "could not increment serial")
+
+	require.Nil(t, server.ReloadCustomRecords(), "could not reload custom records")
+	require.Equal(t, reloaded+1, server.soaSerial.Load(), "could not keep serial monotonic within the same second")
+
+	require.Nil(t, os.WriteFile(path, []byte("ipv4: [\n"), 0600))
+	require.NotNil(t, server.ReloadCustomRecords(), "could not fail on invalid records")
+	m = queryTestDNSServer(server, "app.example.com", dns.TypeA)
+	require.Equal(t, "10.0.0.2", m.Answer[0].(*dns.A).A.String(), "could not keep previous records")
+}
+
+func TestDNSServerReloadCustomRecordsConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  app: 10.0.0.1\nipv6:\n  app: fd00::1\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				require.Len(t, queryTestDNSServer(server, "app.example.com", dns.TypeA).Answer, 1, "could not get custom record")
+				require.Len(t, queryTestDNSServer(server, "app.example.com", dns.TypeAAAA).Answer, 1, "could not get custom ipv6 record")
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		require.Nil(t, server.ReloadCustomRecords(), "could not reload custom records")
+	}
+	wg.Wait()
+}
+
+func TestDNSServerWildcardRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  \"*\": 10.0.0.1\n  db-*: 10.0.0.2\n  db-primary-*: 10.0.0.3\n  db-exact: 10.0.0.4\nipv6:\n  \"*\": fd00::1\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	tests := map[string]string{
+		"anything.example.com":     "10.0.0.1",
+		"db-1.example.com":         "10.0.0.2",
+		"db-primary-1.example.com": "10.0.0.3",
+		"db-exact.example.com":     "10.0.0.4",
+		"aws.example.com":          "169.254.169.254",
+	}
+	for name, expected := range tests {
+		m := queryTestDNSServer(server, name, dns.TypeA)
+		require.Len(t, m.Answer, 1, "could not get answer for %s", name)
+		require.Equal(t, expected, m.Answer[0].(*dns.A).A.String(), "could not get record for %s", name)
+	}
+
+	m := queryTestDNSServer(server, "anything.example.com", dns.TypeAAAA)
+	require.Len(t, m.Answer, 1, "could not get ipv6 answer")
+	require.Equal(t, "fd00::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not get wildcard ipv6 record")
+	m = queryTestDNSServer(server, "localhost.example.com", dns.TypeAAAA)
+	require.Equal(t, "::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not prefer exact ipv6 record")
+}
+
+func TestDNSServerHexIPv6Subdomain(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsSubdomainRecords: []string{"internal=fd00::1"}})
+
+	m := queryTestDNSServer(server, "20010db8000000000000000000000001-x.example.com", dns.TypeAAAA)
+	require.Len(t, m.Answer, 1, "could not get answer")
+	require.Equal(t, "2001:db8::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not decode hex ipv6")
+
+	m = queryTestDNSServer(server, "internal-x.example.com", dns.TypeAAAA)
+	require.Len(t, m.Answer, 1, "could not get answer")
+	require.Equal(t, "fd00::1", m.Answer[0].(*dns.AAAA).AAAA.String(), "could not get named subdomain record")
+}
+
+func TestDoHServer(t *testing.T) {
+	options := &Options{}
+	newTestDNSServer(t, options)
+	server := NewDoHServer(options)
+
+	query := new(dns.Msg)
+	query.SetQuestion("test.example.com.", dns.TypeA)
+	packed, err := query.Pack()
+	require.Nil(t, err, "could not pack query")
+
+	unpack := func(rec *httptest.ResponseRecorder) *dns.Msg {
+		require.Equal(t, http.StatusOK, rec.Code, "could not get doh response")
+		require.Equal(t, dohContentType, rec.Header().Get("Content-Type"), "could not get doh content type")
+		m := new(dns.Msg)
+		require.Nil(t, m.Unpack(rec.Body.Bytes()), "could not unpack doh response")
+		return m
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(packed), nil)
+	req.RemoteAddr = "198.51.100.7:4242"
+	rec := httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(rec, req)
+	m := unpack(rec)
+	require.Len(t, m.Answer, 1, "could not get answer")
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get server ip")
+	require.Equal(t, "198.51.100.7", server.dnsServer.getMsgHost(newDoHConn(req), query), "could not get http remote address")
+
+	req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+	req.Header.Set("Content-Type", dohContentType)
+	rec = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(rec, req)
+	require.Len(t, unpack(rec).Answer, 1, "could not get post answer")
+
+	req = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(packed))
+	rec = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnsupportedMediaType, rec.Code, "could not reject content type")
+
+	req = httptest.NewRequest(http.MethodGet, "/dns-query?dns=%%%", nil)
+	rec = httptest.NewRecorder()
+	server.server.Handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusBadRequest, rec.Code, "could not reject invalid parameter")
+}
+
+func TestDNSServerClientSubnet(t *testing.T) {
+	server := newTestDNSServer(t, &Options{OriginIPEDNSopt: -1, RealIPFrom: []string{"invalid/cidr", "192.0.2.0/24"}})
+
+	r := new(dns.Msg)
+	r.SetQuestion("test.example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4()})
+
+	require.Equal(t, "198.51.100.0/24", server.getClientSubnet(newTestResponseWriter("udp"), r), "could not get client subnet")
+	require.Equal(t, "192.0.2.1", server.getMsgHost(newTestResponseWriter("udp"), r), "could not keep remote address")
+
+	untrusted := newTestDNSServer(t, &Options{RealIPFrom: []string{"10.0.0.1"}})
+	require.Equal(t, "", untrusted.getClientSubnet(newTestResponseWriter("udp"), r), "could not ignore untrusted client subnet")
+}
+
+func TestDNSServerOriginIP(t *testing.T) {
+	server := newTestDNSServer(t, &Options{OriginIPEDNSopt: 65001, RealIPFrom: []string{"192.0.2.0/24"}})
+	query := func(data []byte) string {
+		r := new(dns.Msg)
+		r.SetQuestion("test.example.com.", dns.TypeA)
+		r.SetEdns0(4096, false)
+		r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001, Data: data})
+		return server.getMsgHost(newTestResponseWriter("udp"), r)
+	}
+
+	require.Equal(t, "198.51.100.7", query(net.ParseIP("198.51.100.7").To4()), "could not get 4-byte origin")
+	require.Equal(t, "2001:db8::7", query(net.ParseIP("2001:db8::7")), "could not get 16-byte origin")
+	require.Equal(t, "198.51.100.7", query(net.ParseIP("::ffff:198.51.100.7")), "could not normalize v4-mapped origin")
+	require.Equal(t, "192.0.2.1", query([]byte{198, 51, 100}), "could not ignore invalid origin length")
+
+	server.options.OriginIPEDNSoptPort = true
+	r := new(dns.Msg)
+	r.SetQuestion("test.example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: 65001, Data: append(net.ParseIP("2001:db8::7").To16(), 0x9c, 0x40)})
+	remote, origin, port := server.getMsgOrigin(newTestResponseWriter("udp"), r)
+	require.Equal(t, "192.0.2.1", remote, "could not keep resolver address")
+	require.Equal(t, "2001:db8::7", origin, "could not get origin followed by port")
+	require.Equal(t, 40000, port, "could not get origin port")
+
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server.options.CorrelationIdLength = settings.CorrelationIdLengthDefault
+	server.options.CorrelationIdNonceLength = settings.CorrelationIdNonceLengthDefault
+	require.Nil(t, server.options.Storage.SetID(uniqueID[:settings.CorrelationIdLengthDefault]))
+	r.SetQuestion(uniqueID+".example.com.", dns.TypeA)
+	server.ServeDNS(newTestResponseWriter("udp"), r)
+	item, err := server.options.Storage.GetCacheItem(uniqueID[:settings.CorrelationIdLengthDefault])
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1)
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, "192.0.2.1", interaction.RemoteAddress, "could not store resolver address")
+	require.Equal(t, "2001:db8::7", interaction.OriginAddress, "could not store origin address")
+	require.Equal(t, 40000, interaction.OriginPort, "could not store origin port")
+}
+
+func TestDNSServerEDNSMetadata(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	r := new(dns.Msg)
+	r.SetQuestion(uniqueID+".example.com.", dns.TypeA)
+	r.SetEdns0(1232, false)
+	r.IsEdns0().Option = append(r.IsEdns0().Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: "7265736f6c766572"})
+	server.ServeDNS(newTestResponseWriter("udp"), r)
+
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 1, "could not store interaction")
+	var interaction Interaction
+	require.Nil(t, json.Unmarshal([]byte(item.Data[0]), &interaction))
+	require.Equal(t, "7265736f6c766572", interaction.EDNSNSID, "could not get nsid")
+	require.Equal(t, uint16(1232), interaction.EDNSUDPSize, "could not get udp size")
+}
+
+func TestDNSServerTruncation(t *testing.T) {
+	var ips []string
+	for i := 1; i <= 64; i++ {
+		ips = append(ips, fmt.Sprintf("10.0.0.%d", i))
+	}
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	require.Nil(t, os.WriteFile(path, []byte("ipv4:\n  big: "+strings.Join(ips, ",")+"\n"), 0600))
+	server := newTestDNSServer(t, &Options{CustomRecords: path})
+
+	m := queryTestDNSServer(server, "big.example.com", dns.TypeA)
+	require.True(t, m.Truncated, "could not set tc bit")
+	require.LessOrEqual(t, m.Len(), dns.MinMsgSize, "could not trim answer")
+
+	r := new(dns.Msg)
+	r.SetQuestion("big.example.com.", dns.TypeA)
+	r.SetEdns0(4096, false)
+	w := newTestResponseWriter("udp")
+	server.ServeDNS(w, r)
+	require.False(t, w.msg.Truncated, "could not use edns buffer size")
+	require.Len(t, w.msg.Answer, 64, "could not get full answer")
+
+	tcpServer := NewDNSServer("tcp", server.options)
+	w = newTestResponseWriter("tcp")
+	r = new(dns.Msg)
+	r.SetQuestion("big.example.com.", dns.TypeA)
+	tcpServer.ServeDNS(w, r)
+	require.False(t, w.msg.Truncated, "could not answer over tcp")
+	require.Len(t, w.msg.Answer, 64, "could not get full tcp answer")
+}
+
+func TestDNSServerResponseDelay(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsResponseDelay: 20 * time.Millisecond, DnsMaxResponseDelay: time.Second})
+
+	require.Equal(t, 20*time.Millisecond, server.getResponseDelay("test.example.com."), "could not get default delay")
+	require.Equal(t, 500*time.Millisecond, server.getResponseDelay("delay500ms.c6rj61aciaeutn2ae680cg5ugboyyyyyn.example.com."), "could not get label delay")
+	require.Equal(t, 2*time.Millisecond, server.getResponseDelay("x-delay2ms.example.com."), "could not get label part delay")
+	require.Equal(t, time.Second, server.getResponseDelay("delay1h.example.com."), "could not cap delay")
+	require.Equal(t, 20*time.Millisecond, server.getResponseDelay("delayed.example.com."), "could not ignore invalid delay")
+
+	start := time.Now()
+	queryTestDNSServer(server, "delay50ms.example.com", dns.TypeA)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond, "could not delay answer")
+}
+
+func TestDNSServerEchoTXT(t *testing.T) {
+	server := newTestDNSServer(t, &Options{EchoTXT: true})
+	server.TxtRecord = "static"
+
+	m := queryTestDNSServer(server, "TeSt.ExAmPlE.cOm", dns.TypeTXT)
+	require.Len(t, m.Answer, 1, "could not get txt answer")
+	require.Equal(t, []string{"TeSt.ExAmPlE.cOm."}, m.Answer[0].(*dns.TXT).Txt, "could not echo queried name")
+
+	server = newTestDNSServer(t, &Options{})
+	server.TxtRecord = "static"
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeTXT)
+	require.Equal(t, []string{"static"}, m.Answer[0].(*dns.TXT).Txt, "could not get static txt record")
+}
+
+func TestDNSServerStrictDomain(t *testing.T) {
+	server := newTestDNSServer(t, &Options{StrictDomain: StrictDomainNXDomain})
+
+	m := queryTestDNSServer(server, "other.org", dns.TypeA)
+	require.Equal(t, dns.RcodeNameError, m.Rcode, "could not get nxdomain")
+	require.Empty(t, m.Answer, "could not skip answer")
+
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer configured domain")
+	require.Equal(t, "203.0.113.1", m.Answer[0].(*dns.A).A.String(), "could not get default ip")
+
+	m = queryTestDNSServer(server, "1.113.0.203.in-addr.arpa", dns.TypePTR)
+	require.Len(t, m.Answer, 1, "could not answer reverse lookup")
+
+	server = newTestDNSServer(t, &Options{StrictDomain: StrictDomainRefused})
+	m = queryTestDNSServer(server, "notexample.com", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, m.Rcode, "could not get refused")
+}
+
+func TestDNSServerLatencyHistogram(t *testing.T) {
+	server := newTestDNSServer(t, &Options{EnableMetrics: true})
+	queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	queryTestDNSServer(server, "test.example.com", dns.TypeTXT)
+
+	snapshot := server.options.Stats.DnsLatency.Snapshot()
+	require.Equal(t, uint64(2), snapshot["udp"]["A"].Count, "could not count a queries")
+	require.Equal(t, uint64(2), snapshot["udp"]["A"].Buckets["+Inf"], "could not get cumulative buckets")
+	require.Equal(t, uint64(1), snapshot["udp"]["TXT"].Count, "could not count txt queries")
+
+	data, err := jsoniter.Marshal(server.options.Stats)
+	require.Nil(t, err, "could not encode metrics")
+	require.Contains(t, string(data), `"dns_latency":{"udp":{`, "could not encode latency histogram")
+}
+
+func TestDNSServerRateLimit(t *testing.T) {
+	server := newTestDNSServer(t, &Options{DnsRateLimit: 1, DnsRateBurst: 1})
+
+	m := queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer first query")
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Equal(t, dns.RcodeRefused, m.Rcode, "could not refuse limited query")
+	require.Empty(t, m.Answer, "could not skip answer")
+	require.Equal(t, uint64(1), server.options.Stats.DnsRateLimited, "could not count limited query")
+
+	server = newTestDNSServer(t, &Options{DnsRateLimit: 1, DnsRateBurst: 1, DnsRateLimitExemptTrusted: true, RealIPFrom: []string{"192.0.2.1"}})
+	for i := 0; i < 3; i++ {
+		m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not exempt trusted source")
+	}
+}
+
+func TestDNSServerQTypeFilter(t *testing.T) {
+	const uniqueID = "c6rj61aciaeutn2ae680cg5ugboyyyyyn"
+	server := newTestDNSServer(t, &Options{
+		DnsDeniedQTypes:          []string{"soa", "NS"},
+		CorrelationIdLength:      settings.CorrelationIdLengthDefault,
+		CorrelationIdNonceLength: settings.CorrelationIdNonceLengthDefault,
+	})
+	correlationID := uniqueID[:settings.CorrelationIdLengthDefault]
+	require.Nil(t, server.options.Storage.SetID(correlationID))
+
+	m := queryTestDNSServer(server, uniqueID+".example.com", dns.TypeSOA)
+	require.True(t, m.Authoritative, "could not answer denied type authoritatively")
+	require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer denied type")
+	require.Empty(t, m.Answer, "could not skip denied type answer")
+	item, err := server.options.Storage.GetCacheItem(correlationID)
+	require.Nil(t, err)
+	require.Len(t, item.Data, 0, "could not skip denied type interaction")
+
+	m = queryTestDNSServer(server, uniqueID+".example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not answer allowed type")
+	require.Len(t, item.Data, 1, "could not store allowed type interaction")
+
+	server = newTestDNSServer(t, &Options{DnsAllowedQTypes: []string{"A", "TXT"}})
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeMX)
+	require.Empty(t, m.Answer, "could not skip type outside the allowlist")
+	m = queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	require.Len(t, m.Answer, 1, "could not answer allowlisted type")
+}
+
+func TestDNSServerDNSSEC(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name string, flags uint16) *dns.DNSKEY {
+		key := &dns.DNSKEY{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600}, Flags: flags, Protocol: 3, Algorithm: dns.ECDSAP256SHA256}
+		privateKey, err := key.Generate(256)
+		require.Nil(t, err, "could not generate key")
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name+".key"), []byte(key.String()+"\n"), 0600))
+		require.Nil(t, os.WriteFile(filepath.Join(dir, name+".private"), []byte(key.PrivateKeyString(privateKey)), 0600))
+		return key
+	}
+	zsk := writeKey("zsk", 256)
+	ksk := writeKey("ksk", 257)
+	server := newTestDNSServer(t, &Options{DNSSECKeyPath: filepath.Join(dir, "zsk.key"), DNSSECKSKPath: filepath.Join(dir, "ksk.key")})
+
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion(dns.Fqdn(name), qtype)
+		r.SetEdns0(4096, do)
+		w := newTestResponseWriter("tcp")
+		server.ServeDNS(w, r)
+		return w.msg
+	}
+	splitSigs := func(rrs []dns.RR) ([]dns.RR, []*dns.RRSIG) {
+		var records []dns.RR
+		var sigs []*dns.RRSIG
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); ok {
+				sigs = append(sigs, sig)
+			} else {
+				records = append(records, rr)
+			}
+		}
+		return records, sigs
+	}
+
+	m := query("test.example.com", dns.TypeA, true)
+	records, sigs := splitSigs(m.Answer)
+	require.Len(t, sigs, 1, "could not sign answer")
+	require.Nil(t, sigs[0].Verify(zsk, records), "could not verify answer signature")
+	require.True(t, sigs[0].ValidityPeriod(time.Now()), "could not get valid signature")
+	ns, nsSigs := splitSigs(m.Ns)
+	require.Len(t, nsSigs, 1, "could not sign authority")
+	require.Nil(t, nsSigs[0].Verify(zsk, ns), "could not verify authority signature")
+	require.True(t, m.IsEdns0().Do(), "could not set do bit")
+
+	m = query("example.com", dns.TypeDNSKEY, true)
+	records, sigs = splitSigs(m.Answer)
+	require.Len(t, records, 2, "could not get dnskeys")
+	require.Len(t, sigs, 1, "could not sign dnskeys")
+	require.Equal(t, ksk.KeyTag(), sigs[0].KeyTag, "could not sign dnskeys with ksk")
+	require.Nil(t, sigs[0].Verify(ksk, records), "could not verify dnskey signature")
+
+	m = query("example.com", dns.TypeDS, false)
+	require.Len(t, m.Answer, 1, "could not get ds")
+	require.Equal(t, ksk.ToDS(dns.SHA256).Digest, m.Answer[0].(*dns.DS).Digest, "could not get ksk digest")
+
+	m = query("test.example.com", dns.TypeA, false)
+	_, sigs = splitSigs(m.Answer)
+	require.Empty(t, sigs, "could not skip signing without do bit")
+
+	unsigned := newTestDNSServer(t, &Options{})
+	for _, qtype := range []uint16{dns.TypeDNSKEY, dns.TypeDS} {
+		m = queryTestDNSServer(unsigned, "example.com", qtype)
+		require.Equal(t, dns.RcodeSuccess, m.Rcode, "could not answer without dnssec")
+		require.Empty(t, m.Answer, "could not answer empty without dnssec")
+	}
+}
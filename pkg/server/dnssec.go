@@ -0,0 +1,166 @@
+package server
+
+import (
+	"crypto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+)
+
+const (
+	// dnssecInceptionSkew backdates the signatures for resolvers with skewed clocks
+	dnssecInceptionSkew = time.Hour
+	// dnssecValidity is the validity of the signatures made for each response
+	dnssecValidity = 24 * time.Hour
+)
+
+// dnssecKey is a DNSKEY along with its private key
+type dnssecKey struct {
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+// dnssecSigner signs the responses of the zone of its keys online, the
+// KSK (or the ZSK if unset) signing the DNSKEY RRset and the ZSK the others.
+type dnssecSigner struct {
+	zone string
+	zsk  dnssecKey
+	ksk  *dnssecKey
+}
+
+// newDNSSECSigner returns a signer for the ZSK and the optional KSK given
+// as the paths to their BIND .key files, the .private files sitting next to them.
+func newDNSSECSigner(zskPath, kskPath string) (*dnssecSigner, error) {
+	zsk, err := readDNSSECKey(zskPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read zsk")
+	}
+	signer := &dnssecSigner{zone: strings.ToLower(zsk.dnskey.Hdr.Name), zsk: zsk}
+	if kskPath != "" {
+		ksk, err := readDNSSECKey(kskPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read ksk")
+		}
+		if !strings.EqualFold(ksk.dnskey.Hdr.Name, signer.zone) {
+			return nil, errors.Errorf("ksk zone %s does not match zsk zone %s", ksk.dnskey.Hdr.Name, signer.zone)
+		}
+		signer.ksk = &ksk
+	}
+	return signer, nil
+}
+
+// readDNSSECKey reads the public key of path and its .private file
+func readDNSSECKey(path string) (dnssecKey, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return dnssecKey{}, errors.Wrap(err, "could not open key file")
+	}
+	defer file.Close()
+
+	rr, err := dns.ReadRR(file, path)
+	if err != nil {
+		return dnssecKey{}, errors.Wrap(err, "could not parse key file")
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return dnssecKey{}, errors.New("key file is not a dnskey record")
+	}
+	switch dnskey.Algorithm {
+	case dns.ECDSAP256SHA256, dns.ECDSAP384SHA384, dns.ED25519:
+	default:
+		return dnssecKey{}, errors.Errorf("unsupported algorithm %s", dns.AlgorithmToString[dnskey.Algorithm])
+	}
+
+	privatePath := strings.TrimSuffix(path, ".key") + ".private"
+	privateFile, err := os.Open(privatePath)
+	if err != nil {
+		return dnssecKey{}, errors.Wrap(err, "could not open private key file")
+	}
+	defer privateFile.Close()
+
+	privateKey, err := dnskey.ReadPrivateKey(privateFile, privatePath)
+	if err != nil {
+		return dnssecKey{}, errors.Wrap(err, "could not parse private key file")
+	}
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return dnssecKey{}, errors.New("private key can not sign")
+	}
+	return dnssecKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// dnskeys returns the DNSKEY records of the zone with the given ttl
+func (s *dnssecSigner) dnskeys(ttl uint32) []dns.RR {
+	keys := []*dns.DNSKEY{s.zsk.dnskey}
+	if s.ksk != nil {
+		keys = append(keys, s.ksk.dnskey)
+	}
+	rrs := make([]dns.RR, 0, len(keys))
+	for _, key := range keys {
+		dnskey := dns.Copy(key).(*dns.DNSKEY)
+		dnskey.Hdr.Ttl = ttl
+		rrs = append(rrs, dnskey)
+	}
+	return rrs
+}
+
+// ds returns the SHA-256 DS record of the KSK (or the ZSK if unset) with the given ttl
+func (s *dnssecSigner) ds(ttl uint32) *dns.DS {
+	key := s.zsk
+	if s.ksk != nil {
+		key = *s.ksk
+	}
+	ds := key.dnskey.ToDS(dns.SHA256)
+	if ds == nil {
+		return nil
+	}
+	ds.Hdr.Ttl = ttl
+	return ds
+}
+
+// signSection returns the records of section followed by the signatures
+// of their RRsets under the zone. DS records belong to the parent zone
+// and are left unsigned.
+func (s *dnssecSigner) signSection(section []dns.RR, now time.Time) ([]dns.RR, error) {
+	type rrsetKey struct {
+		name   string
+		rrtype uint16
+	}
+	var keys []rrsetKey
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, rr := range section {
+		hdr := rr.Header()
+		if hdr.Rrtype == dns.TypeRRSIG || hdr.Rrtype == dns.TypeOPT || hdr.Rrtype == dns.TypeDS || !dns.IsSubDomain(s.zone, hdr.Name) {
+			continue
+		}
+		key := rrsetKey{name: strings.ToLower(hdr.Name), rrtype: hdr.Rrtype}
+		if _, ok := rrsets[key]; !ok {
+			keys = append(keys, key)
+		}
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	for _, key := range keys {
+		signingKey := s.zsk
+		if key.rrtype == dns.TypeDNSKEY && s.ksk != nil {
+			signingKey = *s.ksk
+		}
+		rrset := rrsets[key]
+		sig := &dns.RRSIG{
+			Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+			Algorithm:  signingKey.dnskey.Algorithm,
+			KeyTag:     signingKey.dnskey.KeyTag(),
+			SignerName: signingKey.dnskey.Hdr.Name,
+			Inception:  uint32(now.Add(-dnssecInceptionSkew).Unix()),
+			Expiration: uint32(now.Add(dnssecValidity).Unix()),
+		}
+		if err := sig.Sign(signingKey.signer, rrset); err != nil {
+			return section, errors.Wrapf(err, "could not sign %s %s", key.name, dns.TypeToString[key.rrtype])
+		}
+		section = append(section, sig)
+	}
+	return section, nil
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+const (
+	// dohContentType is the media type of the DoH messages (RFC 8484)
+	dohContentType = "application/dns-message"
+	// dohMaxMessageSize is the maximum size of a DNS message
+	dohMaxMessageSize = dns.MaxMsgSize
+)
+
+// DoHServer is a DNS-over-HTTPS (RFC 8484) server answering the
+// queries like the DNS servers.
+type DoHServer struct {
+	options   *Options
+	dnsServer *DNSServer
+	server    http.Server
+}
+
+// NewDoHServer returns a new DNS-over-HTTPS server.
+func NewDoHServer(options *Options) *DoHServer {
+	server := &DoHServer{options: options, dnsServer: NewDNSServer("https", options)}
+
+	router := &http.ServeMux{}
+	router.HandleFunc("/dns-query", server.queryHandler)
+	server.server = http.Server{Addr: options.ListenIP + fmt.Sprintf(":%d", options.DoHPort), Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)}
+	return server
+}
+
+// DNSServer returns the DNS server answering the DoH queries
+func (h *DoHServer) DNSServer() *DNSServer {
+	return h.dnsServer
+}
+
+// ListenAndServe listens on the doh port for the server.
+func (h *DoHServer) ListenAndServe(tlsConfig *tls.Config, dohAlive chan bool) {
+	h.server.TLSConfig = tlsConfig
+
+	dohAlive <- true
+	if err := h.server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		gologger.Error().Msgf("Could not serve dns over https: %s\n", err)
+		dohAlive <- false
+	}
+}
+
+// Shutdown stops the listener and waits for the in-flight queries to be
+// answered or for ctx to be done.
+func (h *DoHServer) Shutdown(ctx context.Context) error {
+	return h.server.Shutdown(ctx)
+}
+
+// queryHandler handles the GET (?dns=) and POST DoH queries
+func (h *DoHServer) queryHandler(w http.ResponseWriter, req *http.Request) {
+	var data []byte
+	switch req.Method {
+	case http.MethodGet:
+		var err error
+		data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(req.URL.Query().Get("dns"), "="))
+		if err != nil || len(data) == 0 {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if req.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		data, err = io.ReadAll(io.LimitReader(req.Body, dohMaxMessageSize+1))
+		if err != nil {
+			http.Error(w, "could not read body", http.StatusBadRequest)
+			return
+		}
+		if len(data) > dohMaxMessageSize {
+			http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r := new(dns.Msg)
+	if err := r.Unpack(data); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+	conn := newDoHConn(req)
+	m := h.dnsServer.handleQuery(conn, r)
+	h.dnsServer.logQuery(conn, r, m)
+	if m == nil {
+		http.Error(w, "could not answer query", http.StatusBadRequest)
+		return
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		gologger.Warning().Msgf("Could not pack DoH response: \n%s\n %s\n", m.String(), err)
+		http.Error(w, "could not pack response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", dohContentType)
+	_, _ = w.Write(packed)
+}
+
+// dohConn holds the addresses of the HTTP connection of a DoH query
+type dohConn struct {
+	local  net.Addr
+	remote net.Addr
+}
+
+func newDoHConn(req *http.Request) dohConn {
+	conn := dohConn{local: &net.TCPAddr{}, remote: &net.TCPAddr{}}
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = addr
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		conn.remote = addr
+	}
+	return conn
+}
+
+func (c dohConn) LocalAddr() net.Addr  { return c.local }
+func (c dohConn) RemoteAddr() net.Addr { return c.remote }
@@ -136,9 +136,13 @@ func (h *FTPServer) recordInteraction(remoteAddress, data string) {
 		gologger.Warning().Msgf("Could not encode ftp interaction: %s\n", err)
 	} else {
 		gologger.Debug().Msgf("FTP Interaction: \n%s\n", buffer.String())
-		if err := h.options.Storage.AddInteractionWithId(h.options.Token, buffer.Bytes()); err != nil {
+		err := h.options.addInteractionWithId(h.options.Token, buffer.Bytes())
+		if err != nil && err != errStorageShed {
 			gologger.Warning().Msgf("Could not store ftp interaction: %s\n", err)
 		}
+		if err != errStorageShed {
+			h.options.publishInteraction("", interaction, buffer.Bytes())
+		}
 	}
 }
 
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+const (
+	// honeytokenTimeout bounds the source PTR lookup and the webhook delivery
+	honeytokenTimeout = 5 * time.Second
+	// honeytokenQueueSize is the number of honeytoken hits queued before dropping
+	honeytokenQueueSize = 256
+	// honeytokenCloseTimeout bounds the recording of the queued hits on close
+	honeytokenCloseTimeout = 10 * time.Second
+)
+
+// HoneytokenRecorder records the honeytoken hits from a single goroutine.
+// It is shared by the DNS listeners.
+type HoneytokenRecorder struct {
+	options *Options
+	queue   chan *Interaction
+	done    chan struct{}
+	// mu guards the queue against the hits recorded after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewHoneytokenRecorder returns a recorder storing and posting the hits with options
+func NewHoneytokenRecorder(options *Options) *HoneytokenRecorder {
+	recorder := &HoneytokenRecorder{
+		options: options,
+		queue:   make(chan *Interaction, honeytokenQueueSize),
+		done:    make(chan struct{}),
+	}
+	go recorder.run()
+	return recorder
+}
+
+// Record queues a honeytoken hit and returns false if it was dropped
+func (r *HoneytokenRecorder) Record(interaction *Interaction) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		return false
+	}
+	select {
+	case r.queue <- interaction:
+		return true
+	default:
+		gologger.Warning().Msgf("Honeytoken queue full, dropping %s hit from %s\n", interaction.UniqueID, interaction.RemoteAddress)
+		return false
+	}
+}
+
+// Close stops queuing hits and waits for the queued ones to be recorded,
+// giving up after honeytokenCloseTimeout.
+func (r *HoneytokenRecorder) Close() error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	select {
+	case <-r.done:
+		return nil
+	case <-time.After(honeytokenCloseTimeout):
+		return errors.New("timed out recording the queued honeytoken hits")
+	}
+}
+
+func (r *HoneytokenRecorder) run() {
+	defer close(r.done)
+
+	for interaction := range r.queue {
+		r.options.recordHoneytoken(interaction)
+	}
+}
+
+// matchHoneytoken returns the honeytoken label contained in domain if any
+func (h *DNSServer) matchHoneytoken(domain string) string {
+	if len(h.honeytokens) == 0 {
+		return ""
+	}
+	for _, label := range strings.Split(strings.ToLower(domain), ".") {
+		if _, ok := h.honeytokens[label]; ok {
+			return label
+		}
+	}
+	return ""
+}
+
+// recordHoneytoken enriches a honeytoken interaction with the source PTR names,
+// stores it in the token bucket bypassing the storage write limit and posts it
+// to the honeytoken webhook. ASN data is added by the clients as for every interaction.
+func (options *Options) recordHoneytoken(interaction *Interaction) {
+	interaction.Honeytoken = true
+	gologger.Info().Msgf("Honeytoken %s triggered from %s\n", interaction.UniqueID, interaction.RemoteAddress)
+
+	ctx, cancel := context.WithTimeout(context.Background(), honeytokenTimeout)
+	defer cancel()
+	if names, err := net.DefaultResolver.LookupAddr(ctx, interaction.RemoteAddress); err == nil {
+		interaction.RemotePTR = names
+	}
+
+	data, err := jsoniter.Marshal(interaction)
+	if err != nil {
+		gologger.Warning().Msgf("Could not encode honeytoken interaction: %s\n", err)
+		return
+	}
+	gologger.Debug().Msgf("Honeytoken Interaction: \n%s\n", string(data))
+	if err := options.addPriorityInteractionWithId(options.Token, data); err != nil {
+		gologger.Warning().Msgf("Could not store honeytoken interaction: %s\n", err)
+	}
+	options.publishInteraction("", interaction, data)
+
+	if options.HoneytokenWebhook == "" {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, options.HoneytokenWebhook, bytes.NewReader(data))
+	if err != nil {
+		gologger.Warning().Msgf("Could not create honeytoken webhook request: %s\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		gologger.Warning().Msgf("Could not send honeytoken webhook: %s\n", err)
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		gologger.Warning().Msgf("Honeytoken webhook returned status %d\n", resp.StatusCode)
+	}
+}
@@ -86,6 +86,12 @@ func NewHTTPServer(options *Options) (*HTTPServer, error) {
 	if server.options.EnableMetrics {
 		router.Handle("/metrics", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.metricsHandler))))
 	}
+	if len(server.options.SequenceRecords) > 0 {
+		router.Handle("/admin/sequence", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.sequenceHandler))))
+	}
+	if server.options.Auth {
+		router.Handle("/admin/config", server.corsMiddleware(server.authMiddleware(http.HandlerFunc(server.configHandler))))
+	}
 	server.tlsserver = http.Server{Addr: options.ListenIP + fmt.Sprintf(":%d", options.HttpsPort), Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)}
 	server.nontlsserver = http.Server{Addr: options.ListenIP + fmt.Sprintf(":%d", options.HttpPort), Handler: router, ErrorLog: log.New(&noopLogger{}, "", 0)}
 	return server, nil
@@ -161,9 +167,13 @@ func (h *HTTPServer) logger(handler http.Handler) http.HandlerFunc {
 						gologger.Warning().Msgf("Could not encode root tld http interaction: %s\n", err)
 					} else {
 						gologger.Debug().Msgf("Root TLD HTTP Interaction: \n%s\n", buffer.String())
-						if err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes()); err != nil {
+						err := h.options.addInteractionWithId(ID, buffer.Bytes())
+						if err != nil && err != errStorageShed {
 							gologger.Warning().Msgf("Could not store root tld http interaction: %s\n", err)
 						}
+						if err != errStorageShed {
+							h.options.publishInteraction(ID, interaction, buffer.Bytes())
+						}
 					}
 				}
 			}
@@ -223,9 +233,13 @@ func (h *HTTPServer) handleInteraction(uniqueID, fullID, reqString, respString,
 	} else {
 		gologger.Debug().Msgf("HTTP Interaction: \n%s\n", buffer.String())
 
-		if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+		err := h.options.addInteraction(correlationID, buffer.Bytes())
+		if err != nil && err != errStorageShed {
 			gologger.Warning().Msgf("Could not store http interaction: %s\n", err)
 		}
+		if err != errStorageShed {
+			h.options.publishInteraction(correlationID, interaction, buffer.Bytes())
+		}
 	}
 }
 
@@ -385,7 +399,7 @@ func (h *HTTPServer) registerHandler(w http.ResponseWriter, req *http.Request) {
 
 	atomic.AddInt64(&h.options.Stats.Sessions, 1)
 
-	if err := h.options.Storage.SetIDPublicKey(r.CorrelationID, r.SecretKey, r.PublicKey); err != nil {
+	if err := h.options.setIDPublicKey(r.CorrelationID, r.SecretKey, r.PublicKey); err != nil {
 		gologger.Warning().Msgf("Could not set id and public key for %s: %s\n", r.CorrelationID, err)
 		jsonError(w, fmt.Sprintf("could not set id and public key: %s", err), http.StatusBadRequest)
 		return
@@ -413,7 +427,7 @@ func (h *HTTPServer) deregisterHandler(w http.ResponseWriter, req *http.Request)
 		return
 	}
 
-	if err := h.options.Storage.RemoveID(r.CorrelationID, r.SecretKey); err != nil {
+	if err := h.options.removeID(r.CorrelationID, r.SecretKey); err != nil {
 		gologger.Warning().Msgf("Could not remove id for %s: %s\n", r.CorrelationID, err)
 		jsonError(w, fmt.Sprintf("could not remove id: %s", err), http.StatusBadRequest)
 		return
@@ -523,6 +537,7 @@ func (h *HTTPServer) checkToken(req *http.Request) bool {
 func (h *HTTPServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	interactMetrics := h.options.Stats
 	interactMetrics.Cache = GetCacheMetrics(h.options)
+	interactMetrics.TrackedNames = GetTrackedNamesMetrics(h.options)
 	interactMetrics.Cpu = GetCpuMetrics()
 	interactMetrics.Memory = GetMemoryMetrics()
 	interactMetrics.Network = GetNetworkMetrics()
@@ -532,6 +547,30 @@ func (h *HTTPServer) metricsHandler(w http.ResponseWriter, req *http.Request) {
 	_ = jsoniter.NewEncoder(w).Encode(interactMetrics)
 }
 
+// sequenceHandler is a handler for /admin/sequence endpoint
+func (h *HTTPServer) sequenceHandler(w http.ResponseWriter, req *http.Request) {
+	counters := map[string]uint64{}
+	if h.options.Counters != nil {
+		counters = h.options.Counters.Values(sequenceCounterPrefix)
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_ = jsoniter.NewEncoder(w).Encode(counters)
+}
+
+// configHandler is a handler for /admin/config endpoint
+func (h *HTTPServer) configHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_ = jsoniter.NewEncoder(w).Encode(h.options.Redacted())
+}
+
 func newProxyHandler(option *Options) func(w http.ResponseWriter, r *http.Request) {
 	var proxy func(*http.Request) (*url.URL, error) = nil
 	var tlsClientConfig *tls.Config = nil
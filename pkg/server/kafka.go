@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+const (
+	// kafkaBufferSize is the number of interactions buffered before dropping
+	kafkaBufferSize = 4096
+	// kafkaBatchSize is the max number of interactions produced at once
+	kafkaBatchSize = 100
+	// kafkaTimeout bounds the production of each batch
+	kafkaTimeout = 10 * time.Second
+)
+
+// kafkaWriter produces batches of messages
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// KafkaSink produces the encoded interactions to a topic keyed by their
+// correlation ID. Interactions are produced in batches from a single
+// goroutine so that a slow cluster never blocks the protocol handlers,
+// interactions being dropped when the buffer is full.
+type KafkaSink struct {
+	writer   kafkaWriter
+	messages chan kafka.Message
+	wg       sync.WaitGroup
+	// mu guards the messages against the interactions produced after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewKafkaSink returns a sink producing to topic on brokers, authenticating
+// with the SASL mechanism (plain, scram-sha-256 or scram-sha-512) if username is set.
+func NewKafkaSink(brokers []string, topic, username, password, mechanism string) (*KafkaSink, error) {
+	if len(brokers) == 0 || topic == "" {
+		return nil, errors.New("kafka brokers and topic are required")
+	}
+	transport := &kafka.Transport{}
+	if username != "" {
+		saslMechanism, err := newKafkaSASLMechanism(mechanism, username, password)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = saslMechanism
+	}
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchSize:    kafkaBatchSize,
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafka.RequireOne,
+		Transport:    transport,
+	}
+	return newKafkaSink(writer), nil
+}
+
+func newKafkaSink(writer kafkaWriter) *KafkaSink {
+	sink := &KafkaSink{
+		writer:   writer,
+		messages: make(chan kafka.Message, kafkaBufferSize),
+	}
+	sink.wg.Add(1)
+	go sink.run()
+	return sink
+}
+
+func newKafkaSASLMechanism(mechanism, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(mechanism) {
+	case "", "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, errors.Errorf("unsupported kafka sasl mechanism %s", mechanism)
+	}
+}
+
+// Produce queues the encoded interaction and returns false if it was dropped
+func (k *KafkaSink) Produce(correlationID string, data []byte) bool {
+	message := kafka.Message{Value: data}
+	if correlationID != "" {
+		message.Key = []byte(correlationID)
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.closed {
+		return false
+	}
+	select {
+	case k.messages <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close flushes the queued interactions and closes the writer
+func (k *KafkaSink) Close() error {
+	k.mu.Lock()
+	if k.closed {
+		k.mu.Unlock()
+		return nil
+	}
+	k.closed = true
+	close(k.messages)
+	k.mu.Unlock()
+	k.wg.Wait()
+	return k.writer.Close()
+}
+
+func (k *KafkaSink) run() {
+	defer k.wg.Done()
+
+	batch := make([]kafka.Message, 0, kafkaBatchSize)
+	for message := range k.messages {
+		batch = append(batch[:0], message)
+	fill:
+		for len(batch) < kafkaBatchSize {
+			select {
+			case message, ok := <-k.messages:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, message)
+			default:
+				break fill
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), kafkaTimeout)
+		if err := k.writer.WriteMessages(ctx, batch...); err != nil {
+			gologger.Warning().Msgf("Could not produce %d interactions to kafka: %s\n", len(batch), err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/require"
+)
+
+// testKafkaWriter records the produced messages
+type testKafkaWriter struct {
+	sync.Mutex
+	messages []kafka.Message
+}
+
+func (w *testKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.Lock()
+	defer w.Unlock()
+	w.messages = append(w.messages, msgs...)
+	return nil
+}
+
+func (w *testKafkaWriter) Close() error { return nil }
+
+func TestKafkaSink(t *testing.T) {
+	writer := &testKafkaWriter{}
+	sink := newKafkaSink(writer)
+	require.True(t, sink.Produce("c6rj61aciaeutn2ae680", []byte(`{"protocol":"dns"}`)))
+	require.True(t, sink.Produce("", []byte(`{"protocol":"smb"}`)))
+	require.Nil(t, sink.Close(), "could not flush sink")
+
+	require.Len(t, writer.messages, 2, "could not flush queued interactions")
+	require.Equal(t, "c6rj61aciaeutn2ae680", string(writer.messages[0].Key), "could not key by correlation id")
+	require.Nil(t, writer.messages[1].Key, "could not leave token interactions unkeyed")
+	require.False(t, sink.Produce("", []byte(`{"protocol":"http"}`)), "could not drop interaction after close")
+	require.Nil(t, sink.Close(), "could not close sink twice")
+
+	_, err := NewKafkaSink([]string{"127.0.0.1:9092"}, "interactions", "user", "pass", "gssapi")
+	require.NotNil(t, err, "could not reject unsupported mechanism")
+}
@@ -150,9 +150,13 @@ func (ldapServer *LDAPServer) handleInteraction(uniqueID, fullID, reqString, hos
 			gologger.Warning().Msgf("Could not encode ldap interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("LDAP Interaction: \n%s\n", buffer.String())
-			if err := ldapServer.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+			err := ldapServer.options.addInteraction(correlationID, buffer.Bytes())
+			if err != nil && err != errStorageShed {
 				gologger.Warning().Msgf("Could not store ldap interaction: %s\n", err)
 			}
+			if err != errStorageShed {
+				ldapServer.options.publishInteraction(correlationID, interaction, buffer.Bytes())
+			}
 		}
 
 	}
@@ -416,9 +420,13 @@ func (ldapServer *LDAPServer) logInteraction(interaction Interaction) {
 		gologger.Warning().Msgf("Could not encode ldap interaction: %s\n", err)
 	} else {
 		gologger.Debug().Msgf("LDAP Interaction: \n%s\n", buffer.String())
-		if err := ldapServer.options.Storage.AddInteractionWithId(ldapServer.options.Token, buffer.Bytes()); err != nil {
+		err := ldapServer.options.addInteractionWithId(ldapServer.options.Token, buffer.Bytes())
+		if err != nil && err != errStorageShed {
 			gologger.Warning().Msgf("Could not store ldap interaction: %s\n", err)
 		}
+		if err != errStorageShed {
+			ldapServer.options.publishInteraction("", &interaction, buffer.Bytes())
+		}
 	}
 }
 
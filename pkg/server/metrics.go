@@ -2,24 +2,196 @@ package server
 
 import (
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	units "github.com/docker/go-units"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/mackerelio/go-osstat/network"
 	"github.com/projectdiscovery/interactsh/pkg/storage"
 )
 
 type Metrics struct {
-	Dns      uint64                `json:"dns"`
-	Ftp      uint64                `json:"ftp"`
-	Http     uint64                `json:"http"`
-	Ldap     uint64                `json:"ldap"`
-	Smb      uint64                `json:"smb"`
-	Smtp     uint64                `json:"smtp"`
-	Sessions int64                 `json:"sessions"`
-	Cache    *storage.CacheMetrics `json:"cache"`
-	Memory   *MemoryMetrics        `json:"memory"`
-	Cpu      *CpuStats             `json:"cpu"`
-	Network  *NetworkStats         `json:"network"`
+	Dns              uint64                  `json:"dns"`
+	Ftp              uint64                  `json:"ftp"`
+	Http             uint64                  `json:"http"`
+	Ldap             uint64                  `json:"ldap"`
+	Smb              uint64                  `json:"smb"`
+	Smtp             uint64                  `json:"smtp"`
+	Sessions         int64                   `json:"sessions"`
+	StorageShed      uint64                  `json:"storage_shed"`
+	DnsRateLimited   uint64                  `json:"dns_rate_limited"`
+	DnsLogDropped    uint64                  `json:"dns_log_dropped"`
+	DnsDeduplicated  uint64                  `json:"dns_deduplicated"`
+	ResultsDropped   uint64                  `json:"results_dropped"`
+	WebhookDropped   uint64                  `json:"webhook_dropped"`
+	SyslogDropped    uint64                  `json:"syslog_dropped"`
+	KafkaDropped     uint64                  `json:"kafka_dropped"`
+	StorageWrites    StorageWrites           `json:"storage_writes"`
+	CustomRecords    CustomRecordsMetrics    `json:"custom_records"`
+	SecondaryStorage SecondaryStorageMetrics `json:"secondary_storage"`
+	TrackedNames     *TrackedNamesMetrics    `json:"tracked_names"`
+	DnsLatency       LatencyHistograms       `json:"dns_latency"`
+	Cache            *storage.CacheMetrics   `json:"cache"`
+	Memory           *MemoryMetrics          `json:"memory"`
+	Cpu              *CpuStats               `json:"cpu"`
+	Network          *NetworkStats           `json:"network"`
+}
+
+// CustomRecordsMetrics contains the number of loaded custom DNS records by type
+type CustomRecordsMetrics struct {
+	IPv4          uint64 `json:"ipv4"`
+	IPv6          uint64 `json:"ipv6"`
+	SubdomainIPv4 uint64 `json:"subdomain_ipv4"`
+	SubdomainIPv6 uint64 `json:"subdomain_ipv6"`
+}
+
+// SecondaryStorageMetrics contains the mirrored writes to the secondary storage
+type SecondaryStorageMetrics struct {
+	Writes            uint64 `json:"writes"`
+	Errors            uint64 `json:"errors"`
+	LastLatencyMicros int64  `json:"last_latency_us"`
+}
+
+// TrackedNamesMetrics contains the number of names tracked by the stateful DNS records
+type TrackedNamesMetrics struct {
+	Count     uint64 `json:"count"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// latencyBuckets are the upper bounds of the latency histogram buckets
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// LatencyHistograms are latency histograms labeled by protocol and query type
+type LatencyHistograms struct {
+	histograms sync.Map // protocol/qtype -> *latencyHistogram
+}
+
+// latencyHistogram counts the observations per bucket, the last one being +Inf
+type latencyHistogram struct {
+	protocol  string
+	qtype     string
+	buckets   []uint64
+	count     uint64
+	sumMicros uint64
+}
+
+// LatencyHistogramMetrics is a histogram with cumulative buckets keyed by their upper bound in seconds
+type LatencyHistogramMetrics struct {
+	Buckets    map[string]uint64 `json:"buckets"`
+	Count      uint64            `json:"count"`
+	SumSeconds float64           `json:"sum_seconds"`
+}
+
+// Observe records the latency of a request of protocol and query type
+func (l *LatencyHistograms) Observe(protocol, qtype string, latency time.Duration) {
+	value, ok := l.histograms.Load(protocol + "/" + qtype)
+	if !ok {
+		value, _ = l.histograms.LoadOrStore(protocol+"/"+qtype, &latencyHistogram{protocol: protocol, qtype: qtype, buckets: make([]uint64, len(latencyBuckets)+1)})
+	}
+	histogram := value.(*latencyHistogram)
+	bucket := len(latencyBuckets)
+	for i, bound := range latencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+	atomic.AddUint64(&histogram.buckets[bucket], 1)
+	atomic.AddUint64(&histogram.count, 1)
+	atomic.AddUint64(&histogram.sumMicros, uint64(latency.Microseconds()))
+}
+
+// Snapshot returns the histograms by protocol and query type
+func (l *LatencyHistograms) Snapshot() map[string]map[string]LatencyHistogramMetrics {
+	snapshot := make(map[string]map[string]LatencyHistogramMetrics)
+	l.histograms.Range(func(_, value any) bool {
+		histogram := value.(*latencyHistogram)
+		metrics := LatencyHistogramMetrics{
+			Buckets:    make(map[string]uint64, len(histogram.buckets)),
+			Count:      atomic.LoadUint64(&histogram.count),
+			SumSeconds: float64(atomic.LoadUint64(&histogram.sumMicros)) / 1e6,
+		}
+		var cumulative uint64
+		for i := range histogram.buckets {
+			cumulative += atomic.LoadUint64(&histogram.buckets[i])
+			bound := "+Inf"
+			if i < len(latencyBuckets) {
+				bound = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'f', -1, 64)
+			}
+			metrics.Buckets[bound] = cumulative
+		}
+		if snapshot[histogram.protocol] == nil {
+			snapshot[histogram.protocol] = make(map[string]LatencyHistogramMetrics)
+		}
+		snapshot[histogram.protocol][histogram.qtype] = metrics
+		return true
+	})
+	return snapshot
+}
+
+// MarshalJSON encodes the snapshot of the histograms
+func (l *LatencyHistograms) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(l.Snapshot())
+}
+
+// StorageWrites counts the interaction writes to the primary storage by protocol
+type StorageWrites struct {
+	counters sync.Map // protocol -> *StorageWriteMetrics
+}
+
+// StorageWriteMetrics contains the successful and failed writes of a protocol
+type StorageWriteMetrics struct {
+	Writes uint64 `json:"writes"`
+	Errors uint64 `json:"errors"`
+}
+
+// Record counts a write of an interaction of protocol, failed if err is set
+func (s *StorageWrites) Record(protocol string, err error) {
+	value, ok := s.counters.Load(protocol)
+	if !ok {
+		value, _ = s.counters.LoadOrStore(protocol, &StorageWriteMetrics{})
+	}
+	counter := value.(*StorageWriteMetrics)
+	if err != nil {
+		atomic.AddUint64(&counter.Errors, 1)
+		return
+	}
+	atomic.AddUint64(&counter.Writes, 1)
+}
+
+// Snapshot returns the writes by protocol
+func (s *StorageWrites) Snapshot() map[string]StorageWriteMetrics {
+	snapshot := make(map[string]StorageWriteMetrics)
+	s.counters.Range(func(key, value any) bool {
+		counter := value.(*StorageWriteMetrics)
+		snapshot[key.(string)] = StorageWriteMetrics{
+			Writes: atomic.LoadUint64(&counter.Writes),
+			Errors: atomic.LoadUint64(&counter.Errors),
+		}
+		return true
+	})
+	return snapshot
+}
+
+// MarshalJSON encodes the snapshot of the writes
+func (s *StorageWrites) MarshalJSON() ([]byte, error) {
+	return jsoniter.Marshal(s.Snapshot())
+}
+
+func GetTrackedNamesMetrics(options *Options) *TrackedNamesMetrics {
+	if options.Counters == nil {
+		return &TrackedNamesMetrics{}
+	}
+	return &TrackedNamesMetrics{Count: uint64(options.Counters.Len()), Evictions: options.Counters.Evictions()}
 }
 
 func GetCacheMetrics(options *Options) *storage.CacheMetrics {
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// proxyHeaderTimeout bounds the read of the PROXY header
+	proxyHeaderTimeout = 5 * time.Second
+	// proxyV1MaxLength is the max length of a v1 header including the CRLF
+	proxyV1MaxLength = 107
+)
+
+// proxyV2Signature starts the binary v2 headers
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections prefixed with a PROXY protocol (v1 or v2)
+// header, reporting the client address it carries as their remote address.
+// Headers are only parsed on connections from trusted sources.
+type proxyListener struct {
+	net.Listener
+	trusted func(host string) bool
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if !l.trusted(host) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// proxyConn reads the PROXY header on the first read or remote address
+// lookup so that slow clients don't block the accept loop.
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader leaves its read deadline set, the DNS server setting its own
+// before reading each message.
+func (c *proxyConn) readHeader() {
+	_ = c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	c.remoteAddr, c.err = readProxyHeader(c.reader)
+	if c.err != nil {
+		_ = c.Conn.Close()
+	}
+}
+
+// readProxyHeader consumes the PROXY header of reader if any and returns
+// the client address it carries, nil for connections without one or
+// whose header doesn't carry an address (UNKNOWN and LOCAL).
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	prefix, err := reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read proxy header")
+	}
+	switch {
+	case bytes.Equal(prefix, proxyV2Signature):
+		return readProxyV2Header(reader)
+	case bytes.HasPrefix(prefix, []byte("PROXY ")):
+		return readProxyV1Header(reader)
+	}
+	return nil, nil
+}
+
+// readProxyV1Header parses a "PROXY TCP4 src dst sport dport\r\n" header
+func readProxyV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("proxy v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read proxy v1 header")
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("invalid proxy v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, errors.Errorf("invalid proxy v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2Header parses a binary v2 header
+func readProxyV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.Wrap(err, "could not read proxy v2 header")
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, errors.Wrap(err, "could not read proxy v2 addresses")
+	}
+	if versionCommand>>4 != 2 {
+		return nil, errors.Errorf("unsupported proxy version %d", versionCommand>>4)
+	}
+	// LOCAL connections are health checks of the proxy itself
+	if versionCommand&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch family {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("short proxy v2 tcp4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("short proxy v2 tcp6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	return nil, nil
+}
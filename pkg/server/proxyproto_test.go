@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadProxyHeader(t *testing.T) {
+	payload := []byte("\x00\x1dquery")
+
+	reader := bufio.NewReader(bytes.NewReader(append([]byte("PROXY TCP4 198.51.100.7 203.0.113.1 40000 53\r\n"), payload...)))
+	addr, err := readProxyHeader(reader)
+	require.Nil(t, err, "could not read v1 header")
+	require.Equal(t, "198.51.100.7:40000", addr.String(), "could not get v1 client address")
+	rest, _ := io.ReadAll(reader)
+	require.Equal(t, payload, rest, "could not keep dns message after v1 header")
+
+	addresses := make([]byte, 12)
+	copy(addresses[0:4], net.ParseIP("198.51.100.8").To4())
+	copy(addresses[4:8], net.ParseIP("203.0.113.1").To4())
+	binary.BigEndian.PutUint16(addresses[8:10], 40001)
+	binary.BigEndian.PutUint16(addresses[10:12], 53)
+	header := append(append([]byte{}, proxyV2Signature...), 0x21, 0x11, 0, byte(len(addresses)))
+	reader = bufio.NewReader(bytes.NewReader(append(append(header, addresses...), payload...)))
+	addr, err = readProxyHeader(reader)
+	require.Nil(t, err, "could not read v2 header")
+	require.Equal(t, "198.51.100.8:40001", addr.String(), "could not get v2 client address")
+	rest, _ = io.ReadAll(reader)
+	require.Equal(t, payload, rest, "could not keep dns message after v2 header")
+
+	reader = bufio.NewReader(bytes.NewReader(append([]byte("\x00\x1d"), bytes.Repeat([]byte{0}, 29)...)))
+	addr, err = readProxyHeader(reader)
+	require.Nil(t, err)
+	require.Nil(t, addr, "could not pass through connection without header")
+
+	_, err = readProxyHeader(bufio.NewReader(bytes.NewReader([]byte("PROXY TCP4 invalid\r\n"))))
+	require.NotNil(t, err, "could not reject invalid v1 header")
+}
+
+func TestProxyListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+
+	trusted := true
+	proxied := &proxyListener{Listener: listener, trusted: func(host string) bool { return trusted }}
+	for _, trust := range []bool{true, false} {
+		trusted = trust
+		client, err := net.Dial("tcp", listener.Addr().String())
+		require.Nil(t, err)
+		_, err = client.Write([]byte("PROXY TCP4 198.51.100.7 203.0.113.1 40000 53\r\n\x00\x1d"))
+		require.Nil(t, err)
+
+		conn, err := proxied.Accept()
+		require.Nil(t, err)
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if trust {
+			require.Equal(t, "198.51.100.7", host, "could not report client address of trusted proxy")
+		} else {
+			require.Equal(t, "127.0.0.1", host, "could not ignore header of untrusted source")
+		}
+		client.Close()
+		conn.Close()
+	}
+}
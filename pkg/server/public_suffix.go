@@ -0,0 +1,75 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/publicsuffix"
+)
+
+// publicSuffixList is the set of public suffix rules loaded from a PSL file.
+// A nil list falls back to the list bundled with golang.org/x/net.
+type publicSuffixList struct {
+	rules map[string]struct{}
+	// wildcards are the parents of the "*." rules, matching one extra label
+	wildcards map[string]struct{}
+	// exceptions are the "!" rules, overriding the wildcards
+	exceptions map[string]struct{}
+}
+
+// loadPublicSuffixList reads the rules of a public suffix list file
+func loadPublicSuffixList(path string) (*publicSuffixList, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open public suffix list")
+	}
+	defer file.Close()
+
+	list := &publicSuffixList{
+		rules:      make(map[string]struct{}),
+		wildcards:  make(map[string]struct{}),
+		exceptions: make(map[string]struct{}),
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rule := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if rule == "" || strings.HasPrefix(rule, "//") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			list.exceptions[strings.TrimPrefix(rule, "!")] = struct{}{}
+		case strings.HasPrefix(rule, "*."):
+			list.wildcards[strings.TrimPrefix(rule, "*.")] = struct{}{}
+		default:
+			list.rules[rule] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read public suffix list")
+	}
+	return list, nil
+}
+
+// contains returns true if name is itself a public suffix
+func (list *publicSuffixList) contains(name string) bool {
+	name = strings.ToLower(name)
+	if list != nil {
+		if _, ok := list.exceptions[name]; ok {
+			return false
+		}
+		if _, ok := list.rules[name]; ok {
+			return true
+		}
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			return false
+		}
+		_, ok = list.wildcards[parent]
+		return ok
+	}
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	return icann && suffix == name
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+const (
+	// queryLogBufferSize is the number of entries buffered before dropping
+	queryLogBufferSize = 4096
+	// queryLogBackups is the number of rotated files kept (file.1 being the newest)
+	queryLogBackups = 3
+)
+
+// QueryLogEntry is a DNS query written to the query log
+type QueryLogEntry struct {
+	Timestamp     time.Time `json:"timestamp"`
+	Protocol      string    `json:"protocol"`
+	RemoteAddress string    `json:"remote-address"`
+	QName         string    `json:"q-name"`
+	QType         string    `json:"q-type"`
+	Rcode         string    `json:"rcode,omitempty"`
+}
+
+// QueryLog writes the DNS queries as JSON lines to a file rotated by size.
+// Entries are written by a single goroutine so that logging never blocks
+// the DNS handlers, entries being dropped when the buffer is full.
+type QueryLog struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	entries chan QueryLogEntry
+	wg      sync.WaitGroup
+	// mu guards the entries against the queries logged after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewQueryLog returns a query log appending to path, rotated once it reaches
+// maxSizeMB megabytes (0 disables the rotation).
+func NewQueryLog(path string, maxSizeMB int) (*QueryLog, error) {
+	log := &QueryLog{
+		path:    path,
+		maxSize: int64(maxSizeMB) * 1024 * 1024,
+		entries: make(chan QueryLogEntry, queryLogBufferSize),
+	}
+	if err := log.open(); err != nil {
+		return nil, err
+	}
+	log.wg.Add(1)
+	go log.run()
+	return log, nil
+}
+
+// Log queues entry and returns false if it was dropped
+func (l *QueryLog) Log(entry QueryLogEntry) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return false
+	}
+	select {
+	case l.entries <- entry:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close writes the queued entries and closes the file
+func (l *QueryLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.entries)
+	l.mu.Unlock()
+	l.wg.Wait()
+	return l.file.Close()
+}
+
+func (l *QueryLog) run() {
+	defer l.wg.Done()
+
+	for entry := range l.entries {
+		data, err := jsoniter.Marshal(entry)
+		if err != nil {
+			continue
+		}
+		data = append(data, '\n')
+		if l.maxSize > 0 && l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+			if err := l.rotate(); err != nil {
+				gologger.Warning().Msgf("Could not rotate DNS query log: %s\n", err)
+			}
+		}
+		n, err := l.file.Write(data)
+		l.size += int64(n)
+		if err != nil {
+			gologger.Warning().Msgf("Could not write DNS query log: %s\n", err)
+		}
+	}
+}
+
+func (l *QueryLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "could not open query log")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "could not stat query log")
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the backups, moves the file to file.1 and reopens it
+func (l *QueryLog) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return errors.Wrap(err, "could not close query log")
+	}
+	for i := queryLogBackups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	renameErr := os.Rename(l.path, l.path+".1")
+	if err := l.open(); err != nil {
+		return err
+	}
+	return errors.Wrap(renameErr, "could not rename query log")
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.log")
+	queryLog, err := NewQueryLog(path, 0)
+	require.Nil(t, err, "could not create query log")
+
+	server := newTestDNSServer(t, &Options{DnsQueryLog: queryLog})
+	queryTestDNSServer(server, "test.example.com", dns.TypeA)
+	queryTestDNSServer(server, "test.example.com", dns.TypeTXT)
+	require.Nil(t, queryLog.Close(), "could not close query log")
+
+	file, err := os.Open(path)
+	require.Nil(t, err, "could not open query log")
+	defer file.Close()
+
+	var entries []QueryLogEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry QueryLogEntry
+		require.Nil(t, jsoniter.Unmarshal(scanner.Bytes(), &entry), "could not decode entry")
+		entries = append(entries, entry)
+	}
+	require.Len(t, entries, 2, "could not log queries")
+	require.Equal(t, "test.example.com.", entries[0].QName, "could not log qname")
+	require.Equal(t, "TXT", entries[1].QType, "could not log qtype")
+	require.Equal(t, "NOERROR", entries[0].Rcode, "could not log rcode")
+	require.True(t, strings.HasPrefix(entries[0].RemoteAddress, "192.0.2.1:"), "could not log remote address")
+
+	// queries in flight on shutdown are dropped
+	require.False(t, queryLog.Log(QueryLogEntry{QName: "test.example.com.", QType: "A"}), "could not drop entry after close")
+	require.Nil(t, queryLog.Close(), "could not close query log twice")
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns.log")
+	queryLog, err := NewQueryLog(path, 0)
+	require.Nil(t, err, "could not create query log")
+	queryLog.maxSize = 200
+
+	for i := 0; i < 10; i++ {
+		require.True(t, queryLog.Log(QueryLogEntry{QName: "test.example.com.", QType: "A"}), "could not queue entry")
+	}
+	require.Nil(t, queryLog.Close(), "could not close query log")
+
+	for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		info, err := os.Stat(name)
+		require.Nil(t, err, "could not rotate query log")
+		require.LessOrEqual(t, info.Size(), int64(200), "could not bound query log size")
+	}
+	_, err = os.Stat(path + ".4")
+	require.True(t, os.IsNotExist(err), "could not bound backups")
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/projectdiscovery/gologger"
+)
+
+// WriteLimiter is a non-blocking token bucket shared by all the servers
+// to cap the storage write throughput.
+type WriteLimiter struct {
+	interval int64
+	burst    int64
+	// tat is the theoretical arrival time of the next write in unix nanoseconds
+	tat int64
+}
+
+// NewWriteLimiter returns a limiter allowing perSecond writes per second
+// with bursts of up to perSecond writes.
+func NewWriteLimiter(perSecond int) *WriteLimiter {
+	interval := int64(time.Second) / int64(perSecond)
+	return &WriteLimiter{interval: interval, burst: interval * int64(perSecond)}
+}
+
+// Allow returns true if a write can be performed now.
+func (l *WriteLimiter) Allow() bool {
+	for {
+		now := time.Now().UnixNano()
+		tat := atomic.LoadInt64(&l.tat)
+		next := tat
+		if next < now {
+			next = now
+		}
+		next += l.interval
+		if next-now > l.burst {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&l.tat, tat, next) {
+			return true
+		}
+	}
+}
+
+// allowStorageWrite returns false and counts the write as shed if the
+// global storage write limit is exceeded.
+func (options *Options) allowStorageWrite() bool {
+	if options.StorageWriteLimiter == nil || options.StorageWriteLimiter.Allow() {
+		return true
+	}
+	if options.Stats != nil {
+		atomic.AddUint64(&options.Stats.StorageShed, 1)
+	}
+	gologger.Debug().Msgf("Storage write limit exceeded, shedding interaction\n")
+	return false
+}
+
+// SourceLimiter is a token bucket per source shared by the DNS listeners.
+// Like the NameCounters, the least recently seen sources are evicted once
+// maxSources are tracked so that spoofed sources can't grow it unbounded.
+type SourceLimiter struct {
+	mu         sync.Mutex
+	interval   int64
+	burst      int64
+	maxSources int
+	sources    map[string]*list.Element
+	lru        *list.List
+}
+
+type sourceBucket struct {
+	source string
+	// tat is the theoretical arrival time of the next query in unix nanoseconds
+	tat int64
+}
+
+// NewSourceLimiter returns a limiter allowing perSecond queries per second
+// per source with bursts of up to burst queries (perSecond if unset).
+func NewSourceLimiter(perSecond, burst, maxSources int) *SourceLimiter {
+	if burst <= 0 {
+		burst = perSecond
+	}
+	if maxSources <= 0 {
+		maxSources = DefaultMaxTrackedNames
+	}
+	interval := int64(time.Second) / int64(perSecond)
+	return &SourceLimiter{
+		interval:   interval,
+		burst:      interval * int64(burst),
+		maxSources: maxSources,
+		sources:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Allow returns true if a query of source can be answered now.
+func (l *SourceLimiter) Allow(source string) bool {
+	now := time.Now().UnixNano()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	element, ok := l.sources[source]
+	if ok {
+		l.lru.MoveToFront(element)
+	} else {
+		if l.lru.Len() >= l.maxSources {
+			oldest := l.lru.Back()
+			l.lru.Remove(oldest)
+			delete(l.sources, oldest.Value.(*sourceBucket).source)
+		}
+		element = l.lru.PushFront(&sourceBucket{source: source})
+		l.sources[source] = element
+	}
+	bucket := element.Value.(*sourceBucket)
+	next := bucket.tat
+	if next < now {
+		next = now
+	}
+	next += l.interval
+	if next-now > l.burst {
+		return false
+	}
+	bucket.tat = next
+	return true
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageWriteLimiter(t *testing.T) {
+	options := &Options{Stats: &Metrics{}, StorageWriteLimiter: NewWriteLimiter(2)}
+
+	var allowed int
+	for i := 0; i < 5; i++ {
+		if options.allowStorageWrite() {
+			allowed++
+		}
+	}
+	require.Equal(t, 2, allowed, "could not limit storage writes")
+	require.Equal(t, uint64(3), options.Stats.StorageShed, "could not count shed writes")
+}
+
+func TestSourceLimiter(t *testing.T) {
+	limiter := NewSourceLimiter(1, 2, 2)
+
+	require.True(t, limiter.Allow("192.0.2.1"), "could not allow first query")
+	require.True(t, limiter.Allow("192.0.2.1"), "could not allow burst query")
+	require.False(t, limiter.Allow("192.0.2.1"), "could not limit source")
+	require.True(t, limiter.Allow("192.0.2.2"), "could not allow other source")
+
+	limiter.Allow("192.0.2.3")
+	require.Len(t, limiter.sources, 2, "could not evict least recently seen source")
+	require.True(t, limiter.Allow("192.0.2.1"), "could not reset evicted source")
+}
@@ -100,9 +100,13 @@ func (h *ResponderServer) ListenAndServe(responderAlive chan bool) error {
 						gologger.Warning().Msgf("Could not encode responder interaction: %s\n", err)
 					} else {
 						gologger.Debug().Msgf("Responder Interaction: \n%s\n", buffer.String())
-						if err := h.options.Storage.AddInteractionWithId(h.options.Token, buffer.Bytes()); err != nil {
+						err := h.options.addInteractionWithId(h.options.Token, buffer.Bytes())
+						if err != nil && err != errStorageShed {
 							gologger.Warning().Msgf("Could not store dns interaction: %s\n", err)
 						}
+						if err != errStorageShed {
+							h.options.publishInteraction("", interaction, buffer.Bytes())
+						}
 					}
 				}
 			}
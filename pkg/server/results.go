@@ -0,0 +1,109 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// resultWorkers is the number of goroutines running the OnResult callback
+	resultWorkers = 4
+	// resultQueueSize is the number of results queued before dropping
+	resultQueueSize = 1024
+	// resultCloseTimeout bounds the callbacks of the queued results on close
+	resultCloseTimeout = 10 * time.Second
+)
+
+// ResultDispatcher runs the OnResult callback on a bounded pool of workers
+// so that slow callbacks never stall the protocol handlers, results being
+// dropped when the queue is full.
+type ResultDispatcher struct {
+	results chan interface{}
+	wg      sync.WaitGroup
+	// mu guards the queue against the results dispatched after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewResultDispatcher returns a dispatcher running callback on workers goroutines
+func NewResultDispatcher(callback OnResultCallback, workers int) *ResultDispatcher {
+	if workers <= 0 {
+		workers = resultWorkers
+	}
+	dispatcher := &ResultDispatcher{results: make(chan interface{}, resultQueueSize)}
+	dispatcher.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer dispatcher.wg.Done()
+			for result := range dispatcher.results {
+				callback(result)
+			}
+		}()
+	}
+	return dispatcher
+}
+
+// Dispatch queues result and returns false if it was dropped
+func (d *ResultDispatcher) Dispatch(result interface{}) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.results <- result:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops queuing results and waits for the callbacks of the queued
+// ones, giving up after resultCloseTimeout.
+func (d *ResultDispatcher) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.results)
+	}
+	d.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(resultCloseTimeout):
+		return errors.New("timed out running the queued result callbacks")
+	}
+}
+
+// publishInteraction hands a stored interaction and its encoding to the
+// OnResult callback, the webhook, syslog and kafka. The callback runs through the
+// dispatcher when set and in the calling goroutine otherwise.
+func (options *Options) publishInteraction(correlationID string, interaction *Interaction, data []byte) {
+	if options.Webhook != nil && !options.Webhook.Deliver(data) && options.Stats != nil {
+		atomic.AddUint64(&options.Stats.WebhookDropped, 1)
+	}
+	if options.Syslog != nil && !options.Syslog.Log(interaction) && options.Stats != nil {
+		atomic.AddUint64(&options.Stats.SyslogDropped, 1)
+	}
+	if options.Kafka != nil && !options.Kafka.Produce(correlationID, data) && options.Stats != nil {
+		atomic.AddUint64(&options.Stats.KafkaDropped, 1)
+	}
+	if options.OnResult == nil {
+		return
+	}
+	if options.ResultDispatcher == nil {
+		options.OnResult(interaction)
+		return
+	}
+	if !options.ResultDispatcher.Dispatch(interaction) && options.Stats != nil {
+		atomic.AddUint64(&options.Stats.ResultsDropped, 1)
+	}
+}
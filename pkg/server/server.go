@@ -20,14 +20,44 @@ type Interaction struct {
 	FullId string `json:"full-id"`
 	// QType is the question type for the interaction
 	QType string `json:"q-type,omitempty"`
+	// MatchMethod is the extraction method which matched the unique id (scan-everywhere, scan-raw, regex or label)
+	MatchMethod string `json:"match-method,omitempty"`
+	// AnswerIPs are the A/AAAA addresses served in the DNS answer
+	AnswerIPs []string `json:"answer-ips,omitempty"`
 	// RawRequest is the raw request received by the interactsh server.
 	RawRequest string `json:"raw-request,omitempty"`
 	// RawResponse is the raw response sent by the interactsh server.
 	RawResponse string `json:"raw-response,omitempty"`
 	// SMTPFrom is the mail form field
 	SMTPFrom string `json:"smtp-from,omitempty"`
-	// RemoteAddress is the remote address for interaction
+	// RemoteAddress is the remote address for interaction, the resolver for dns ones
 	RemoteAddress string `json:"remote-address"`
+	// OriginAddress is the client address carried by the origin IP EDNS option
+	OriginAddress string `json:"origin-address,omitempty"`
+	// OriginPort is the client source port carried by the origin IP EDNS option
+	OriginPort int `json:"origin-port,omitempty"`
+	// LocalPort is the local port the interaction was received on
+	LocalPort int `json:"local-port,omitempty"`
+	// CheckingDisabled is the CD (checking-disabled) bit of the DNS query
+	CheckingDisabled bool `json:"checking-disabled,omitempty"`
+	// FlakyPhase is the phase of a flaky name query (servfail or retry)
+	FlakyPhase string `json:"flaky-phase,omitempty"`
+	// EDNSPadded is true if the DNS response was padded (RFC 7830)
+	EDNSPadded bool `json:"edns-padded,omitempty"`
+	// QueryOrigin tells whether the DNS query came directly from a client or through a resolver
+	QueryOrigin string `json:"query-origin,omitempty"`
+	// Honeytoken is true if the interaction was triggered by a honeytoken label
+	Honeytoken bool `json:"honeytoken,omitempty"`
+	// EDNS is the OPT record of the DNS query
+	EDNS string `json:"edns,omitempty"`
+	// ClientSubnet is the EDNS Client Subnet sent by a trusted resolver
+	ClientSubnet string `json:"client-subnet,omitempty"`
+	// EDNSNSID is the hex encoded NSID option of the DNS query
+	EDNSNSID string `json:"edns-nsid,omitempty"`
+	// EDNSUDPSize is the UDP buffer size advertised by the DNS query
+	EDNSUDPSize uint16 `json:"edns-udp-size,omitempty"`
+	// RemotePTR are the reverse DNS names of the remote address
+	RemotePTR []string `json:"remote-ptr,omitempty"`
 	// Timestamp is the timestamp for the interaction
 	Timestamp time.Time           `json:"timestamp"`
 	AsnInfo   []map[string]string `json:"asninfo,omitempty"`
@@ -47,8 +77,21 @@ type Options struct {
 	DnsPort int
 	// DnsTTL is the ttl for DNS response
 	DnsTTL int
+	// DoHPort is the port to listen the DNS-over-HTTPS server on (0 disables)
+	DoHPort int
+	// TCPTTLOverride is the ttl for DNS responses served over TCP, DoT and DoH,
+	// taking precedence over DnsTTLByType (0 uses DnsTTL)
+	TCPTTLOverride int
+	// DnsEDNSUDPSize is the UDP buffer size advertised in the OPT record of the responses to EDNS queries
+	DnsEDNSUDPSize int
+	// DnsTTLJitter randomizes the ttl of each record by up to seconds (30) or a percentage (20%)
+	DnsTTLJitter string
+	// DnsTTLByType is the ttl of the DNS responses per record type (e.g. A, TXT), falling back to DnsTTL
+	DnsTTLByType map[string]int
 	// HttpPort is the port to listen HTTP server on
 	DnsSubdomainRecords []string
+	// CAARecords are the CAA records answered for a domain (domain=<flag> <tag> "<value>")
+	CAARecords []string
 	// DnsSubdomainRecords is the mapping relationship between subdomain and resolve, used for dns rebinding
 	HttpPort int
 	// HttpsPort is the port to listen HTTPS server on
@@ -70,7 +113,9 @@ type Options struct {
 	// Hostmaster is the hostmaster email for the server.
 	Hostmasters []string
 	// Storage is a storage for interaction data storage
-	Storage storage.Storage
+	Storage storage.Storage `json:"-"`
+	// SecondaryStorage mirrors the writes to the primary storage, e.g. while migrating backends
+	SecondaryStorage storage.Storage `json:"-"`
 	// Auth requires client to authenticate
 	Auth bool
 	// HTTPIndex is the http index file for server
@@ -93,16 +138,32 @@ type Options struct {
 	FTPDirectory string
 	// ScanEverywhere for potential correlation id
 	ScanEverywhere bool
+	// ScanRawQuery additionally scans the wire bytes of the DNS queries with ScanEverywhere
+	ScanRawQuery bool
 	// CorrelationIdLength of preamble
 	CorrelationIdLength int
 	// CorrelationIdNonceLength of the unique identifier
 	CorrelationIdNonceLength int
+	// CorrelationIdAlphabet restricts the characters of the correlation ids, any
+	// alphanumeric one being accepted when empty. Dashes are only accepted when
+	// they are not part of the CorrelationIdSeparators
+	CorrelationIdAlphabet string
+	// CorrelationIdRegex extracts the correlation id of the DNS names from its
+	// first capture group before the default heuristics
+	CorrelationIdRegex string
+	// CorrelationIdSeparators split the DNS labels into the parts checked for
+	// correlation ids, defaulting to dashes and underscores
+	CorrelationIdSeparators string
 	// Certificate Path
 	CertificatePath string
 	// Private Key Path
 	PrivateKeyPath string
 	// CustomRecords is a file containing custom DNS records
 	CustomRecords string
+	// StrictCustomRecords fails loading the custom records on invalid records instead of skipping them
+	StrictCustomRecords bool
+	// DisableDefaultRecords skips the built-in cloud metadata and localhost records
+	DisableDefaultRecords bool
 	// HTTP header containing origin IP
 	OriginIPHeader string
 	// Version is the version of interactsh server
@@ -111,6 +172,12 @@ type Options struct {
 	DiskStorage bool
 	// DiskStoragePath defines the disk storage location
 	DiskStoragePath string
+	// RedisAddress is the redis server storing the interactions shared by several instances
+	RedisAddress string
+	// RedisPassword is the password of the redis server
+	RedisPassword string
+	// RedisDB is the database of the redis server
+	RedisDB int
 	// DynamicResp enables dynamic HTTP response
 	DynamicResp bool
 	// EnableMetrics enables metrics endpoint
@@ -123,16 +190,233 @@ type Options struct {
 	RealIPFrom []string
 	// EDNSopt code containing origin IP
 	OriginIPEDNSopt int
+	// OriginIPEDNSoptPort reads a 2-byte source port following the address of the origin IP EDNS option
+	OriginIPEDNSoptPort bool
+	// OfflineMode answers OfflineIP for every query without ACME/TLS dependencies
+	OfflineMode bool
+	// OfflineIP is the IP address answered in offline mode
+	OfflineIP string
+	// ACMELookupTimeout bounds the lookup of the ACME challenge records, timeouts being answered SERVFAIL
+	ACMELookupTimeout time.Duration
+	// SinkholeIP is answered instead of IPAddress for the subdomains without custom records
+	SinkholeIP string
+	// SinkholeIPv6 is answered instead of IPv6Address for the subdomains without custom records
+	SinkholeIPv6 string
+	// ANAMEUpstream is the resolver (host:port) of the ANAME record targets
+	ANAMEUpstream string
+	// ANAMECacheTTL is the duration the resolved ANAME targets are cached for (0 disables)
+	ANAMECacheTTL time.Duration
+	// AnswerOrdering controls the order of records in responses (insertion-order or rfc-order)
+	AnswerOrdering string
+	// EDNSPadding pads responses over encrypted transports (requested or always)
+	EDNSPadding string
+	// DNSSECKeyPath is the BIND .key file of the ZSK signing the responses to DO queries
+	DNSSECKeyPath string
+	// DNSSECKSKPath is the BIND .key file of the KSK signing the DNSKEY RRset (optional)
+	DNSSECKSKPath string
+	// DnsAllowedQTypes restricts the answered and stored query types (e.g. A, TXT)
+	DnsAllowedQTypes []string
+	// DnsDeniedQTypes are the query types answered empty and not stored (e.g. SOA, NS)
+	DnsDeniedQTypes []string
+	// StrictDomain answers queries outside the configured domains with an error (nxdomain or refused)
+	StrictDomain string
+	// DNSDiscovery answers TXT queries for _interactsh.<domain> with the server capabilities
+	DNSDiscovery bool
+	// MailHost is the subdomain MX queries point to (mail by default)
+	MailHost string
+	// NSRecords are the name servers of a domain, overriding ns1/ns2
+	NSRecords map[string][]string
+	// MXRecords are the mail exchangers of a domain answered in order, overriding the mail host
+	MXRecords map[string][]MXRecord
+	// MailSPF is the SPF TXT record answered for the mail host
+	MailSPF string
+	// AuditEchoLabel is the subdomain answering a TXT with the query source and timestamp
+	AuditEchoLabel string
+	// EchoTXT answers TXT queries with the queried name as received
+	EchoTXT bool
+	// HINFOCpu is the CPU string answered for HINFO queries
+	HINFOCpu string
+	// HINFOOs is the OS string answered for HINFO queries
+	HINFOOs string
+	// SOASerial is the serial of the SOA record (0 uses the startup timestamp)
+	SOASerial int
+	// SOARefresh is the refresh timer of the SOA record in seconds
+	SOARefresh int
+	// SOARetry is the retry timer of the SOA record in seconds
+	SOARetry int
+	// SOAExpire is the expire timer of the SOA record in seconds (60 if unset)
+	SOAExpire int
+	// SOAMinTTL is the minimum (negative caching) ttl of the SOA record in seconds (60 if unset)
+	SOAMinTTL int
+	// SplitHorizon answers A queries from matching source CIDRs with a dedicated IP
+	SplitHorizon []SplitHorizonRecord
+	// SignedLabels requires correlation ids to be followed by their signature (<id>-<hmac>)
+	SignedLabels bool
+	// LogUnsignedLabels logs interactions carrying unsigned correlation ids
+	LogUnsignedLabels bool
+	// TOTPLabels requires an otp-<code> label with a valid time-based code keyed by the token
+	TOTPLabels bool
+	// TOTPPeriod is the time step of the otp label codes
+	TOTPPeriod time.Duration
+	// TOTPSkew is the number of time steps accepted before and after the current one
+	TOTPSkew int
+	// CDNSubtree is the label under which queries rotate through CDNPool
+	CDNSubtree string
+	// CDNPool is the list of IPs rotated for queries under CDNSubtree
+	CDNPool []string
+	// CDNTTL is the TTL forced on answers under CDNSubtree
+	CDNTTL int
+	// FlakyLabels are the subdomains answered SERVFAIL on the first query of a source
+	FlakyLabels []string
+	// FlakyWindow is the time retries of a flaky name are answered normally
+	FlakyWindow time.Duration
+	// DnsResponseDelay is the time waited before answering DNS queries without a delay<duration> label
+	DnsResponseDelay time.Duration
+	// DnsMaxResponseDelay caps the time waited before answering DNS queries (10s if unset)
+	DnsMaxResponseDelay time.Duration
+	// ProxyProtocol parses the PROXY protocol headers of the DNS over TCP connections from RealIPFrom
+	ProxyProtocol bool
+	// DnsDedupWindow suppresses the DNS interactions of a (unique id, qtype, source) seen within it
+	DnsDedupWindow time.Duration
+	// DnsIgnoreNames are the query names (or *suffixes) answered but never stored, e.g. monitoring probes
+	DnsIgnoreNames []string
+	// DnsIgnoreIDs are the correlation or unique ids (or *suffixes) whose DNS interactions are never stored
+	DnsIgnoreIDs []string
+	// DirectQueryOnlyRecords maps a subdomain to the IP answered only for direct queries.
+	// Queries are direct when they carry the RD bit, which iterating resolvers clear
+	// but stubs and forwarders set, or come from DirectQuerySources.
+	DirectQueryOnlyRecords map[string]string
+	// DirectQuerySources are the IPs/CIDRs whose queries are always considered direct
+	DirectQuerySources []string
+	// HoneytokenLabels are the labels stored as enriched high-priority interactions
+	HoneytokenLabels []string
+	// HoneytokenWebhook is the URL honeytoken interactions are posted to
+	HoneytokenWebhook string
+	// WebhookURL is the URL every stored interaction is posted to
+	WebhookURL string
+	// WebhookAuthHeader is the "Name: value" header or Authorization value sent to the webhook
+	WebhookAuthHeader string
+	// WebhookRetries is the number of retries of a failed webhook delivery
+	WebhookRetries int
+	// SyslogAddress is the [udp|tcp|unix]://address interactions are sent to
+	SyslogAddress string
+	// SyslogFacility is the facility name or code of the syslog messages
+	SyslogFacility string
+	// KafkaBrokers are the brokers of the cluster interactions are produced to
+	KafkaBrokers []string
+	// KafkaTopic is the topic interactions are produced to
+	KafkaTopic string
+	// KafkaUsername is the optional SASL username of the kafka cluster
+	KafkaUsername string
+	// KafkaPassword is the SASL password of the kafka cluster
+	KafkaPassword string
+	// KafkaSASLMechanism is the SASL mechanism (plain, scram-sha-256 or scram-sha-512)
+	KafkaSASLMechanism string
+	// CDBypassRecords maps a subdomain to the IP answered when the CD bit is set
+	CDBypassRecords map[string]string
+	// DNAMERecords maps a subtree label to the target domain it is redirected to
+	DNAMERecords map[string]string
+	// Delegations maps a subzone label to the name servers it is delegated to (host or host=glue ip)
+	Delegations map[string][]string
+	// SequenceRecords maps a subdomain to the IPs returned in order on successive queries
+	SequenceRecords map[string][]string
+	// RefusePublicSuffixLabels answers REFUSED to queries whose first label is a public suffix
+	RefusePublicSuffixLabels bool
+	// PublicSuffixListPath is the public suffix list file used instead of the bundled one
+	PublicSuffixListPath string
+	// MaxTrackedNames is the maximum number of names tracked by the stateful DNS records
+	MaxTrackedNames int
+	// DnsLogFile is the file the DNS queries are logged to as JSON lines
+	DnsLogFile string
+	// DnsLogMaxSizeMB is the size the DNS query log is rotated at (0 disables rotation)
+	DnsLogMaxSizeMB int
+	// DnsRateLimit is the number of DNS queries answered per second per source (0 disables)
+	DnsRateLimit int
+	// DnsRateBurst is the burst of DNS queries allowed per source (DnsRateLimit if unset)
+	DnsRateBurst int
+	// DnsRateLimitExemptTrusted exempts the RealIPFrom sources from the DNS rate limit
+	DnsRateLimitExemptTrusted bool
+	// MaxStorageWritesPerSec is the global cap on storage writes per second (0 disables)
+	MaxStorageWritesPerSec int
 
-	ACMEStore *acme.Provider
-	Stats     *Metrics
-	OnResult  OnResultCallback
+	ACMEStore           *acme.Provider      `json:"-"`
+	Stats               *Metrics            `json:"-"`
+	Counters            *NameCounters       `json:"-"`
+	StorageWriteLimiter *WriteLimiter       `json:"-"`
+	DnsRateLimiter      *SourceLimiter      `json:"-"`
+	DnsQueryLog         *QueryLog           `json:"-"`
+	ANAMECache          *ANAMECache         `json:"-"`
+	HoneytokenRecorder  *HoneytokenRecorder `json:"-"`
+	ResultDispatcher    *ResultDispatcher   `json:"-"`
+	Webhook             *Webhook            `json:"-"`
+	Syslog              *SyslogWriter       `json:"-"`
+	Kafka               *KafkaSink          `json:"-"`
+	// OnResult is called with every stored interaction, from the workers of
+	// the ResultDispatcher if set (as by NewDNSServer). The results are then
+	// dropped and counted in ResultsDropped while its queue is full, closing
+	// the dispatcher on shutdown running the queued callbacks.
+	OnResult OnResultCallback `json:"-"`
 
-	Certificates []tls.Certificate
-	CertFiles    []acme.CertificateFiles
+	Certificates []tls.Certificate       `json:"-"`
+	CertFiles    []acme.CertificateFiles `json:"-"`
 }
+
+// OnResultCallback is called with every interaction stored by the servers
 type OnResultCallback func(out interface{})
 
+// MXRecord is a mail exchanger answered for MX queries
+type MXRecord struct {
+	Host string
+	Pref uint16
+}
+
+// SplitHorizonRecord is the IP answered to sources within CIDR
+type SplitHorizonRecord struct {
+	CIDR string
+	IP   string
+}
+
+// redactedValue replaces secrets in the redacted options
+const redactedValue = "[REDACTED]"
+
+// Redacted returns a copy of the options with the secrets masked,
+// suitable to be serialized for diagnostics.
+func (options *Options) Redacted() Options {
+	redacted := *options
+	for _, value := range []*string{&redacted.Token, &redacted.RedisPassword, &redacted.KafkaUsername, &redacted.KafkaPassword, &redacted.WebhookAuthHeader} {
+		if *value != "" {
+			*value = redactedValue
+		}
+	}
+	for _, value := range []*string{&redacted.HTTPReverseProxy, &redacted.OriginURL, &redacted.WebhookURL, &redacted.HoneytokenWebhook, &redacted.SyslogAddress, &redacted.RedisAddress} {
+		*value = redactURL(*value)
+	}
+	return redacted
+}
+
+// redactURL masks the userinfo, query and fragment of a URL or address,
+// which often carry credentials.
+func redactURL(value string) string {
+	scheme, rest, ok := strings.Cut(value, "://")
+	if !ok {
+		scheme, rest = "", value
+	}
+	authority, path := rest, ""
+	if end := strings.IndexAny(rest, "/?#"); end >= 0 {
+		authority, path = rest[:end], rest[end:]
+	}
+	if at := strings.LastIndex(authority, "@"); at >= 0 {
+		authority = redactedValue + authority[at:]
+	}
+	if end := strings.IndexAny(path, "?#"); end >= 0 {
+		path = path[:end+1] + redactedValue
+	}
+	if ok {
+		return scheme + "://" + authority + path
+	}
+	return authority + path
+}
+
 func (options *Options) GetIdLength() int {
 	return options.CorrelationIdLength + options.CorrelationIdNonceLength
 }
@@ -113,9 +113,13 @@ func (h *SMTPServer) defaultHandler(remoteAddr net.Addr, from string, to []strin
 						gologger.Warning().Msgf("Could not encode root tld SMTP interaction: %s\n", err)
 					} else {
 						gologger.Debug().Msgf("Root TLD SMTP Interaction: \n%s\n", buffer.String())
-						if err := h.options.Storage.AddInteractionWithId(ID, buffer.Bytes()); err != nil {
+						err := h.options.addInteractionWithId(ID, buffer.Bytes())
+						if err != nil && err != errStorageShed {
 							gologger.Warning().Msgf("Could not store root tld smtp interaction: %s\n", err)
 						}
+						if err != errStorageShed {
+							h.options.publishInteraction(ID, interaction, buffer.Bytes())
+						}
 					}
 				}
 			}
@@ -154,9 +158,13 @@ func (h *SMTPServer) defaultHandler(remoteAddr net.Addr, from string, to []strin
 			gologger.Warning().Msgf("Could not encode smtp interaction: %s\n", err)
 		} else {
 			gologger.Debug().Msgf("%s\n", buffer.String())
-			if err := h.options.Storage.AddInteraction(correlationID, buffer.Bytes()); err != nil {
+			err := h.options.addInteraction(correlationID, buffer.Bytes())
+			if err != nil && err != errStorageShed {
 				gologger.Warning().Msgf("Could not store smtp interaction: %s\n", err)
 			}
+			if err != errStorageShed {
+				h.options.publishInteraction(correlationID, interaction, buffer.Bytes())
+			}
 		}
 	}
 	return nil
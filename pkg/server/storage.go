@@ -0,0 +1,113 @@
+package server
+
+import (
+	"sync/atomic"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+)
+
+// errStorageShed is returned for the interactions shed over the storage write
+// limit, which are not published to the sinks either.
+var errStorageShed = errors.New("storage write limit exceeded")
+
+// addInteraction stores an interaction for the correlation ID unless shed
+func (options *Options) addInteraction(correlationID string, data []byte) error {
+	if !options.allowStorageWrite() {
+		return errStorageShed
+	}
+	err := options.Storage.AddInteraction(correlationID, data)
+	options.recordStorageWrite(data, err)
+	options.mirror("add interaction", func(secondary storage.Storage) error {
+		return secondary.AddInteraction(correlationID, data)
+	})
+	return err
+}
+
+// addInteractionWithId stores an interaction for the id bucket unless shed
+func (options *Options) addInteractionWithId(id string, data []byte) error {
+	if !options.allowStorageWrite() {
+		return errStorageShed
+	}
+	return options.addPriorityInteractionWithId(id, data)
+}
+
+// addPriorityInteractionWithId stores an interaction for the id bucket regardless of the write limit
+func (options *Options) addPriorityInteractionWithId(id string, data []byte) error {
+	err := options.Storage.AddInteractionWithId(id, data)
+	options.recordStorageWrite(data, err)
+	options.mirror("add interaction", func(secondary storage.Storage) error {
+		return secondary.AddInteractionWithId(id, data)
+	})
+	return err
+}
+
+// recordStorageWrite counts a write to the primary storage by the protocol of the interaction
+func (options *Options) recordStorageWrite(data []byte, err error) {
+	if options.Stats == nil {
+		return
+	}
+	options.Stats.StorageWrites.Record(jsoniter.Get(data, "protocol").ToString(), err)
+}
+
+// setIDPublicKey registers the correlation ID in the primary and secondary storages
+func (options *Options) setIDPublicKey(correlationID, secretKey, publicKey string) error {
+	if err := options.Storage.SetIDPublicKey(correlationID, secretKey, publicKey); err != nil {
+		return err
+	}
+	options.mirror("register", func(secondary storage.Storage) error {
+		return secondary.SetIDPublicKey(correlationID, secretKey, publicKey)
+	})
+	return nil
+}
+
+// removeID deregisters the correlation ID from the primary and secondary storages
+func (options *Options) removeID(correlationID, secretKey string) error {
+	if err := options.Storage.RemoveID(correlationID, secretKey); err != nil {
+		return err
+	}
+	options.mirror("deregister", func(secondary storage.Storage) error {
+		return secondary.RemoveID(correlationID, secretKey)
+	})
+	return nil
+}
+
+// SetStorageID creates an unencrypted id bucket in the primary and secondary storages
+func (options *Options) SetStorageID(id string) error {
+	if err := options.Storage.SetID(id); err != nil {
+		return err
+	}
+	options.mirror("set id", func(secondary storage.Storage) error {
+		return secondary.SetID(id)
+	})
+	return nil
+}
+
+// StatsForID returns the number of interactions stored for a correlation ID
+// and the time of the last one, without polling them.
+func (options *Options) StatsForID(correlationID string) (int, time.Time, error) {
+	return options.Storage.StatsForID(correlationID)
+}
+
+// mirror runs op against the secondary storage if any. Failures are
+// logged and counted but never affect the primary storage.
+func (options *Options) mirror(op string, fn func(secondary storage.Storage) error) {
+	if options.SecondaryStorage == nil {
+		return
+	}
+	start := time.Now()
+	err := fn(options.SecondaryStorage)
+	if options.Stats != nil {
+		atomic.AddUint64(&options.Stats.SecondaryStorage.Writes, 1)
+		atomic.StoreInt64(&options.Stats.SecondaryStorage.LastLatencyMicros, time.Since(start).Microseconds())
+	}
+	if err != nil {
+		if options.Stats != nil {
+			atomic.AddUint64(&options.Stats.SecondaryStorage.Errors, 1)
+		}
+		gologger.Warning().Msgf("Could not %s in secondary storage: %s\n", op, err)
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/projectdiscovery/interactsh/pkg/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecondaryStorage(t *testing.T) {
+	primary, err := storage.New(&storage.Options{})
+	require.Nil(t, err, "could not create primary storage")
+	secondary, err := storage.New(&storage.Options{})
+	require.Nil(t, err, "could not create secondary storage")
+	options := &Options{Storage: primary, SecondaryStorage: secondary, Stats: &Metrics{}}
+
+	require.Nil(t, options.SetStorageID("bucket"))
+	require.Nil(t, options.addInteractionWithId("bucket", []byte("interaction")))
+	for _, store := range []storage.Storage{primary, secondary} {
+		item, err := store.GetCacheItem("bucket")
+		require.Nil(t, err)
+		require.Equal(t, []string{"interaction"}, item.Data, "could not mirror interaction")
+	}
+	require.Equal(t, uint64(2), options.Stats.SecondaryStorage.Writes, "could not count secondary writes")
+
+	require.Nil(t, primary.SetID("primary-only"))
+	require.Nil(t, options.addInteractionWithId("primary-only", []byte("interaction")), "could not ignore secondary failure")
+	require.Equal(t, uint64(1), options.Stats.SecondaryStorage.Errors, "could not count secondary errors")
+}
+
+func TestStorageWriteMetrics(t *testing.T) {
+	store, err := storage.New(&storage.Options{})
+	require.Nil(t, err, "could not create storage")
+	options := &Options{Storage: store, Stats: &Metrics{}}
+
+	require.Nil(t, options.SetStorageID("bucket"))
+	require.Nil(t, options.addInteractionWithId("bucket", []byte(`{"protocol":"dns"}`)))
+	require.NotNil(t, options.addInteractionWithId("missing", []byte(`{"protocol":"dns"}`)))
+	require.NotNil(t, options.addInteraction("missing", []byte(`{"protocol":"http"}`)))
+
+	require.Equal(t, map[string]StorageWriteMetrics{
+		"dns":  {Writes: 1, Errors: 1},
+		"http": {Errors: 1},
+	}, options.Stats.StorageWrites.Snapshot(), "could not count writes by protocol")
+}
+
+func TestStorageShed(t *testing.T) {
+	store, err := storage.New(&storage.Options{})
+	require.Nil(t, err, "could not create storage")
+	options := &Options{Storage: store, StorageWriteLimiter: NewWriteLimiter(1)}
+
+	require.Nil(t, options.SetStorageID("bucket"))
+	require.Nil(t, options.addInteractionWithId("bucket", []byte("stored")))
+	require.Equal(t, errStorageShed, options.addInteractionWithId("bucket", []byte("shed")), "could not report shed write")
+	item, err := store.GetCacheItem("bucket")
+	require.Nil(t, err)
+	require.Equal(t, []string{"stored"}, item.Data, "could not shed interaction")
+}
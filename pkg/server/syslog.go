@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+const (
+	// syslogBufferSize is the number of messages buffered before dropping
+	syslogBufferSize = 4096
+	// syslogTimeout bounds the connection and each write to the syslog server
+	syslogTimeout = 5 * time.Second
+	// syslogSeverity is the informational severity of the interaction messages
+	syslogSeverity = 6
+)
+
+// syslogFacilities are the facility codes by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// SyslogWriter sends a one-line RFC 5424 summary of the interactions to a
+// syslog server from a single goroutine, reconnecting on failure. Messages
+// are dropped when the buffer is full or the server can not be reached.
+type SyslogWriter struct {
+	network  string
+	address  string
+	priority int
+	hostname string
+	conn     net.Conn
+	messages chan string
+	wg       sync.WaitGroup
+	// mu guards the messages against the interactions logged after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewSyslogWriter returns a writer for address, given as [udp|tcp|unix]://address
+// (udp if the scheme is omitted), and facility, given as a name or a code.
+func NewSyslogWriter(address, facility string) (*SyslogWriter, error) {
+	network, addr, ok := strings.Cut(address, "://")
+	if !ok {
+		network, addr = "udp", address
+	}
+	switch network {
+	case "udp", "tcp", "unix":
+	default:
+		return nil, errors.Errorf("unsupported syslog network %s", network)
+	}
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		var err error
+		if code, err = strconv.Atoi(facility); err != nil || code < 0 || code > 23 {
+			return nil, errors.Errorf("invalid syslog facility %s", facility)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	writer := &SyslogWriter{
+		network:  network,
+		address:  addr,
+		priority: code*8 + syslogSeverity,
+		hostname: hostname,
+		messages: make(chan string, syslogBufferSize),
+	}
+	writer.wg.Add(1)
+	go writer.run()
+	return writer, nil
+}
+
+// Log queues the summary of interaction and returns false if it was dropped
+func (s *SyslogWriter) Log(interaction *Interaction) bool {
+	summary := fmt.Sprintf("protocol=%s unique-id=%s remote-address=%s", interaction.Protocol, interaction.UniqueID, interaction.RemoteAddress)
+	if interaction.QType != "" {
+		summary += " q-type=" + interaction.QType
+	}
+	timestamp := interaction.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	message := fmt.Sprintf("<%d>1 %s %s interactsh %d interaction - %s", s.priority, timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"), s.hostname, os.Getpid(), summary)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.messages <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close sends the queued messages and closes the connection
+func (s *SyslogWriter) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.messages)
+	s.mu.Unlock()
+	s.wg.Wait()
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+}
+
+func (s *SyslogWriter) run() {
+	defer s.wg.Done()
+
+	connected := true
+	for message := range s.messages {
+		// retry once on a fresh connection as stream connections break silently
+		var err error
+		for attempt := 0; attempt < 2; attempt++ {
+			if err = s.write(message); err == nil {
+				break
+			}
+		}
+		if err != nil && connected {
+			gologger.Warning().Msgf("Could not write to syslog: %s\n", err)
+		}
+		connected = err == nil
+	}
+}
+
+func (s *SyslogWriter) write(message string) error {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if s.network == "tcp" {
+		message += "\n"
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	if _, err := s.conn.Write([]byte(message)); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return errors.Wrap(err, "could not write syslog message")
+	}
+	return nil
+}
+
+func (s *SyslogWriter) dial() (net.Conn, error) {
+	if s.network == "unix" {
+		// local syslog daemons usually listen on datagram sockets
+		if conn, err := net.DialTimeout("unixgram", s.address, syslogTimeout); err == nil {
+			return conn, nil
+		}
+	}
+	conn, err := net.DialTimeout(s.network, s.address, syslogTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to syslog")
+	}
+	return conn, nil
+}
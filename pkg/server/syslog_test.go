@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSyslogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	writer, err := NewSyslogWriter("udp://"+conn.LocalAddr().String(), "local1")
+	require.Nil(t, err)
+	defer writer.Close()
+	require.True(t, writer.Log(&Interaction{Protocol: "dns", UniqueID: "test", RemoteAddress: "127.0.0.1", QType: "A"}))
+
+	buffer := make([]byte, 1024)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buffer)
+	require.Nil(t, err, "could not receive syslog message")
+	message := string(buffer[:n])
+	require.True(t, strings.HasPrefix(message, "<142>1 "), "could not set priority of local1 info")
+	require.True(t, strings.HasSuffix(message, " interaction - protocol=dns unique-id=test remote-address=127.0.0.1 q-type=A"), "could not write summary")
+
+	// interactions arriving on shutdown are dropped
+	writer.Close()
+	require.False(t, writer.Log(&Interaction{Protocol: "http"}), "could not drop interaction after close")
+
+	_, err = NewSyslogWriter("http://127.0.0.1:514", "local0")
+	require.NotNil(t, err, "could not reject unsupported network")
+	_, err = NewSyslogWriter("127.0.0.1:514", "local9")
+	require.NotNil(t, err, "could not reject invalid facility")
+}
@@ -1,10 +1,18 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
+	"github.com/pkg/errors"
 	"github.com/rs/xid"
 )
 
@@ -17,6 +25,11 @@ func (options *Options) isCorrelationID(s string) bool {
 		return true
 	}
 
+	if options.CorrelationIdAlphabet != "" {
+		// trimming the alphabet leaves nothing of ids made of its characters only
+		return len(s) == options.GetIdLength() && strings.Trim(s, options.CorrelationIdAlphabet) == ""
+	}
+
 	if len(s) == options.GetIdLength() && govalidator.IsAlphanumeric(s) {
 		// xid should be 12
 		if options.CorrelationIdLength != 12 {
@@ -27,3 +40,114 @@ func (options *Options) isCorrelationID(s string) bool {
 	}
 	return false
 }
+
+// ValidateCorrelationID checks that the correlation id lengths along with the
+// CorrelationIdAlphabet, if any, can form the ids accepted by the server.
+func (options *Options) ValidateCorrelationID() error {
+	if options.CorrelationIdLength <= 0 || options.CorrelationIdNonceLength < 0 {
+		return errors.Errorf("invalid correlation id length %d and nonce length %d", options.CorrelationIdLength, options.CorrelationIdNonceLength)
+	}
+	alphabet := options.CorrelationIdAlphabet
+	if alphabet == "" {
+		return nil
+	}
+	seen := make(map[rune]struct{}, len(alphabet))
+	for _, c := range alphabet {
+		// ids are lowercased as resolvers randomize the casing of the names
+		if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+			return errors.Errorf("invalid correlation id alphabet character %q, only lowercase letters, digits and dashes are supported", c)
+		}
+		if strings.ContainsRune(options.correlationIdSeparators(), c) {
+			return errors.Errorf("correlation id alphabet character %q is a correlation id separator", c)
+		}
+		if _, ok := seen[c]; ok {
+			return errors.Errorf("duplicate correlation id alphabet character %q", c)
+		}
+		seen[c] = struct{}{}
+	}
+	if len(seen) < 2 {
+		return errors.New("correlation id alphabet needs at least two characters")
+	}
+	if options.GetIdLength() == 8 && strings.Trim(alphabet, "abcdef0123456789") == "" {
+		return errors.New("hex correlation ids of 8 characters are never matched")
+	}
+	return nil
+}
+
+// correlationIdSeparators returns the characters splitting the labels into
+// the parts checked for correlation ids
+func (options *Options) correlationIdSeparators() string {
+	if options.CorrelationIdSeparators == "" {
+		return defaultCorrelationIdSeparators
+	}
+	return options.CorrelationIdSeparators
+}
+
+// signedLabelLength is the number of hex characters of a label signature
+const signedLabelLength = 16
+
+// SignLabel returns the signature of a correlation id keyed by the server token,
+// to be used in labels of the <id>-<signature> form when SignedLabels is enabled.
+func SignLabel(id, token string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(strings.ToLower(id)))
+	return hex.EncodeToString(mac.Sum(nil))[:signedLabelLength]
+}
+
+// hasSignedID returns true if s contains id followed by a dash and its valid signature
+func (options *Options) hasSignedID(s, id string) bool {
+	s = strings.ToLower(s)
+	prefix := strings.ToLower(id) + "-"
+	idx := strings.Index(s, prefix)
+	if idx < 0 {
+		return false
+	}
+	signature := s[idx+len(prefix):]
+	if len(signature) > signedLabelLength {
+		signature = signature[:signedLabelLength]
+	}
+	return hmac.Equal([]byte(SignLabel(id, options.Token)), []byte(signature))
+}
+
+// otpLabelPrefix is the prefix of time-based one-time labels (otp-<code>)
+const otpLabelPrefix = "otp-"
+
+// defaultTOTPPeriod is the time step of one-time codes when TOTPPeriod is unset
+const defaultTOTPPeriod = 30 * time.Second
+
+// TOTPCode returns the 6 digits one-time code (RFC 6238) of the time step containing t
+// keyed by the server token, to be used in otp-<code> labels when TOTPLabels is enabled.
+func TOTPCode(token string, t time.Time, period time.Duration) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(t.Unix()/int64(period/time.Second)))
+	mac := hmac.New(sha1.New, []byte(token))
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", code%1000000)
+}
+
+// checkOTPLabel looks for an otp-<code> label in zone and returns whether it
+// was found and whether its code is valid within TOTPSkew time steps.
+func (options *Options) checkOTPLabel(zone string) (found, valid bool) {
+	period := options.TOTPPeriod
+	if period < time.Second {
+		period = defaultTOTPPeriod
+	}
+	now := time.Now()
+	for _, label := range strings.Split(strings.ToLower(zone), ".") {
+		if !strings.HasPrefix(label, otpLabelPrefix) {
+			continue
+		}
+		found = true
+		code := strings.TrimPrefix(label, otpLabelPrefix)
+		for skew := -options.TOTPSkew; skew <= options.TOTPSkew; skew++ {
+			expected := TOTPCode(options.Token, now.Add(time.Duration(skew)*period), period)
+			if hmac.Equal([]byte(expected), []byte(code)) {
+				return true, true
+			}
+		}
+	}
+	return found, false
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/projectdiscovery/gologger"
+)
+
+const (
+	// webhookQueueSize is the number of interactions queued before dropping
+	webhookQueueSize = 1024
+	// webhookTimeout bounds each delivery attempt
+	webhookTimeout = 5 * time.Second
+	// webhookBackoff is the delay before the first retry, doubled on each attempt
+	webhookBackoff = time.Second
+	// webhookCloseTimeout bounds the delivery of the queued interactions on close
+	webhookCloseTimeout = 10 * time.Second
+)
+
+// Webhook posts the encoded interactions to a URL from a single goroutine,
+// retrying failed deliveries with an exponential backoff.
+type Webhook struct {
+	url         string
+	headerName  string
+	headerValue string
+	retries     int
+	backoff     time.Duration
+	client      *http.Client
+	queue       chan []byte
+	done        chan struct{}
+	// mu guards the queue against the deliveries after Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewWebhook returns a webhook posting to url. authHeader is either a
+// "Name: value" header or the value of the Authorization header.
+func NewWebhook(url, authHeader string, retries int) *Webhook {
+	return newWebhook(url, authHeader, retries, webhookBackoff)
+}
+
+func newWebhook(url, authHeader string, retries int, backoff time.Duration) *Webhook {
+	webhook := &Webhook{
+		url:     url,
+		retries: retries,
+		backoff: backoff,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan []byte, webhookQueueSize),
+		done:    make(chan struct{}),
+	}
+	if authHeader != "" {
+		webhook.headerName, webhook.headerValue = "Authorization", authHeader
+		if name, value, ok := strings.Cut(authHeader, ":"); ok && !strings.Contains(name, " ") {
+			webhook.headerName, webhook.headerValue = name, strings.TrimSpace(value)
+		}
+	}
+	go webhook.run()
+	return webhook
+}
+
+// Deliver queues the encoded interaction and returns false if it was dropped
+func (w *Webhook) Deliver(data []byte) bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return false
+	}
+	select {
+	case w.queue <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops queuing interactions and waits for the queued ones to be
+// delivered, giving up after webhookCloseTimeout.
+func (w *Webhook) Close() error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	select {
+	case <-w.done:
+		return nil
+	case <-time.After(webhookCloseTimeout):
+		return errors.New("timed out delivering the queued interactions")
+	}
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+
+	for data := range w.queue {
+		var err error
+		for attempt := 0; attempt <= w.retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(w.backoff << (attempt - 1))
+			}
+			if err = w.post(data); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			gologger.Warning().Msgf("Could not deliver interaction webhook after %d attempts: %s\n", w.retries+1, err)
+		}
+	}
+}
+
+func (w *Webhook) post(data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrap(err, "could not create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.headerName != "" {
+		req.Header.Set(w.headerName, w.headerValue)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not send webhook request")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhook(t *testing.T) {
+	var attempts int32
+	bodies := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "secret", r.Header.Get("X-Api-Key"), "could not send auth header")
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+	}))
+	defer ts.Close()
+
+	webhook := newWebhook(ts.URL, "X-Api-Key: secret", 2, time.Millisecond)
+	require.True(t, webhook.Deliver([]byte(`{"protocol":"dns"}`)), "could not queue interaction")
+	select {
+	case body := <-bodies:
+		require.Equal(t, `{"protocol":"dns"}`, body, "could not deliver interaction")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "could not deliver interaction after retries")
+	}
+	require.Equal(t, int32(3), atomic.LoadInt32(&attempts), "could not retry failed delivery")
+
+	// queued interactions are delivered on close
+	require.True(t, webhook.Deliver([]byte(`{"protocol":"http"}`)))
+	require.Nil(t, webhook.Close(), "could not flush webhook")
+	require.Equal(t, `{"protocol":"http"}`, <-bodies, "could not deliver queued interaction on close")
+	require.False(t, webhook.Deliver([]byte(`{"protocol":"smtp"}`)), "could not drop interaction after close")
+
+	webhook = newWebhook(ts.URL, "Bearer token", 0, time.Millisecond)
+	require.Equal(t, "Authorization", webhook.headerName, "could not default to authorization header")
+	require.Equal(t, "Bearer token", webhook.headerValue)
+}
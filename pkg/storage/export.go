@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Export writes the interactions stored for every id to ExportPath as json
+// lines without removing them, returning the number of interactions written.
+// The evicted ids and interactions are skipped, as are the interactions
+// restored from a snapshot, which are kept encrypted.
+func (s *StorageDB) Export() (int, error) {
+	file, err := os.Create(s.Options.ExportPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not create export file")
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	var count int
+	var exportErr error
+	s.index.Range(func(key, _ interface{}) bool {
+		id := key.(string)
+		item, ok := s.cache.GetIfPresent(id)
+		if !ok {
+			return true
+		}
+		correlationData, ok := item.(*CorrelationData)
+		if !ok {
+			return true
+		}
+		interactions, err := s.exportInteractions(correlationData, id)
+		if err != nil {
+			exportErr = errors.Wrapf(err, "could not export interactions of %s", id)
+			return false
+		}
+		for _, interaction := range interactions {
+			if _, err := writer.WriteString(strings.TrimRight(interaction, "\n") + "\n"); err != nil {
+				exportErr = errors.Wrap(err, "could not write export file")
+				return false
+			}
+			count++
+		}
+		return true
+	})
+	if exportErr != nil {
+		return count, exportErr
+	}
+	return count, errors.Wrap(writer.Flush(), "could not write export file")
+}
+
+// exportInteractions returns the plain interactions of id
+func (s *StorageDB) exportInteractions(correlationData *CorrelationData, id string) ([]string, error) {
+	correlationData.Lock()
+	defer correlationData.Unlock()
+
+	if !s.Options.UseDisk() {
+		correlationData.pruneData(time.Now())
+		return append([]string(nil), correlationData.Data...), nil
+	}
+	data, err := s.db.Get([]byte(id), nil)
+	if errors.Is(err, leveldb.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var interactions []string
+	for _, item := range bytes.Split(data, []byte("\n")) {
+		if len(item) == 0 {
+			continue
+		}
+		plain, err := s.decryptDiskData(correlationData.AESKey, string(item))
+		if err != nil {
+			return nil, err
+		}
+		interactions = append(interactions, string(plain))
+	}
+	return interactions, nil
+}
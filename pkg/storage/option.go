@@ -5,13 +5,41 @@ import "time"
 type Options struct {
 	DbPath      string
 	EvictionTTL time.Duration
-	MaxSize     int
+	// ProtocolEvictionTTL overrides the eviction ttl of the in-memory interactions by protocol
+	ProtocolEvictionTTL map[string]time.Duration
+	MaxSize             int
+	// MaxInteractionsPerID is the number of newest interactions kept per id (0 disables)
+	MaxInteractionsPerID int
+	SnapshotPath         string
+	// ExportPath is the file the interactions are exported to as json lines on shutdown
+	ExportPath string
+	// CompressStorage gzips the disk interactions before encrypting them
+	CompressStorage bool
+	// RedisAddress is the address of the redis server shared by several instances
+	RedisAddress  string
+	RedisPassword string
+	RedisDB       int
 }
 
 func (options *Options) UseDisk() bool {
 	return options.DbPath != ""
 }
 
+// UseSnapshot returns true if the in-memory store is persisted to SnapshotPath
+func (options *Options) UseSnapshot() bool {
+	return options.SnapshotPath != "" && !options.UseDisk()
+}
+
+// trackIDs returns true if the ids are indexed to iterate the store
+func (options *Options) trackIDs() bool {
+	return options.UseSnapshot() || options.ExportPath != ""
+}
+
+// UseRedis returns true if the interactions are stored in redis
+func (options *Options) UseRedis() bool {
+	return options.RedisAddress != ""
+}
+
 var DefaultOptions = Options{
 	MaxSize: 2500000,
 }
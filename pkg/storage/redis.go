@@ -0,0 +1,316 @@
+package storage
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisKeyPrefix namespaces the keys of the redis storage
+	redisKeyPrefix = "interactsh:"
+	// redisTimeout bounds each redis operation
+	redisTimeout = 5 * time.Second
+)
+
+// redis hash fields of an id
+const (
+	redisFieldSecret          = "secret"
+	redisFieldAESKey          = "aes-key"
+	redisFieldAESKeyEncrypted = "aes-key-encrypted"
+	redisFieldCount           = "count"
+	redisFieldLastSeen        = "last-seen"
+)
+
+// RedisStorage is a storage shared by several interactsh instances. Each id
+// is a hash holding its keys along with a list of interactions encrypted
+// with its AES key, both expiring after EvictionTTL without access.
+type RedisStorage struct {
+	Options *Options
+	client  *redis.Client
+	hits    uint64
+	misses  uint64
+	dropped uint64
+}
+
+// NewRedis creates a new redis storage instance for interactsh data.
+func NewRedis(options *Options) (*RedisStorage, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     options.RedisAddress,
+		Password: options.RedisPassword,
+		DB:       options.RedisDB,
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, errors.Wrap(err, "could not connect to redis")
+	}
+	return &RedisStorage{Options: options, client: client}, nil
+}
+
+func redisIDKey(id string) string {
+	return redisKeyPrefix + "id:" + id
+}
+
+func redisDataKey(id string) string {
+	return redisKeyPrefix + "data:" + id
+}
+
+// touch extends the expiry of the keys of id
+func (s *RedisStorage) touch(ctx context.Context, pipe redis.Pipeliner, id string) {
+	if s.Options.EvictionTTL <= 0 {
+		return
+	}
+	pipe.Expire(ctx, redisIDKey(id), s.Options.EvictionTTL)
+	pipe.Expire(ctx, redisDataKey(id), s.Options.EvictionTTL)
+}
+
+// get returns the fields of id, counting the hits and misses
+func (s *RedisStorage) get(ctx context.Context, id string) (map[string]string, error) {
+	fields, err := s.client.HGetAll(ctx, redisIDKey(id)).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get id from redis")
+	}
+	if len(fields) == 0 {
+		atomic.AddUint64(&s.misses, 1)
+		return nil, ErrCorrelationIdNotFound
+	}
+	atomic.AddUint64(&s.hits, 1)
+	return fields, nil
+}
+
+func (s *RedisStorage) GetCacheMetrics() (*CacheMetrics, error) {
+	return &CacheMetrics{
+		HitCount:     atomic.LoadUint64(&s.hits),
+		MissCount:    atomic.LoadUint64(&s.misses),
+		DroppedCount: atomic.LoadUint64(&s.dropped),
+	}, nil
+}
+
+// registerScript claims the secret field of an id and sets its keys in a
+// single step, so that no id exists without its AES key.
+var registerScript = redis.NewScript(`
+if redis.call("HSETNX", KEYS[1], ARGV[1], ARGV[2]) == 0 then
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[3], ARGV[4], ARGV[5], ARGV[6])
+local ttl = tonumber(ARGV[7])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return 1
+`)
+
+// SetIDPublicKey sets the correlation ID and publicKey into redis for further operations.
+func (s *RedisStorage) SetIDPublicKey(correlationID, secretKey, publicKey string) error {
+	aesKey, aesKeyEncrypted, err := newAESKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	// claiming the secret field makes the registration atomic across instances
+	created, err := registerScript.Run(ctx, s.client,
+		[]string{redisIDKey(correlationID), redisDataKey(correlationID)},
+		redisFieldSecret, secretKey,
+		redisFieldAESKey, string(aesKey),
+		redisFieldAESKeyEncrypted, aesKeyEncrypted,
+		s.Options.EvictionTTL.Milliseconds(),
+	).Int()
+	if err != nil {
+		return errors.Wrap(err, "could not set id in redis")
+	}
+	if created == 0 {
+		return errors.New("correlation-id provided already exists")
+	}
+	return nil
+}
+
+// SetID sets an unencrypted id bucket into redis, keeping any existing one.
+func (s *RedisStorage) SetID(ID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, redisIDKey(ID), redisFieldSecret, "")
+		s.touch(ctx, pipe, ID)
+		return nil
+	})
+	return errors.Wrap(err, "could not set id in redis")
+}
+
+// AddInteraction adds an interaction data to the correlation ID after encrypting
+// it with the AES key of the correlation ID.
+func (s *RedisStorage) AddInteraction(correlationID string, data []byte) error {
+	return s.AddInteractionWithId(correlationID, data)
+}
+
+// addScript appends an interaction to the data list of an id if the id
+// still exists with the AES key it was encrypted with, so that a concurrent
+// removal leaves no orphaned list. It returns the length of the list, or -1
+// if the id doesn't exist anymore.
+var addScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 or (redis.call("HGET", KEYS[1], ARGV[2]) or "") ~= ARGV[3] then
+	return -1
+end
+local length = redis.call("RPUSH", KEYS[2], ARGV[1])
+redis.call("HINCRBY", KEYS[1], ARGV[4], 1)
+redis.call("HSET", KEYS[1], ARGV[5], ARGV[6])
+local limit = tonumber(ARGV[7])
+if limit > 0 then
+	redis.call("LTRIM", KEYS[2], -limit, -1)
+end
+local ttl = tonumber(ARGV[8])
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+	redis.call("PEXPIRE", KEYS[2], ttl)
+end
+return length
+`)
+
+// AddInteractionWithId adds an interaction data to the id bucket, encrypted
+// unless the bucket is an unencrypted one.
+func (s *RedisStorage) AddInteractionWithId(id string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	fields, err := s.get(ctx, id)
+	if err != nil {
+		return err
+	}
+	value := string(data)
+	aesKey := fields[redisFieldAESKey]
+	if aesKey != "" {
+		if value, err = AESEncrypt([]byte(aesKey), data); err != nil {
+			return errors.Wrap(err, "could not encrypt event data")
+		}
+	}
+	length, err := addScript.Run(ctx, s.client,
+		[]string{redisIDKey(id), redisDataKey(id)},
+		value,
+		redisFieldAESKey, aesKey,
+		redisFieldCount,
+		redisFieldLastSeen, time.Now().UnixNano(),
+		s.Options.MaxInteractionsPerID,
+		s.Options.EvictionTTL.Milliseconds(),
+	).Int64()
+	if err != nil {
+		return errors.Wrap(err, "could not add interaction to redis")
+	}
+	if length < 0 {
+		// the id was removed or registered again since read
+		return ErrCorrelationIdNotFound
+	}
+	if limit := int64(s.Options.MaxInteractionsPerID); limit > 0 && length > limit {
+		atomic.AddUint64(&s.dropped, uint64(length-limit))
+	}
+	return nil
+}
+
+// StatsForID returns the number of interactions added to a correlation ID
+// since its registration and the time of the last one, without polling them.
+func (s *RedisStorage) StatsForID(correlationID string) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	fields, err := s.get(ctx, correlationID)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	count, _ := strconv.Atoi(fields[redisFieldCount])
+	var lastSeen time.Time
+	if nanos, err := strconv.ParseInt(fields[redisFieldLastSeen], 10, 64); err == nil {
+		lastSeen = time.Unix(0, nanos)
+	}
+	return count, lastSeen, nil
+}
+
+// GetInteractions returns the interactions for a correlationID and removes
+// them from the storage. It also returns AES Encrypted Key for the IDs.
+func (s *RedisStorage) GetInteractions(correlationID, secret string) ([]string, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	fields, err := s.get(ctx, correlationID)
+	if err != nil {
+		return nil, "", err
+	}
+	if !strings.EqualFold(fields[redisFieldSecret], secret) {
+		return nil, "", errors.New("invalid secret key passed for user")
+	}
+	data, err := s.popInteractions(ctx, correlationID)
+	return data, fields[redisFieldAESKeyEncrypted], err
+}
+
+// GetInteractionsWithId returns the interactions for a id and removes them from the storage
+func (s *RedisStorage) GetInteractionsWithId(id string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if _, err := s.get(ctx, id); err != nil {
+		return nil, errors.New("could not get id from cache")
+	}
+	return s.popInteractions(ctx, id)
+}
+
+// popInteractions atomically reads and removes the interactions of id
+func (s *RedisStorage) popInteractions(ctx context.Context, id string) ([]string, error) {
+	var data *redis.StringSliceCmd
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		data = pipe.LRange(ctx, redisDataKey(id), 0, -1)
+		pipe.Del(ctx, redisDataKey(id))
+		s.touch(ctx, pipe, id)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get interactions from redis")
+	}
+	if len(data.Val()) == 0 {
+		return nil, nil
+	}
+	return data.Val(), nil
+}
+
+// RemoveID removes data for a correlation ID and data related to it.
+func (s *RedisStorage) RemoveID(correlationID, secret string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	fields, err := s.get(ctx, correlationID)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(fields[redisFieldSecret], secret) {
+		return errors.New("invalid secret key passed for deregister")
+	}
+	return errors.Wrap(s.client.Del(ctx, redisIDKey(correlationID), redisDataKey(correlationID)).Err(), "could not remove id from redis")
+}
+
+// GetCacheItem returns an item as is, without removing its interactions
+func (s *RedisStorage) GetCacheItem(token string) (*CorrelationData, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	fields, err := s.get(ctx, token)
+	if err != nil {
+		return nil, errors.New("cache item not found")
+	}
+	data, err := s.client.LRange(ctx, redisDataKey(token), 0, -1).Result()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get interactions from redis")
+	}
+	value := &CorrelationData{
+		Data:            data,
+		SecretKey:       fields[redisFieldSecret],
+		AESKeyEncrypted: fields[redisFieldAESKeyEncrypted],
+	}
+	if aesKey := fields[redisFieldAESKey]; aesKey != "" {
+		value.AESKey = []byte(aesKey)
+	}
+	return value, nil
+}
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
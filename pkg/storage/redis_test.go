@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/google/uuid"
+	"github.com/rs/xid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedisStorage(t *testing.T) {
+	server := miniredis.RunT(t)
+	options := &Options{EvictionTTL: time.Hour, RedisAddress: server.Addr()}
+	first, err := NewRedis(options)
+	require.Nil(t, err)
+	defer first.Close()
+	// a second instance shares the interactions of the first one
+	second, err := NewRedis(options)
+	require.Nil(t, err)
+	defer second.Close()
+
+	secret := uuid.New().String()
+	correlationID := xid.New().String()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "could not generate rsa key")
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(priv.Public())
+	require.Nil(t, err, "could not marshal public key")
+	encoded := base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pubkeyBytes}))
+
+	require.Nil(t, first.SetIDPublicKey(correlationID, secret, encoded), "could not register correlation-id")
+	require.NotEmpty(t, server.HGet(redisIDKey(correlationID), redisFieldAESKey), "could not set aes key on registration")
+	require.NotNil(t, second.SetIDPublicKey(correlationID, secret, encoded), "could not reject registered correlation-id")
+	require.Nil(t, second.AddInteraction(correlationID, []byte("interaction")), "could not add interaction from second instance")
+	require.Equal(t, time.Hour, server.TTL(redisIDKey(correlationID)), "could not expire id after eviction ttl")
+
+	_, _, err = first.GetInteractions(correlationID, "wrong")
+	require.NotNil(t, err, "could not reject invalid secret")
+	data, key, err := first.GetInteractions(correlationID, secret)
+	require.Nil(t, err, "could not get interactions")
+	require.Len(t, data, 1, "could not get interaction of second instance")
+	require.NotEqual(t, "interaction", data[0], "could not encrypt interaction")
+	require.NotEmpty(t, key, "could not get aes key")
+	data, _, err = first.GetInteractions(correlationID, secret)
+	require.Nil(t, err)
+	require.Empty(t, data, "could not remove polled interactions")
+
+	require.Nil(t, first.SetID("token"))
+	require.Nil(t, second.AddInteractionWithId("token", []byte("interaction")))
+	data, err = first.GetInteractionsWithId("token")
+	require.Nil(t, err)
+	require.Equal(t, []string{"interaction"}, data, "could not store id bucket interactions unencrypted")
+	count, last, err := first.StatsForID("token")
+	require.Nil(t, err)
+	require.Equal(t, 1, count, "could not count interactions")
+	require.False(t, last.IsZero(), "could not get last interaction time")
+
+	capped, err := NewRedis(&Options{EvictionTTL: time.Hour, RedisAddress: server.Addr(), MaxInteractionsPerID: 1})
+	require.Nil(t, err)
+	defer capped.Close()
+	require.Nil(t, capped.AddInteractionWithId("token", []byte("first")))
+	require.Nil(t, capped.AddInteractionWithId("token", []byte("second")))
+	data, err = capped.GetInteractionsWithId("token")
+	require.Nil(t, err)
+	require.Equal(t, []string{"second"}, data, "could not keep newest interaction")
+
+	// interactions encrypted with the key of a replaced registration are rejected
+	length, err := addScript.Run(context.Background(), first.client,
+		[]string{redisIDKey(correlationID), redisDataKey(correlationID)},
+		"interaction", redisFieldAESKey, "stale", redisFieldCount, redisFieldLastSeen, 0, 0, 0,
+	).Int64()
+	require.Nil(t, err)
+	require.Equal(t, int64(-1), length, "could not reject interaction of stale key")
+
+	require.Nil(t, first.RemoveID(correlationID, secret), "could not remove correlation-id")
+	require.ErrorIs(t, second.AddInteraction(correlationID, []byte("interaction")), ErrCorrelationIdNotFound)
+	require.False(t, server.Exists(redisDataKey(correlationID)), "could not avoid orphaned interactions")
+}
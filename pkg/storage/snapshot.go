@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	fileutil "github.com/projectdiscovery/utils/file"
+)
+
+// snapshotEntry is the serialized form of a correlation-id in the snapshot
+// file. Neither the secret key, only kept hashed, nor the AES key is written,
+// the interactions being encrypted with the AES key as returned to the client.
+type snapshotEntry struct {
+	ID            string `json:"id"`
+	SecretKeyHash string `json:"secret-key-hash,omitempty"`
+	PublicKey     string `json:"public-key,omitempty"`
+	// Batches are the interactions grouped by AES key, plain for the
+	// unencrypted id buckets
+	Batches    []sealedBatch `json:"batches,omitempty"`
+	LastAccess int64         `json:"last-access"`
+	Count      int           `json:"count,omitempty"`
+	LastSeen   time.Time     `json:"last-seen,omitempty"`
+}
+
+// touch records the access time of id for the snapshot and the export
+func (s *StorageDB) touch(id string) {
+	if !s.Options.trackIDs() {
+		return
+	}
+	now := time.Now().UnixNano()
+	if lastAccess, ok := s.index.Load(id); ok {
+		atomic.StoreInt64(lastAccess.(*int64), now)
+		return
+	}
+	s.index.Store(id, &now)
+}
+
+// writeSnapshot serializes the in-memory store to the snapshot path
+func (s *StorageDB) writeSnapshot() error {
+	var entries []snapshotEntry
+	var snapshotErr error
+	s.index.Range(func(key, value interface{}) bool {
+		id := key.(string)
+		item, ok := s.cache.GetIfPresent(id)
+		if !ok {
+			return true
+		}
+		correlationData, ok := item.(*CorrelationData)
+		if !ok {
+			return true
+		}
+		correlationData.Lock()
+		entry, err := newSnapshotEntry(id, correlationData, time.Now())
+		correlationData.Unlock()
+		if err != nil {
+			snapshotErr = errors.Wrapf(err, "could not encrypt interactions of %s", id)
+			return false
+		}
+		entry.LastAccess = atomic.LoadInt64(value.(*int64))
+		entries = append(entries, entry)
+		return true
+	})
+	if snapshotErr != nil {
+		return snapshotErr
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return errors.Wrap(err, "could not encode snapshot")
+	}
+	tmpPath := s.Options.SnapshotPath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return errors.Wrap(err, "could not write snapshot")
+	}
+	return os.Rename(tmpPath, s.Options.SnapshotPath)
+}
+
+// newSnapshotEntry returns the snapshot entry of the locked correlationData,
+// its pending interactions being encrypted with its AES key.
+func newSnapshotEntry(id string, correlationData *CorrelationData, now time.Time) (snapshotEntry, error) {
+	entry := snapshotEntry{
+		ID:            id,
+		SecretKeyHash: correlationData.secretKeyHash,
+		PublicKey:     correlationData.publicKey,
+		Count:         correlationData.count,
+		LastSeen:      correlationData.lastSeen,
+	}
+	if correlationData.SecretKey != "" {
+		entry.SecretKeyHash = hashSecretKey(correlationData.SecretKey)
+	}
+	for i := range correlationData.sealed {
+		batch := &correlationData.sealed[i]
+		if batch.Data, batch.Expiries = pruneExpired(batch.Data, batch.Expiries, now); len(batch.Data) > 0 {
+			entry.Batches = append(entry.Batches, *batch)
+		}
+	}
+
+	correlationData.pruneData(now)
+	if len(correlationData.Data) == 0 {
+		return entry, nil
+	}
+	batch := sealedBatch{
+		AESKeyEncrypted: correlationData.AESKeyEncrypted,
+		Data:            append([]string(nil), correlationData.Data...),
+		Expiries:        append([]time.Time(nil), correlationData.expiries...),
+	}
+	// the unencrypted id buckets are returned as is to the pollers
+	if correlationData.AESKey != nil {
+		for i, item := range batch.Data {
+			ct, err := AESEncrypt(correlationData.AESKey, []byte(item))
+			if err != nil {
+				return entry, err
+			}
+			batch.Data[i] = ct
+		}
+	}
+	entry.Batches = append(entry.Batches, batch)
+	return entry, nil
+}
+
+// loadSnapshot restores the in-memory store from the snapshot path, dropping
+// the entries which would have been evicted in the meantime. The restored ids
+// get a new AES key, their restored interactions being returned first with
+// the key they are encrypted with.
+func (s *StorageDB) loadSnapshot() (int, error) {
+	if !fileutil.FileExists(s.Options.SnapshotPath) {
+		return 0, nil
+	}
+	data, err := os.ReadFile(s.Options.SnapshotPath)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not read snapshot")
+	}
+	var entries []snapshotEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return 0, errors.Wrap(err, "could not decode snapshot")
+	}
+
+	var loaded int
+	now := time.Now()
+	for _, entry := range entries {
+		remaining := s.Options.EvictionTTL - now.Sub(time.Unix(0, entry.LastAccess))
+		if s.Options.EvictionTTL > 0 && remaining <= 0 {
+			continue
+		}
+		correlationData := &CorrelationData{
+			secretKeyHash: entry.SecretKeyHash,
+			publicKey:     entry.PublicKey,
+			count:         entry.Count,
+			lastSeen:      entry.LastSeen,
+		}
+		if entry.PublicKey != "" {
+			aesKey, aesKeyEncrypted, err := newAESKey(entry.PublicKey)
+			if err != nil {
+				return loaded, errors.Wrapf(err, "could not restore %s", entry.ID)
+			}
+			correlationData.AESKey, correlationData.AESKeyEncrypted = aesKey, aesKeyEncrypted
+			correlationData.sealed = entry.Batches
+		} else {
+			for _, batch := range entry.Batches {
+				for i, item := range batch.Data {
+					var deadline time.Time
+					if len(batch.Expiries) == len(batch.Data) {
+						deadline = batch.Expiries[i]
+					}
+					correlationData.appendData(item, deadline)
+				}
+			}
+			correlationData.pruneData(now)
+		}
+		s.cache.Put(entry.ID, correlationData)
+		accessTime := entry.LastAccess
+		s.index.Store(entry.ID, &accessTime)
+		if s.Options.EvictionTTL > 0 {
+			s.expireRestored(entry.ID, &accessTime, remaining)
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// expireRestored evicts a restored id once the rest of its eviction window
+// elapsed, the cache having restarted it on load, unless accessed meanwhile.
+func (s *StorageDB) expireRestored(id string, lastAccess *int64, remaining time.Duration) {
+	restored := atomic.LoadInt64(lastAccess)
+	time.AfterFunc(remaining, func() {
+		current, ok := s.index.Load(id)
+		if ok && current.(*int64) == lastAccess && atomic.LoadInt64(lastAccess) == restored {
+			s.cache.Invalidate(id)
+		}
+	})
+}
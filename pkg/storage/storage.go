@@ -1,6 +1,8 @@
 // storage defines a storage mechanism
 package storage
 
+import "time"
+
 type Storage interface {
 	GetCacheMetrics() (*CacheMetrics, error)
 	SetIDPublicKey(correlationID, secretKey, publicKey string) error
@@ -11,5 +13,6 @@ type Storage interface {
 	GetInteractionsWithId(id string) ([]string, error)
 	RemoveID(correlationID, secret string) error
 	GetCacheItem(token string) (*CorrelationData, error)
+	StatsForID(correlationID string) (int, time.Time, error)
 	Close() error
 }
@@ -10,9 +10,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/goburrow/cache"
 	"github.com/google/uuid"
+	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
 	fileutil "github.com/projectdiscovery/utils/file"
 	permissionutil "github.com/projectdiscovery/utils/permission"
@@ -29,6 +33,10 @@ type StorageDB struct {
 	cache   cache.Cache
 	db      *leveldb.DB
 	dbpath  string
+	// index tracks the stored ids and their last access for snapshots
+	index sync.Map
+	// dropped counts the interactions dropped over MaxInteractionsPerID
+	dropped uint64
 }
 
 // New creates a new storage instance for interactsh data.
@@ -40,7 +48,7 @@ func New(options *Options) (*StorageDB, error) {
 	if options.EvictionTTL > 0 {
 		cacheOptions = append(cacheOptions, cache.WithExpireAfterAccess(options.EvictionTTL))
 	}
-	if options.UseDisk() {
+	if options.UseDisk() || options.trackIDs() {
 		cacheOptions = append(cacheOptions, cache.WithRemovalListener(storageDB.OnCacheRemovalCallback))
 	}
 	cacheDb := cache.New(cacheOptions...)
@@ -64,11 +72,20 @@ func New(options *Options) (*StorageDB, error) {
 		storageDB.db = levDb
 	}
 
+	if options.UseSnapshot() {
+		if _, err := storageDB.loadSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+
 	return storageDB, nil
 }
 
 func (s *StorageDB) OnCacheRemovalCallback(key cache.Key, value cache.Value) {
-	if key, ok := value.([]byte); ok {
+	if id, ok := key.(string); ok {
+		s.index.Delete(id)
+	}
+	if key, ok := value.([]byte); ok && s.db != nil {
 		_ = s.db.Delete(key, &opt.WriteOptions{})
 	}
 }
@@ -84,6 +101,7 @@ func (s *StorageDB) GetCacheMetrics() (*CacheMetrics, error) {
 		LoadErrorCount:   info.LoadErrorCount,
 		TotalLoadTime:    info.TotalLoadTime,
 		EvictionCount:    info.EvictionCount,
+		DroppedCount:     atomic.LoadUint64(&s.dropped),
 	}
 
 	return cacheMetrics, nil
@@ -96,29 +114,47 @@ func (s *StorageDB) SetIDPublicKey(correlationID, secretKey, publicKey string) e
 	if found {
 		return errors.New("correlation-id provided already exists")
 	}
-	publicKeyData, err := ParseB64RSAPublicKeyFromPEM(publicKey)
-	if err != nil {
-		return errors.Wrap(err, "could not read public Key")
-	}
-	aesKey := uuid.New().String()[:32]
-
-	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKeyData, []byte(aesKey), []byte(""))
+	aesKey, aesKeyEncrypted, err := newAESKey(publicKey)
 	if err != nil {
-		return errors.New("could not encrypt event data")
+		return err
 	}
 
 	data := &CorrelationData{
 		SecretKey:       secretKey,
-		AESKey:          []byte(aesKey),
-		AESKeyEncrypted: base64.StdEncoding.EncodeToString(ciphertext),
+		AESKey:          aesKey,
+		AESKeyEncrypted: aesKeyEncrypted,
+		publicKey:       publicKey,
 	}
 	s.cache.Put(correlationID, data)
+	s.touch(correlationID)
 	return nil
 }
 
+// newAESKey returns a random AES key along with its encryption with the
+// base64 encoded rsa pem publicKey.
+func newAESKey(publicKey string) ([]byte, string, error) {
+	publicKeyData, err := ParseB64RSAPublicKeyFromPEM(publicKey)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not read public Key")
+	}
+	aesKey := uuid.New().String()[:32]
+
+	ciphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKeyData, []byte(aesKey), []byte(""))
+	if err != nil {
+		return nil, "", errors.New("could not encrypt event data")
+	}
+	return []byte(aesKey), base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// SetID sets an unencrypted id bucket into the cache, keeping any existing one.
 func (s *StorageDB) SetID(ID string) error {
+	if _, found := s.cache.GetIfPresent(ID); found {
+		s.touch(ID)
+		return nil
+	}
 	data := &CorrelationData{}
 	s.cache.Put(ID, data)
+	s.touch(ID)
 	return nil
 }
 
@@ -133,21 +169,21 @@ func (s *StorageDB) AddInteraction(correlationID string, data []byte) error {
 	if !ok {
 		return errors.New("invalid correlation-id cache value found")
 	}
+	s.touch(correlationID)
 
 	if s.Options.UseDisk() {
-		ct, err := AESEncrypt(value.AESKey, data)
+		ct, err := s.encryptDiskData(value.AESKey, data)
 		if err != nil {
 			return errors.Wrap(err, "could not encrypt event data")
 		}
 		value.Lock()
 		existingData, _ := s.db.Get([]byte(correlationID), nil)
-		_ = s.db.Put([]byte(correlationID), AppendMany("\n", existingData, []byte(ct)), nil)
+		_ = s.db.Put([]byte(correlationID), s.trimDiskData(AppendMany("\n", existingData, []byte(ct))), nil)
 		value.Unlock()
 	} else {
-		value.Lock()
-		value.Data = append(value.Data, string(data))
-		value.Unlock()
+		s.appendData(value, data)
 	}
+	value.recordInteraction(time.Now())
 
 	return nil
 }
@@ -162,21 +198,21 @@ func (s *StorageDB) AddInteractionWithId(id string, data []byte) error {
 	if !ok {
 		return errors.New("invalid correlation-id cache value found")
 	}
+	s.touch(id)
 
 	if s.Options.UseDisk() {
-		ct, err := AESEncrypt(value.AESKey, data)
+		ct, err := s.encryptDiskData(value.AESKey, data)
 		if err != nil {
 			return errors.Wrap(err, "could not encrypt event data")
 		}
 		value.Lock()
 		existingData, _ := s.db.Get([]byte(id), nil)
-		_ = s.db.Put([]byte(id), AppendMany("\n", existingData, []byte(ct)), nil)
+		_ = s.db.Put([]byte(id), s.trimDiskData(AppendMany("\n", existingData, []byte(ct))), nil)
 		value.Unlock()
 	} else {
-		value.Lock()
-		value.Data = append(value.Data, string(data))
-		value.Unlock()
+		s.appendData(value, data)
 	}
+	value.recordInteraction(time.Now())
 
 	return nil
 }
@@ -192,9 +228,14 @@ func (s *StorageDB) GetInteractions(correlationID, secret string) ([]string, str
 	if !ok {
 		return nil, "", errors.New("invalid correlation-id cache value found")
 	}
-	if !strings.EqualFold(value.SecretKey, secret) {
+	if !value.checkSecret(secret) {
 		return nil, "", errors.New("invalid secret key passed for user")
 	}
+	s.touch(correlationID)
+	// the interactions restored from a snapshot come first, with their own key
+	if data, aesKeyEncrypted, ok := value.takeSealed(time.Now()); ok {
+		return data, aesKeyEncrypted, nil
+	}
 	data, err := s.getInteractions(value, correlationID)
 	return data, value.AESKeyEncrypted, err
 }
@@ -209,6 +250,7 @@ func (s *StorageDB) GetInteractionsWithId(id string) ([]string, error) {
 	if !ok {
 		return nil, errors.New("invalid id cache value found")
 	}
+	s.touch(id)
 	return s.getInteractions(value, id)
 }
 
@@ -222,13 +264,14 @@ func (s *StorageDB) RemoveID(correlationID, secret string) error {
 	if !ok {
 		return errors.New("invalid correlation-id cache value found")
 	}
-	if !strings.EqualFold(value.SecretKey, secret) {
+	if !value.checkSecret(secret) {
 		return errors.New("invalid secret key passed for deregister")
 	}
 	value.Lock()
-	value.Data = nil
+	value.resetData()
 	value.Unlock()
 	s.cache.Invalidate(correlationID)
+	s.index.Delete(correlationID)
 
 	if s.Options.UseDisk() {
 		return s.db.Delete([]byte(correlationID), nil)
@@ -249,6 +292,110 @@ func (s *StorageDB) GetCacheItem(token string) (*CorrelationData, error) {
 	return value, nil
 }
 
+// StatsForID returns the number of interactions added to a correlation ID
+// since its registration and the time of the last one, without polling them.
+func (s *StorageDB) StatsForID(correlationID string) (int, time.Time, error) {
+	item, ok := s.cache.GetIfPresent(correlationID)
+	if !ok {
+		return 0, time.Time{}, ErrCorrelationIdNotFound
+	}
+	value, ok := item.(*CorrelationData)
+	if !ok {
+		return 0, time.Time{}, errors.New("invalid correlation-id cache value found")
+	}
+	value.Lock()
+	defer value.Unlock()
+	return value.count, value.lastSeen, nil
+}
+
+// appendData stores an in-memory interaction, expiring it after the
+// eviction ttl of its protocol if overridden.
+func (s *StorageDB) appendData(value *CorrelationData, data []byte) {
+	var deadline time.Time
+	now := time.Now()
+	if ttl := s.protocolEvictionTTL(data); ttl > 0 {
+		deadline = now.Add(ttl)
+	}
+	value.Lock()
+	value.pruneData(now)
+	value.appendData(string(data), deadline)
+	dropped := value.trimData(s.Options.MaxInteractionsPerID)
+	value.Unlock()
+	if dropped > 0 {
+		atomic.AddUint64(&s.dropped, uint64(dropped))
+	}
+}
+
+// trimDiskData keeps the newest MaxInteractionsPerID interactions of the
+// newline separated disk data.
+func (s *StorageDB) trimDiskData(data []byte) []byte {
+	limit := s.Options.MaxInteractionsPerID
+	if limit <= 0 || bytes.Count(data, []byte("\n")) < limit {
+		return data
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	dropped := len(lines) - limit
+	atomic.AddUint64(&s.dropped, uint64(dropped))
+	return bytes.Join(lines[dropped:], []byte("\n"))
+}
+
+// protocolEvictionTTL returns the eviction ttl overriding the global one for
+// the protocol of the interaction, 0 if not overridden.
+func (s *StorageDB) protocolEvictionTTL(data []byte) time.Duration {
+	if len(s.Options.ProtocolEvictionTTL) == 0 {
+		return 0
+	}
+	return s.Options.ProtocolEvictionTTL[strings.ToLower(jsoniter.Get(data, "protocol").ToString())]
+}
+
+// compressedDataPrefix marks the disk interactions encrypted once compressed,
+// the base64 of the plain ones never containing it
+const compressedDataPrefix = "gz:"
+
+// encryptDiskData encrypts an interaction stored on disk, compressing it
+// first with CompressStorage.
+func (s *StorageDB) encryptDiskData(aesKey, data []byte) (string, error) {
+	if !s.Options.CompressStorage {
+		return AESEncrypt(aesKey, data)
+	}
+	compressed, err := gzipData(data)
+	if err != nil {
+		return "", err
+	}
+	ct, err := AESEncrypt(aesKey, compressed)
+	if err != nil {
+		return "", err
+	}
+	return compressedDataPrefix + ct, nil
+}
+
+// decompressDiskData returns a disk interaction encrypted as the clients
+// expect it, decompressing the compressed ones whatever CompressStorage.
+func (s *StorageDB) decompressDiskData(aesKey []byte, item string) (string, error) {
+	if !strings.HasPrefix(item, compressedDataPrefix) {
+		return item, nil
+	}
+	data, err := s.decryptDiskData(aesKey, item)
+	if err != nil {
+		return item, err
+	}
+	encrypted, err := AESEncrypt(aesKey, data)
+	if err != nil {
+		return item, err
+	}
+	return encrypted, nil
+}
+
+// decryptDiskData returns the plain data of a disk interaction
+func (s *StorageDB) decryptDiskData(aesKey []byte, item string) ([]byte, error) {
+	ct, compressed := strings.CutPrefix(item, compressedDataPrefix)
+	data, err := AESDecrypt(aesKey, ct)
+	if err != nil || !compressed {
+		return data, err
+	}
+	return gunzipData(data)
+}
+
 func (s *StorageDB) getInteractions(correlationData *CorrelationData, id string) ([]string, error) {
 	correlationData.Lock()
 	defer correlationData.Unlock()
@@ -263,16 +410,22 @@ func (s *StorageDB) getInteractions(correlationData *CorrelationData, id string)
 			return nil, err
 		}
 		var dataString []string
+		var errs []error
 		for _, d := range bytes.Split(data, []byte("\n")) {
-			dataString = append(dataString, string(d))
+			item, err := s.decompressDiskData(correlationData.AESKey, string(d))
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, "could not decompress event data"))
+			}
+			dataString = append(dataString, item)
 		}
 		_ = s.db.Delete([]byte(id), nil)
-		return dataString, nil
+		return dataString, multierr.Combine(errs...)
 	default:
 		// in memory data
 		var errs []error
+		correlationData.pruneData(time.Now())
 		data := correlationData.Data
-		correlationData.Data = nil
+		correlationData.resetData()
 		if len(data) == 0 {
 			return nil, nil
 		}
@@ -291,11 +444,16 @@ func (s *StorageDB) getInteractions(correlationData *CorrelationData, id string)
 }
 
 func (s *StorageDB) Close() error {
+	var errSnapshot error
+	if s.Options.UseSnapshot() {
+		errSnapshot = s.writeSnapshot()
+	}
 	var errdbClosed error
 	if s.db != nil {
 		errdbClosed = s.db.Close()
 	}
 	return multierr.Combine(
+		errSnapshot,
 		s.cache.Close(),
 		errdbClosed,
 		os.RemoveAll(s.dbpath),
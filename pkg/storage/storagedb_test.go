@@ -9,6 +9,8 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
@@ -133,3 +135,217 @@ func doStuffWithOtherCache(cache cache.Cache) {
 		_, _ = cache.GetIfPresent(strconv.Itoa(i))
 	}
 }
+
+func TestStorageSnapshot(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.json")
+
+	mem, err := New(&Options{EvictionTTL: 1 * time.Hour, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	require.Nil(t, mem.SetID("token"))
+	require.Nil(t, mem.AddInteractionWithId("token", []byte("interaction")))
+	require.Nil(t, mem.Close(), "could not close storage")
+
+	restored, err := New(&Options{EvictionTTL: 1 * time.Hour, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	require.Nil(t, restored.SetID("token"))
+	// id buckets have no aes key, so interactions are returned unencrypted
+	data, _ := restored.GetInteractionsWithId("token")
+	require.Equal(t, []string{"interaction"}, data, "could not restore interactions from snapshot")
+	count, _, err := restored.StatsForID("token")
+	require.Nil(t, err)
+	require.Equal(t, 1, count, "could not restore interaction count from snapshot")
+
+	// entries accessed outside the eviction window are dropped on load
+	time.Sleep(10 * time.Millisecond)
+	require.Nil(t, restored.Close(), "could not close storage")
+	expired, err := New(&Options{EvictionTTL: 1 * time.Millisecond, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	_, err = expired.GetCacheItem("token")
+	require.NotNil(t, err, "could not drop expired entry")
+}
+
+func TestStorageSnapshotEncryption(t *testing.T) {
+	snapshotPath := filepath.Join(t.TempDir(), "snapshot.json")
+	priv, publicKey := newTestKeyPair(t)
+
+	mem, err := New(&Options{EvictionTTL: 1 * time.Hour, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	require.Nil(t, mem.SetIDPublicKey("correlation", "Secret", publicKey))
+	item, err := mem.GetCacheItem("correlation")
+	require.Nil(t, err)
+	aesKey := string(item.AESKey)
+	require.Nil(t, mem.AddInteraction("correlation", []byte("before-restart")))
+	require.Nil(t, mem.Close(), "could not close storage")
+
+	snapshot, err := os.ReadFile(snapshotPath)
+	require.Nil(t, err)
+	for _, secret := range []string{"Secret", aesKey, "before-restart"} {
+		require.NotContains(t, string(snapshot), secret, "could not keep snapshot encrypted")
+	}
+
+	restored, err := New(&Options{EvictionTTL: 1 * time.Hour, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	require.Nil(t, restored.AddInteraction("correlation", []byte("after-restart")))
+	_, _, err = restored.GetInteractions("correlation", "wrong")
+	require.NotNil(t, err, "could not check restored secret key")
+	data, aesKeyEncrypted, err := restored.GetInteractions("correlation", "secret")
+	require.Nil(t, err)
+	require.Equal(t, []string{"before-restart"}, decryptTestInteractions(t, priv, data, aesKeyEncrypted), "could not restore interactions with their key")
+	data, aesKeyEncrypted, err = restored.GetInteractions("correlation", "secret")
+	require.Nil(t, err)
+	require.Equal(t, []string{"after-restart"}, decryptTestInteractions(t, priv, data, aesKeyEncrypted), "could not encrypt interactions with a new key")
+	require.Nil(t, restored.Close())
+
+	// restored entries keep the rest of their eviction window
+	time.Sleep(200 * time.Millisecond)
+	shortened, err := New(&Options{EvictionTTL: 400 * time.Millisecond, SnapshotPath: snapshotPath})
+	require.Nil(t, err)
+	_, err = shortened.GetCacheItem("correlation")
+	require.Nil(t, err, "could not restore entry within its eviction window")
+	time.Sleep(300 * time.Millisecond)
+	_, err = shortened.GetCacheItem("correlation")
+	require.NotNil(t, err, "could not evict restored entry after the rest of its window")
+}
+
+func TestStorageStatsForID(t *testing.T) {
+	publicKey := newTestPublicKey(t)
+	for _, diskPath := range []string{"", t.TempDir()} {
+		db, err := New(&Options{EvictionTTL: 1 * time.Hour, DbPath: diskPath})
+		require.Nil(t, err)
+		correlationID := xid.New().String()
+		require.Nil(t, db.SetIDPublicKey(correlationID, "secret", publicKey))
+		count, last, err := db.StatsForID(correlationID)
+		require.Nil(t, err)
+		require.Zero(t, count)
+		require.True(t, last.IsZero(), "could not get zero time without interactions")
+
+		before := time.Now()
+		require.Nil(t, db.AddInteraction(correlationID, []byte("first")))
+		require.Nil(t, db.AddInteraction(correlationID, []byte("second")))
+		_, _, err = db.GetInteractions(correlationID, "secret")
+		require.Nil(t, err)
+		count, last, err = db.StatsForID(correlationID)
+		require.Nil(t, err)
+		require.Equal(t, 2, count, "could not count interactions (disk: %v)", diskPath != "")
+		require.False(t, last.Before(before), "could not get last interaction time")
+
+		_, _, err = db.StatsForID("missing")
+		require.ErrorIs(t, err, ErrCorrelationIdNotFound)
+		require.Nil(t, db.Close())
+	}
+}
+
+func TestStorageProtocolEviction(t *testing.T) {
+	mem, err := New(&Options{EvictionTTL: 1 * time.Hour, ProtocolEvictionTTL: map[string]time.Duration{"dns": 10 * time.Millisecond}})
+	require.Nil(t, err)
+	require.Nil(t, mem.SetID("token"))
+	require.Nil(t, mem.AddInteractionWithId("token", []byte(`{"protocol":"dns"}`)))
+	require.Nil(t, mem.AddInteractionWithId("token", []byte(`{"protocol":"http"}`)))
+
+	time.Sleep(20 * time.Millisecond)
+	data, _ := mem.GetInteractionsWithId("token")
+	require.Equal(t, []string{`{"protocol":"http"}`}, data, "could not evict dns interaction before the global ttl")
+}
+
+func TestStorageMaxInteractionsPerID(t *testing.T) {
+	mem, err := New(&Options{EvictionTTL: 1 * time.Hour, MaxInteractionsPerID: 2})
+	require.Nil(t, err)
+	require.Nil(t, mem.SetID("token"))
+	for _, data := range []string{"first", "second", "third"} {
+		require.Nil(t, mem.AddInteractionWithId("token", []byte(data)))
+	}
+
+	data, _ := mem.GetInteractionsWithId("token")
+	require.Equal(t, []string{"second", "third"}, data, "could not keep newest interactions")
+	metrics, err := mem.GetCacheMetrics()
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), metrics.DroppedCount, "could not count dropped interaction")
+}
+
+func TestStorageCompressDisk(t *testing.T) {
+	db, err := New(&Options{EvictionTTL: 1 * time.Hour, DbPath: t.TempDir(), CompressStorage: true})
+	require.Nil(t, err)
+	defer db.Close()
+
+	correlationID := xid.New().String()
+	require.Nil(t, db.SetIDPublicKey(correlationID, "secret", newTestPublicKey(t)))
+	item, err := db.GetCacheItem(correlationID)
+	require.Nil(t, err)
+
+	// entries written before enabling the compression stay readable
+	db.Options.CompressStorage = false
+	require.Nil(t, db.AddInteraction(correlationID, []byte("plain interaction")))
+	db.Options.CompressStorage = true
+	require.Nil(t, db.AddInteraction(correlationID, []byte("compressed interaction")))
+
+	stored, err := db.db.Get([]byte(correlationID), nil)
+	require.Nil(t, err)
+	require.Contains(t, string(stored), "\n"+compressedDataPrefix, "could not compress interaction")
+
+	data, _, err := db.GetInteractions(correlationID, "secret")
+	require.Nil(t, err)
+	require.Len(t, data, 2)
+	for i, expected := range []string{"plain interaction", "compressed interaction"} {
+		decrypted, err := AESDecrypt(item.AESKey, data[i])
+		require.Nil(t, err, "could not decrypt interaction")
+		require.Equal(t, expected, string(decrypted), "could not read interaction")
+	}
+}
+
+func TestStorageExport(t *testing.T) {
+	for _, dbPath := range []string{"", t.TempDir()} {
+		exportPath := filepath.Join(t.TempDir(), "interactions.ndjson")
+		db, err := New(&Options{EvictionTTL: 1 * time.Hour, DbPath: dbPath, ExportPath: exportPath, ProtocolEvictionTTL: map[string]time.Duration{"dns": time.Nanosecond}})
+		require.Nil(t, err)
+
+		correlationID := xid.New().String()
+		require.Nil(t, db.SetIDPublicKey(correlationID, "secret", newTestPublicKey(t)))
+		require.Nil(t, db.AddInteraction(correlationID, []byte("{\"protocol\":\"http\"}\n")))
+		require.Nil(t, db.AddInteraction(correlationID, []byte("{\"protocol\":\"dns\"}\n")))
+
+		count, err := db.Export()
+		require.Nil(t, err)
+		data, err := os.ReadFile(exportPath)
+		require.Nil(t, err)
+		if dbPath == "" {
+			require.Equal(t, 1, count, "could not skip evicted interaction")
+			require.Equal(t, "{\"protocol\":\"http\"}\n", string(data), "could not export in-memory interactions")
+		} else {
+			require.Equal(t, 2, count)
+			require.Equal(t, "{\"protocol\":\"http\"}\n{\"protocol\":\"dns\"}\n", string(data), "could not export disk interactions")
+		}
+		interactions, _, err := db.GetInteractions(correlationID, "secret")
+		require.Nil(t, err)
+		require.Len(t, interactions, count, "could not keep exported interactions")
+		require.Nil(t, db.Close())
+	}
+}
+
+// newTestPublicKey returns the base64 pem of a new rsa public key
+func newTestPublicKey(t *testing.T) string {
+	_, publicKey := newTestKeyPair(t)
+	return publicKey
+}
+
+func newTestKeyPair(t *testing.T) (*rsa.PrivateKey, string) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err, "could not generate rsa key")
+	pubkeyBytes, err := x509.MarshalPKIXPublicKey(priv.Public())
+	require.Nil(t, err, "could not marshal public key")
+	return priv, base64.StdEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: pubkeyBytes}))
+}
+
+// decryptTestInteractions decrypts the polled interactions with the private key
+func decryptTestInteractions(t *testing.T, priv *rsa.PrivateKey, data []string, aesKeyEncrypted string) []string {
+	ciphertext, err := base64.StdEncoding.DecodeString(aesKeyEncrypted)
+	require.Nil(t, err)
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, ciphertext, nil)
+	require.Nil(t, err, "could not decrypt aes key")
+	var plain []string
+	for _, item := range data {
+		decrypted, err := AESDecrypt(aesKey, item)
+		require.Nil(t, err, "could not decrypt interaction")
+		plain = append(plain, string(decrypted))
+	}
+	return plain
+}
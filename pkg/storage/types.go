@@ -1,6 +1,10 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
 	"sync"
 	"time"
 )
@@ -14,6 +18,7 @@ type CacheMetrics struct {
 	LoadErrorCount   uint64        `json:"load-error-count"`
 	TotalLoadTime    time.Duration `json:"total-load-time"`
 	EvictionCount    uint64        `json:"eviction-count"`
+	DroppedCount     uint64        `json:"dropped-count"`
 }
 
 // CorrelationData is the data for a correlation-id.
@@ -27,4 +32,110 @@ type CorrelationData struct {
 	AESKeyEncrypted string `json:"aes-key"`
 	// decrypted AES key for signing
 	AESKey []byte `json:"-"`
+	// expiries are the deadlines of Data set when a protocol eviction ttl applies
+	expiries []time.Time
+	// count and lastSeen are the number of interactions added since the
+	// registration and the time of the last one, polling keeping them
+	count    int
+	lastSeen time.Time
+	// publicKey is the client public key the AES key is encrypted with
+	publicKey string
+	// secretKeyHash replaces SecretKey for the ids restored from a snapshot
+	secretKeyHash string
+	// sealed are the interactions restored from a snapshot, encrypted with
+	// the AES keys of the previous runs
+	sealed []sealedBatch
+}
+
+// sealedBatch holds interactions encrypted with the AES key of a previous
+// run, returned to the client along with AESKeyEncrypted.
+type sealedBatch struct {
+	AESKeyEncrypted string      `json:"aes-key-encrypted,omitempty"`
+	Data            []string    `json:"data"`
+	Expiries        []time.Time `json:"expiries,omitempty"`
+}
+
+// hashSecretKey returns the hash of a secret key, compared case-insensitively
+func hashSecretKey(secret string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(secret)))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkSecret returns true if secret is the secret key of the correlation-id
+func (c *CorrelationData) checkSecret(secret string) bool {
+	if c.secretKeyHash != "" {
+		return subtle.ConstantTimeCompare([]byte(c.secretKeyHash), []byte(hashSecretKey(secret))) == 1
+	}
+	return strings.EqualFold(c.SecretKey, secret)
+}
+
+// takeSealed removes and returns the oldest sealed interactions along with
+// their encrypted AES key, ok being false once none are left.
+func (c *CorrelationData) takeSealed(now time.Time) (data []string, aesKeyEncrypted string, ok bool) {
+	c.Lock()
+	defer c.Unlock()
+	for len(c.sealed) > 0 {
+		batch := c.sealed[0]
+		c.sealed = c.sealed[1:]
+		if batch.Data, batch.Expiries = pruneExpired(batch.Data, batch.Expiries, now); len(batch.Data) > 0 {
+			return batch.Data, batch.AESKeyEncrypted, true
+		}
+	}
+	return nil, "", false
+}
+
+// recordInteraction counts an interaction added at now
+func (c *CorrelationData) recordInteraction(now time.Time) {
+	c.Lock()
+	c.count++
+	c.lastSeen = now
+	c.Unlock()
+}
+
+// appendData adds an interaction expiring at deadline, the zero time
+// keeping it until the correlation-id is evicted.
+func (c *CorrelationData) appendData(data string, deadline time.Time) {
+	if !deadline.IsZero() || len(c.expiries) > 0 {
+		c.expiries = append(c.expiries, make([]time.Time, len(c.Data)-len(c.expiries))...)
+		c.expiries = append(c.expiries, deadline)
+	}
+	c.Data = append(c.Data, data)
+}
+
+// pruneData drops the interactions past their deadline
+func (c *CorrelationData) pruneData(now time.Time) {
+	c.Data, c.expiries = pruneExpired(c.Data, c.expiries, now)
+}
+
+// pruneExpired drops the data past their deadline in expiries
+func pruneExpired(data []string, expiries []time.Time, now time.Time) ([]string, []time.Time) {
+	if len(expiries) != len(data) {
+		return data, expiries
+	}
+	kept := 0
+	for i, item := range data {
+		if deadline := expiries[i]; deadline.IsZero() || now.Before(deadline) {
+			data[kept], expiries[kept] = item, deadline
+			kept++
+		}
+	}
+	return data[:kept], expiries[:kept]
+}
+
+// trimData drops the oldest interactions over limit and returns their count
+func (c *CorrelationData) trimData(limit int) int {
+	if limit <= 0 || len(c.Data) <= limit {
+		return 0
+	}
+	dropped := len(c.Data) - limit
+	c.Data = append(c.Data[:0], c.Data[dropped:]...)
+	if len(c.expiries) > 0 {
+		c.expiries = append(c.expiries[:0], c.expiries[dropped:]...)
+	}
+	return dropped
+}
+
+// resetData drops all the interactions
+func (c *CorrelationData) resetData() {
+	c.Data, c.expiries, c.sealed = nil, nil, nil
 }
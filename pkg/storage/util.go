@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"compress/gzip"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -58,6 +59,48 @@ func AESEncrypt(key []byte, message []byte) (string, error) {
 	return string(encMessage), nil
 }
 
+// AESDecrypt decrypts a message encrypted with AESEncrypt
+func AESDecrypt(key []byte, message string) ([]byte, error) {
+	cipherText, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherText) < aes.BlockSize {
+		return nil, errors.New("cipher text is less than block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plainText := make([]byte, len(cipherText)-aes.BlockSize)
+	stream := cipher.NewCFBDecrypter(block, cipherText[:aes.BlockSize])
+	stream.XORKeyStream(plainText, cipherText[aes.BlockSize:])
+	return plainText, nil
+}
+
+// gzipData compresses data with gzip
+func gzipData(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// gunzipData decompresses gzip data
+func gunzipData(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
 func AppendMany(sep string, slices ...[]byte) []byte {
 	var final [][]byte
 	for _, slice := range slices {